@@ -0,0 +1,285 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/endocrimes/endobot/internal/audit"
+	"github.com/endocrimes/endobot/internal/hmacauth"
+	"github.com/endocrimes/endobot/internal/tokensigner"
+	"github.com/endocrimes/endobot/internal/webhook"
+	"github.com/gorilla/mux"
+)
+
+// maxBodySize bounds the request bodies read into memory.
+const maxBodySize = 1 << 20
+
+const (
+	KindToken   = "token"
+	KindSigned  = "hmac"
+	KindWebhook = "webhook"
+	KindUnix    = "unix"
+)
+
+// Principal is the authenticated sender of a request.
+type Principal struct {
+	// ID identifies the credential that was used, prefixed by its Kind.
+	ID     string
+	Kind   string
+	ChatID int64
+
+	// Name is a human readable description of the credential.
+	Name string
+
+	// UserID is the Telegram user that owns the credential, or zero if it
+	// isn't owned by a Telegram user.
+	UserID int64
+
+	// Token holds the verified claims when the request used a token.
+	Token *tokensigner.Claims
+}
+
+// credentialResolver authenticates one kind of credential. Resolve returns
+// a nil Principal and error when r doesn't carry that kind of credential.
+type credentialResolver interface {
+	Resolve(r *http.Request) (*Principal, error)
+}
+
+// authenticate resolves the credentials presented with r. Resolvers are
+// tried in order and the first that recognizes the request decides.
+func (s *server) authenticate(r *http.Request) (*Principal, error) {
+	for _, resolver := range s.resolvers {
+		p, err := resolver.Resolve(r)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			return p, nil
+		}
+	}
+
+	return nil, CodedError(401, "Missing token in request")
+}
+
+// peerResolver authenticates unix socket callers by their user, or failing
+// that their primary group.
+type peerResolver struct {
+	s *server
+}
+
+func (p *peerResolver) Resolve(r *http.Request) (*Principal, error) {
+	cred, ok := r.Context().Value(peerCredKey{}).(*peerCred)
+	if !ok {
+		return nil, nil
+	}
+	if cred == nil {
+		p.s.logger.Warn("unix socket peer credentials are unavailable, falling back to other credentials",
+			"route", routeTemplate(r))
+		return nil, nil
+	}
+	return p.s.authenticatePeer(cred)
+}
+
+// webhookRoutes are the only routes webhook keys may be used with, as they
+// are meant for sending notifications and nothing else.
+var webhookRoutes = map[string]bool{
+	"/in/{key}": true,
+	"/notify":   true,
+}
+
+// webhookResolver authenticates webhook keys, either from the /in/{key}
+// URL or an "Authorization: Key <key>" header.
+type webhookResolver struct {
+	s        *server
+	webhooks *webhook.Registry
+}
+
+func (w *webhookResolver) Resolve(r *http.Request) (*Principal, error) {
+	key := mux.Vars(r)["key"]
+	if key == "" {
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Key ") {
+			return nil, nil
+		}
+		key = strings.TrimPrefix(header, "Key ")
+	}
+
+	hook := w.webhooks.Resolve(key)
+	if hook == nil {
+		w.s.logger.Info("unknown webhook key")
+		w.s.auditAuthFailure(r, KindWebhook, "", 0, "unknown key")
+		return nil, CodedError(401, "the provided key was invalid")
+	}
+	if route := routeTemplate(r); !webhookRoutes[route] {
+		w.s.logger.Info("webhook key used with another route", "webhook_id", hook.ID, "route", route)
+		w.s.auditAuthFailure(r, KindWebhook, KindWebhook+":"+hook.ID, hook.ChatID, "route not allowed")
+		return nil, CodedError(403, "webhook keys may only be used with POST /in/{key} and POST /notify")
+	}
+
+	return &Principal{
+		ID:     KindWebhook + ":" + hook.ID,
+		Kind:   KindWebhook,
+		ChatID: hook.ChatID,
+		Name:   hook.Name,
+		UserID: hook.CreatedBy,
+	}, nil
+}
+
+// signedResolver authenticates requests signed with hmacauth. The body is
+// consumed to check its hash and replaced so handlers can still read it.
+type signedResolver struct {
+	s       *server
+	signing *hmacauth.Verifier
+}
+
+func (sr *signedResolver) Resolve(r *http.Request) (*Principal, error) {
+	if !hmacauth.IsSigned(r) {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	client, err := sr.signing.Verify(r, body)
+	if err != nil {
+		sr.s.logger.Info("signature verification failed", "error", err)
+		sr.s.auditAuthFailure(r, KindSigned, "", 0, err.Error())
+		return nil, CodedError(401, "the request signature was invalid")
+	}
+
+	return &Principal{
+		ID:     KindSigned + ":" + client.ID,
+		Kind:   KindSigned,
+		ChatID: client.ChatID,
+		Name:   client.Name,
+		UserID: client.CreatedBy,
+	}, nil
+}
+
+// tokenResolver authenticates tokens and enforces their source address
+// allowlist.
+type tokenResolver struct {
+	s *server
+}
+
+func (t *tokenResolver) Resolve(r *http.Request) (*Principal, error) {
+	token := t.s.parseToken(r)
+	if token == "" {
+		return nil, nil
+	}
+
+	s := t.s
+	claims, err := s.tokenUnsigner.VerifyToken([]byte(token))
+	if err != nil {
+		s.logger.Info("token verification failed", "error", err)
+		s.auditAuthFailure(r, KindToken, "", 0, err.Error())
+		return nil, CodedError(401, "the provided token was invalid")
+	}
+
+	ip := s.clientIP(r)
+	if ip == nil {
+		return nil, CodedError(400, "unable to determine client address")
+	}
+	allowed := claims.AllowsAddr(ip)
+
+	isNew, isFirst, err := s.registry.ObserveAddr(claims, ip.String())
+	if err != nil {
+		s.logger.Error("failed to record token address", "token_id", claims.ID, "error", err)
+	}
+	if isNew && (!isFirst || !allowed) {
+		s.bot.AlertTokenUse(claims, ip.String(), !allowed)
+	}
+
+	if !allowed {
+		s.logger.Info("token used from disallowed address", "token_id", claims.ID, "address", ip)
+		s.auditAuthFailure(r, KindToken, KindToken+":"+claims.ID, claims.ChatID, "address not allowed")
+		return nil, CodedError(403, "the provided token may not be used from this address")
+	}
+
+	return &Principal{
+		ID:     KindToken + ":" + claims.ID,
+		Kind:   KindToken,
+		ChatID: claims.ChatID,
+		Name:   tokenName(claims),
+		UserID: claims.UserID,
+		Token:  claims,
+	}, nil
+}
+
+// auditAuthFailure records a request whose credential was rejected. actor
+// is the credential if it is known, otherwise the client's address is used.
+func (s *server) auditAuthFailure(r *http.Request, kind, actor string, chatID int64, reason string) {
+	details := map[string]interface{}{
+		"kind":   kind,
+		"reason": reason,
+	}
+	if ip := s.clientIP(r); ip != nil {
+		details["address"] = ip.String()
+		if actor == "" {
+			actor = "addr:" + ip.String()
+		}
+	}
+	details["route"] = routeTemplate(r)
+
+	s.bot.RecordAudit(&audit.Entry{
+		Action:  audit.ActionAuthFailed,
+		Actor:   actor,
+		ChatID:  chatID,
+		Details: details,
+	})
+}
+
+func tokenName(claims *tokensigner.Claims) string {
+	if claims.Username != "" {
+		return "@" + claims.Username
+	}
+	return fmt.Sprintf("user %d", claims.UserID)
+}
+
+// clientIP returns the address of the client that made r. When the request
+// was forwarded by a trusted proxy the configured header is used, walking
+// it from the right so that clients can't spoof their address by sending
+// the header themselves.
+func (s *server) clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !s.isTrustedProxy(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values(s.cfg.RealIPHeader) {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !s.isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (s *server) isTrustedProxy(ip net.IP) bool {
+	for _, n := range s.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
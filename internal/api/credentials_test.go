@@ -0,0 +1,243 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/audit"
+	"github.com/endocrimes/endobot/internal/bot"
+	"github.com/endocrimes/endobot/internal/chats"
+	"github.com/endocrimes/endobot/internal/dedupe"
+	"github.com/endocrimes/endobot/internal/hmacauth"
+	"github.com/endocrimes/endobot/internal/store"
+	"github.com/endocrimes/endobot/internal/tokensigner"
+	"github.com/endocrimes/endobot/internal/tokensigner/jwt"
+	"github.com/endocrimes/endobot/internal/webhook"
+	jwtlib "github.com/gbrlsnchs/jwt/v3"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+)
+
+const (
+	testOwner    = 10
+	testUser     = 20
+	testOwnChat  = 10
+	testUserChat = -300
+)
+
+// okTelegram answers every Telegram API call successfully.
+type okTelegram struct{}
+
+func (okTelegram) RoundTrip(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"ok": true, "result": true}`))),
+		Request:    r,
+	}, nil
+}
+
+type testServer struct {
+	*server
+	bot      *bot.Bot
+	signer   *jwt.TokenSigner
+	signing  *hmacauth.Verifier
+	webhooks *webhook.Registry
+}
+
+func newTestServer(t *testing.T) *testServer {
+	st, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry, err := tokensigner.NewRegistry(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signing, err := hmacauth.New(st, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks, err := webhook.NewRegistry(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatDir, err := chats.NewDirectory(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dd, err := dedupe.New(st, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &jwt.TokenSigner{Secret: jwtlib.NewHS256([]byte("secret")), Registry: registry, Chats: chatDir}
+
+	tg := &tgbotapi.BotAPI{Token: "test", Client: &http.Client{Transport: okTelegram{}}}
+	b, err := bot.New(hclog.NewNullLogger(), tg, signer, registry, signing, webhooks, chatDir, st, &bot.Config{
+		Owners:       []int64{testOwner},
+		AllowedUsers: []int64{testUser},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(hclog.NewNullLogger(), b, signer, registry, signing, webhooks, dd, &Config{
+		UnixUsers: []string{"1000=" + strconv.Itoa(testUserChat)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testServer{server: s.(*server), bot: b, signer: signer, signing: signing, webhooks: webhooks}
+}
+
+// do serves r with the routes of the API.
+func (s *testServer) do(r *http.Request) *httptest.ResponseRecorder {
+	router := mux.NewRouter()
+	s.registerRoutes(router)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func (s *testServer) token(t *testing.T, chatID, userID int64) string {
+	chat := &tgbotapi.Chat{ID: chatID, Type: "group"}
+	token, _, err := s.signer.GenerateToken(chat, &tgbotapi.User{ID: int(userID)}, &tokensigner.TokenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(token)
+}
+
+func signRequest(r *http.Request, client *hmacauth.Client) {
+	ts := time.Now().Unix()
+	path := r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	sig := hmacauth.Sign(client.Secret, hmacauth.StringToSign(r.Method, path, ts, "nonce", nil))
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s, Timestamp=%d, Nonce=nonce, Signature=%s",
+		hmacauth.Scheme, client.ID, ts, sig))
+}
+
+func TestAuditVisibility(t *testing.T) {
+	s := newTestServer(t)
+	for _, chatID := range []int64{testOwnChat, testUserChat, -400} {
+		s.bot.RecordAudit(&audit.Entry{Action: audit.ActionTokenIssued, Actor: "user:1", ChatID: chatID})
+	}
+
+	// Credentials created by the owner for another chat.
+	_, key, err := s.webhooks.Create(testUserChat, func(int64) bool { return false }, "hook", testOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := s.signing.NewClient(testUserChat, "key", testOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name      string
+		authorize func(r *http.Request) *http.Request
+		code      int
+		want      int
+	}{
+		{"owner token", func(r *http.Request) *http.Request {
+			r.Header.Set("Authorization", "Bearer "+s.token(t, testOwnChat, testOwner))
+			return r
+		}, 200, 3},
+		{"owner token for another chat", func(r *http.Request) *http.Request {
+			r.Header.Set("Authorization", "Bearer "+s.token(t, testUserChat, testOwner))
+			return r
+		}, 200, 3},
+		{"user token", func(r *http.Request) *http.Request {
+			r.Header.Set("Authorization", "Bearer "+s.token(t, testUserChat, testUser))
+			return r
+		}, 200, 1},
+		{"signing key created by an owner", func(r *http.Request) *http.Request {
+			signRequest(r, client)
+			return r
+		}, 200, 1},
+		{"unix socket", func(r *http.Request) *http.Request {
+			return r.WithContext(context.WithValue(r.Context(), peerCredKey{}, &peerCred{UID: 1000, GID: 1000}))
+		}, 200, 1},
+		{"webhook created by an owner", func(r *http.Request) *http.Request {
+			r.Header.Set("Authorization", "Key "+key)
+			return r
+		}, 403, 0},
+	}
+	for _, tc := range cases {
+		w := s.do(tc.authorize(httptest.NewRequest("GET", "/audit?action=token.issued", nil)))
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d: %s", tc.name, w.Code, tc.code, w.Body)
+			continue
+		}
+		if tc.code != 200 {
+			continue
+		}
+		var resp ListAuditResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Entries) != tc.want {
+			t.Errorf("%s: got %d entries, want %d", tc.name, len(resp.Entries), tc.want)
+		}
+		for _, e := range resp.Entries {
+			if tc.want == 1 && e.ChatID != testUserChat {
+				t.Errorf("%s: got an entry about chat %d", tc.name, e.ChatID)
+			}
+		}
+	}
+}
+
+func TestWebhookKeyRoutes(t *testing.T) {
+	s := newTestServer(t)
+	hook, key, err := s.webhooks.Create(testUserChat, func(int64) bool { return false }, "hook", testUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Authenticate on every route without doing anything else.
+	router := mux.NewRouter()
+	whoami := s.wrap(func(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+		return s.authenticate(r)
+	})
+	for _, route := range []string{"/notify", "/in/{key}", "/notify/batch", "/messages", "/scheduled/{id}"} {
+		router.HandleFunc(route, whoami)
+	}
+
+	cases := []struct {
+		path   string
+		header bool
+		code   int
+	}{
+		{"/in/" + key, false, 200},
+		{"/notify", true, 200},
+		{"/notify/batch", true, 403},
+		{"/messages", true, 403},
+		{"/scheduled/1", true, 403},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("POST", tc.path, nil)
+		if tc.header {
+			r.Header.Set("Authorization", "Key "+key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Errorf("%s: got status %d, want %d: %s", tc.path, w.Code, tc.code, w.Body)
+		}
+	}
+
+	denied := s.bot.AuditLog(testUserChat, 0, audit.Query{Action: audit.ActionAuthFailed})
+	if len(denied) != 1 || denied[0].Actor != "webhook:"+hook.ID || denied[0].Details["reason"] != "route not allowed" {
+		t.Fatalf("got audit entries %v, want the first use with another route recorded", denied)
+	}
+}
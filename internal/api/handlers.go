@@ -1,36 +1,764 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/endocrimes/endobot/internal/audit"
+	"github.com/endocrimes/endobot/internal/bot"
+	"github.com/endocrimes/endobot/internal/dedupe"
+	"github.com/endocrimes/endobot/internal/history"
 	"github.com/gorilla/mux"
 )
 
+const (
+	priorityNormal = "normal"
+	priorityHigh   = "high"
+)
+
 func (s *server) registerRoutes(r *mux.Router) {
 	r.HandleFunc("/notify", s.wrap(s.notify)).Methods("POST")
+	r.HandleFunc("/in/{key}", s.wrap(s.notify)).Methods("POST")
+	r.HandleFunc("/notify/batch", s.wrap(s.notifyBatch)).Methods("POST")
+	r.HandleFunc("/token/cidrs", s.wrap(s.setTokenCIDRs)).Methods("PUT")
+	r.HandleFunc("/token/dedupe", s.wrap(s.setTokenDedupe)).Methods("PUT")
+	r.HandleFunc("/whoami", s.wrap(s.whoami)).Methods("GET")
+	r.HandleFunc("/scheduled", s.wrap(s.listScheduled)).Methods("GET")
+	r.HandleFunc("/scheduled/{id}", s.wrap(s.cancelScheduled)).Methods("DELETE")
+	r.HandleFunc("/messages", s.wrap(s.listMessages)).Methods("GET")
+	r.HandleFunc("/audit", s.wrap(s.listAudit)).Methods("GET")
+	r.HandleFunc("/recurring", s.wrap(s.listRecurring)).Methods("GET")
+	r.HandleFunc("/recurring", s.wrap(s.addRecurring)).Methods("POST")
+	r.HandleFunc("/recurring/preview", s.wrap(s.previewRecurring)).Methods("GET")
+	r.HandleFunc("/recurring/{id}/pause", s.wrap(s.pauseRecurring)).Methods("POST")
+	r.HandleFunc("/recurring/{id}/resume", s.wrap(s.resumeRecurring)).Methods("POST")
+	r.HandleFunc("/recurring/{id}", s.wrap(s.deleteRecurring)).Methods("DELETE")
 }
 
+// idempotencyHeader carries a key that makes retrying a request safe: a
+// repeat within the window is answered with the original response.
+const idempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength bounds the idempotency keys that are remembered.
+const maxIdempotencyKeyLength = 255
+
 func (s *server) notify(w http.ResponseWriter, r *http.Request) (interface{}, error) {
-	token, err := s.parseToken(r)
+	principal, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := decodeNotification(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, replayed, err := s.idempotent(principal, r.Header.Get(idempotencyHeader), req, func() (interface{}, error) {
+		return s.sendNotification(principal, req)
+	})
+	if err != nil {
+		return nil, rateLimitError(w, err)
+	}
+	if replayed {
+		w.Header().Set("Idempotent-Replayed", "true")
+	}
+	return resp, nil
+}
+
+const (
+	// maxBatchSize bounds the number of notifications in a batch.
+	maxBatchSize = 100
+
+	// maxGroupBatchSize bounds batches to groups, which Telegram lets the
+	// bot send 20 messages a minute, so that a batch is sent within about a
+	// minute rather than holding the request open.
+	maxGroupBatchSize = 20
+)
+
+func (s *server) notifyBatch(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var reqs []*BatchNotificationRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, maxBodySize))
+	err = dec.Decode(&reqs)
+	if err != nil {
+		return nil, CodedError(400, fmt.Sprintf("invalid request body: %v", err))
+	}
+	limit := maxBatchSize
+	if principal.ChatID < 0 {
+		limit = maxGroupBatchSize
+	}
+	if len(reqs) == 0 || len(reqs) > limit {
+		return nil, CodedError(400, fmt.Sprintf("a batch must have from 1 to %d notifications", limit))
+	}
+	// Nothing is sent unless every notification is valid.
+	for i, req := range reqs {
+		if err := prepareNotification(&req.SendNotificationRequest); err != nil {
+			return nil, CodedError(400, fmt.Sprintf("notification %d: %v", i, err))
+		}
+	}
+
+	resp := &BatchNotificationResponse{Results: make([]*BatchNotificationResult, len(reqs))}
+	var throttled error
+	for i, req := range reqs {
+		result := &BatchNotificationResult{Status: http.StatusOK}
+		resp.Results[i] = result
+
+		// Once a limit is hit the rest would be sent out of order, if at
+		// all, so they are refused too.
+		err := throttled
+		if err == nil {
+			// Keys are shared with /notify, so the fingerprint must not
+			// include the key itself.
+			notification := &req.SendNotificationRequest
+			var sent interface{}
+			sent, result.Replayed, err = s.idempotent(principal, req.IdempotencyKey, notification, func() (interface{}, error) {
+				return s.sendNotification(principal, notification)
+			})
+			if err == nil {
+				result.SendNotificationResponse, err = batchResponse(sent)
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		result.Status = http.StatusInternalServerError
+		result.Error = err.Error()
+		if limited, ok := err.(*bot.RateLimitedError); ok {
+			result.Status = http.StatusTooManyRequests
+			result.RetryAfter = retryAfterSeconds(limited)
+			throttled = err
+		} else if coded, ok := err.(HTTPCodedError); ok {
+			result.Status = coded.Code()
+		}
+	}
+	return resp, nil
+}
+
+// batchResponse returns the response to a notification in a batch, which
+// is a json.RawMessage when it was replayed.
+func batchResponse(sent interface{}) (*SendNotificationResponse, error) {
+	switch sent := sent.(type) {
+	case *SendNotificationResponse:
+		return sent, nil
+	case json.RawMessage:
+		var resp SendNotificationResponse
+		err := json.Unmarshal(sent, &resp)
+		return &resp, err
+	}
+	return nil, fmt.Errorf("unexpected response %T", sent)
+}
+
+// idempotent runs fn unless principal already made the same request with
+// key, in which case the response to that request is returned instead.
+// Requests without a key always run fn. Only successful responses are
+// remembered, so failed requests can be retried with the same key.
+func (s *server) idempotent(principal *Principal, key string, req interface{}, fn func() (interface{}, error)) (interface{}, bool, error) {
+	if key == "" {
+		resp, err := fn()
+		return resp, false, err
+	}
+	if len(key) > maxIdempotencyKeyLength {
+		return nil, false, CodedError(400, fmt.Sprintf("the idempotency key must be at most %d characters", maxIdempotencyKeyLength))
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, false, err
+	}
+	body, err := s.dedupe.Begin(principal.ID, key, dedupe.Hash(data), time.Now())
+	switch err {
+	case nil:
+	case dedupe.ErrKeyReused:
+		return nil, false, CodedError(422, err.Error())
+	case dedupe.ErrInProgress:
+		return nil, false, CodedError(409, err.Error())
+	default:
+		return nil, false, err
+	}
+	if body != nil {
+		return body, true, nil
+	}
+
+	resp, err := fn()
+	if err != nil {
+		s.dedupe.Abort(principal.ID, key)
+		return nil, false, err
+	}
+	body, err = json.Marshal(resp)
+	if err == nil {
+		err = s.dedupe.Complete(principal.ID, key, body, time.Now())
+	}
+	if err != nil {
+		s.logger.Error("failed to remember idempotent response", "credential_id", principal.ID, "error", err)
+	}
+	return resp, false, nil
+}
+
+// sendNotification delivers or schedules a notification from principal.
+// Notifications identical to one the credential sent within its dedupe
+// window are dropped. Refusals from the rate limiter are returned as a
+// *bot.RateLimitedError.
+func (s *server) sendNotification(principal *Principal, req *SendNotificationRequest) (resp *SendNotificationResponse, err error) {
+	now := time.Now()
+	var sendAt time.Time
+	if req.SendAt != "" {
+		sendAt, err = parseSendAt(req.SendAt, now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if window := s.dedupeWindow(principal); window > 0 {
+		content := []byte(req.Message)
+		dup, cerr := s.dedupe.Claim(principal.ID, content, window, now)
+		if cerr != nil {
+			s.logger.Error("failed to record notification content", "credential_id", principal.ID, "error", cerr)
+		}
+		if dup {
+			return &SendNotificationResponse{Suppressed: true, Duplicate: true}, nil
+		}
+		defer func() {
+			if err != nil {
+				if rerr := s.dedupe.Release(principal.ID, content); rerr != nil {
+					s.logger.Error("failed to forget notification content", "credential_id", principal.ID, "error", rerr)
+				}
+			}
+		}()
+	}
+
+	if err := s.bot.CheckRateLimit(principal.ID, principal.ChatID); err != nil {
+		return nil, err
+	}
+
+	n := &bot.Notification{
+		ChatID:     principal.ChatID,
+		Text:       req.Message,
+		Silent:     req.DisableNotification.Ptr(),
+		High:       req.Priority == priorityHigh,
+		Source:     principal.ID,
+		SourceName: principal.Name,
+		Buttons:    req.Buttons,
+		Format:     req.Format,
+	}
+
+	if sendAt.After(now) {
+		sn, err := s.bot.Schedule(n, sendAt)
+		if err != nil {
+			return nil, err
+		}
+		return &SendNotificationResponse{ScheduledID: sn.ID, SendAt: &sn.SendAt}, nil
+	}
+
+	err = s.bot.Notify(n)
+	if muted, ok := err.(*bot.MutedError); ok {
+		return &SendNotificationResponse{Suppressed: true, MutedUntil: &muted.Until}, nil
+	}
+	if err != nil {
+		return nil, deliveryError(err)
+	}
+	return &SendNotificationResponse{}, nil
+}
+
+// dedupeWindow returns how long the notifications of principal are
+// remembered to drop identical ones. Only tokens have one.
+func (s *server) dedupeWindow(principal *Principal) time.Duration {
+	if principal.Token == nil {
+		return 0
+	}
+	rec := s.registry.Get(principal.Token.ID)
+	if rec == nil {
+		return 0
+	}
+	return rec.DedupeWindow
+}
+
+// rateLimitError turns a refusal from the rate limiter into a 429 response
+// telling the client when to try again.
+func rateLimitError(w http.ResponseWriter, err error) error {
+	limited, ok := err.(*bot.RateLimitedError)
+	if !ok {
+		return err
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds(limited), 10))
+	return CodedError(429, limited.Error())
+}
+
+// retryAfterSeconds returns how many whole seconds to wait before retrying
+// a request refused by the rate limiter.
+func retryAfterSeconds(limited *bot.RateLimitedError) int64 {
+	return int64(math.Ceil(limited.RetryAfter.Seconds()))
+}
+
+// parseSendAt parses when a notification should be sent: an RFC 3339
+// timestamp or a duration from now such as "90m".
+func parseSendAt(s string, now time.Time) (time.Time, error) {
+	if at, err := time.Parse(time.RFC3339, s); err == nil {
+		return at, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, CodedError(400, "send_at must be an RFC 3339 timestamp or a duration like 90m")
+	}
+	return now.Add(d), nil
+}
+
+func (s *server) listScheduled(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := s.authenticate(r)
 	if err != nil {
 		return nil, err
 	}
 
-	chatID, err := s.tokenUnsigner.VerifyToken([]byte(token))
+	resp := &ListScheduledResponse{Scheduled: []*ScheduledNotification{}}
+	for _, sn := range s.bot.Scheduled(principal.ChatID) {
+		resp.Scheduled = append(resp.Scheduled, &ScheduledNotification{
+			ID:        sn.ID,
+			SendAt:    sn.SendAt,
+			CreatedAt: sn.CreatedAt,
+			CreatedBy: sn.CreatedBy,
+			Message:   sn.Notification.Text,
+		})
+	}
+	return resp, nil
+}
+
+func (s *server) cancelScheduled(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := s.authenticate(r)
 	if err != nil {
-		s.logger.Info("token verification failed", "error", err)
-		return nil, CodedError(401, fmt.Sprintf("the provided token was invalid"))
+		return nil, err
+	}
+
+	id := mux.Vars(r)["id"]
+	ok, err := s.bot.CancelScheduled(principal.ChatID, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, CodedError(404, "no such scheduled notification")
+	}
+	return &CancelScheduledResponse{ID: id}, nil
+}
+
+const (
+	defaultMessagesLimit = 100
+	maxMessagesLimit     = 10000
+)
+
+func (s *server) listMessages(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	query := r.URL.Query()
+	now := time.Now()
+	q := history.Query{
+		Source: query.Get("source"),
+		Text:   query.Get("q"),
+		Limit:  defaultMessagesLimit,
+	}
+	if q.Since, err = parseTimeBound("since", query.Get("since"), now); err != nil {
+		return nil, err
+	}
+	if q.Until, err = parseTimeBound("until", query.Get("until"), now); err != nil {
+		return nil, err
+	}
+	if l := query.Get("limit"); l != "" {
+		q.Limit, err = strconv.Atoi(l)
+		if err != nil || q.Limit < 1 || q.Limit > maxMessagesLimit {
+			return nil, CodedError(400, fmt.Sprintf("limit must be a number from 1 to %d", maxMessagesLimit))
+		}
+	}
+
+	records := s.bot.Messages(principal.ChatID, q)
+	switch format := query.Get("format"); format {
+	case "", bot.ExportJSON:
+		resp := &ListMessagesResponse{Messages: []*Message{}}
+		for _, rec := range records {
+			resp.Messages = append(resp.Messages, &Message{
+				ID:          rec.ID,
+				Source:      rec.Source,
+				SourceName:  rec.SourceName,
+				Text:        rec.Text,
+				ReceivedAt:  rec.ReceivedAt,
+				DeliveredAt: rec.DeliveredAt,
+				Status:      rec.Status,
+				Error:       rec.Error,
+				ScheduledID: rec.ScheduledID,
+			})
+		}
+		return resp, nil
+	case bot.ExportCSV:
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="messages.csv"`)
+		// The response has started, so errors can only be logged.
+		if err := bot.ExportMessages(w, format, records); err != nil {
+			s.logger.Error("failed to write messages", "error", err)
+		}
+		return nil, nil
+	default:
+		return nil, CodedError(400, fmt.Sprintf("format must be %q or %q", bot.ExportJSON, bot.ExportCSV))
+	}
+}
+
+func (s *server) listAudit(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	query := r.URL.Query()
+	now := time.Now()
+	q := audit.Query{
+		Action: query.Get("action"),
+		Actor:  query.Get("actor"),
+		Limit:  defaultMessagesLimit,
+	}
+	if q.Since, err = parseTimeBound("since", query.Get("since"), now); err != nil {
+		return nil, err
+	}
+	if q.Until, err = parseTimeBound("until", query.Get("until"), now); err != nil {
+		return nil, err
+	}
+	if l := query.Get("limit"); l != "" {
+		q.Limit, err = strconv.Atoi(l)
+		if err != nil || q.Limit < 1 || q.Limit > maxMessagesLimit {
+			return nil, CodedError(400, fmt.Sprintf("limit must be a number from 1 to %d", maxMessagesLimit))
+		}
+	}
+
+	// Only tokens carry their owner in signed claims, other credentials
+	// merely record who created them and see their own chat.
+	var ownerID int64
+	if principal.Token != nil {
+		ownerID = principal.Token.UserID
+	}
+	resp := &ListAuditResponse{Entries: []*AuditEntry{}}
+	for _, e := range s.bot.AuditLog(principal.ChatID, ownerID, q) {
+		resp.Entries = append(resp.Entries, &AuditEntry{
+			ID:      e.ID,
+			Time:    e.Time,
+			Action:  e.Action,
+			Actor:   e.Actor,
+			ChatID:  e.ChatID,
+			Details: e.Details,
+		})
+	}
+	return resp, nil
+}
+
+// parseTimeBound parses the start or end of a time range: an RFC 3339
+// timestamp or a duration before now such as "24h".
+func parseTimeBound(name, s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, CodedError(400, fmt.Sprintf("%s must be an RFC 3339 timestamp or a duration like 24h", name))
+	}
+	return now.Add(-d), nil
+}
+
+// maxPreviewRuns bounds how many runs of a cron expression can be previewed
+// at once.
+const maxPreviewRuns = 50
+
+func (s *server) addRecurring(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var req AddRecurringRequest
+	err = json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&req)
+	if err != nil {
+		return nil, CodedError(400, fmt.Sprintf("invalid request body: %v", err))
+	}
+	message := strings.TrimSpace(req.Title + "\n\n" + req.Message)
+	if message == "" {
+		return nil, CodedError(400, "message must not be empty")
+	}
+	switch req.Priority {
+	case "", priorityNormal, priorityHigh:
+	default:
+		return nil, CodedError(400, fmt.Sprintf("priority must be %q or %q", priorityNormal, priorityHigh))
+	}
+	if req.Timezone == "" {
+		req.Timezone = s.bot.Timezone(principal.ChatID)
+	}
+
+	runs, err := s.bot.PreviewCron(req.Cron, req.Timezone, bot.DefaultPreviewRuns)
+	if err != nil {
+		return nil, CodedError(400, err.Error())
+	}
+	if len(runs) == 0 {
+		return nil, CodedError(400, "the cron expression never matches")
+	}
+
+	rn, err := s.bot.AddRecurring(&bot.Notification{
+		ChatID:     principal.ChatID,
+		Text:       message,
+		Silent:     req.DisableNotification.Ptr(),
+		High:       req.Priority == priorityHigh,
+		Source:     principal.ID,
+		SourceName: principal.Name,
+	}, req.Cron, req.Timezone)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := recurringNotification(rn)
+	resp.NextRuns = runs
+	return resp, nil
+}
+
+func recurringNotification(rn *bot.RecurringNotification) *RecurringNotification {
+	out := &RecurringNotification{
+		ID:        rn.ID,
+		Cron:      rn.Cron,
+		Timezone:  rn.Timezone,
+		Paused:    rn.Paused,
+		CreatedAt: rn.CreatedAt,
+		CreatedBy: rn.CreatedBy,
+		Message:   rn.Notification.Text,
+	}
+	if !rn.Paused {
+		out.NextRun = &rn.NextRun
+	}
+	return out
+}
+
+func (s *server) listRecurring(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ListRecurringResponse{Recurring: []*RecurringNotification{}}
+	for _, rn := range s.bot.Recurring(principal.ChatID) {
+		resp.Recurring = append(resp.Recurring, recurringNotification(rn))
+	}
+	return resp, nil
+}
+
+func (s *server) previewRecurring(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	query := r.URL.Query()
+	timezone := query.Get("timezone")
+	if timezone == "" {
+		timezone = s.bot.Timezone(principal.ChatID)
+	}
+	count := bot.DefaultPreviewRuns
+	if c := query.Get("count"); c != "" {
+		count, err = strconv.Atoi(c)
+		if err != nil || count < 1 || count > maxPreviewRuns {
+			return nil, CodedError(400, fmt.Sprintf("count must be a number from 1 to %d", maxPreviewRuns))
+		}
+	}
+
+	runs, err := s.bot.PreviewCron(query.Get("cron"), timezone, count)
+	if err != nil {
+		return nil, CodedError(400, err.Error())
+	}
+	return &PreviewRecurringResponse{Timezone: timezone, Runs: append([]time.Time{}, runs...)}, nil
+}
+
+func (s *server) pauseRecurring(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return s.setRecurringPaused(r, true)
+}
+
+func (s *server) resumeRecurring(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	return s.setRecurringPaused(r, false)
+}
+
+func (s *server) setRecurringPaused(r *http.Request, paused bool) (interface{}, error) {
+	principal, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	id := mux.Vars(r)["id"]
+	ok, err := s.bot.SetRecurringPaused(principal.ChatID, id, paused)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, CodedError(404, "no such recurring notification")
+	}
+	return &UpdateRecurringResponse{ID: id, Paused: paused}, nil
+}
+
+func (s *server) deleteRecurring(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	id := mux.Vars(r)["id"]
+	ok, err := s.bot.DeleteRecurring(principal.ChatID, id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, CodedError(404, "no such recurring notification")
+	}
+	return &DeleteRecurringResponse{ID: id}, nil
+}
+
+// deliveryError maps delivery failures that are the fault of the chat
+// rather than the server to specific client errors.
+func deliveryError(err error) error {
+	switch err {
+	case bot.ErrChatBlocked:
+		return CodedError(410, "the bot was blocked by the user or removed from the chat")
+	case bot.ErrChatNotFound:
+		return CodedError(410, "the chat no longer exists")
+	}
+	return err
+}
+
+// decodeNotification reads a notification from r. JSON bodies are decoded as
+// a SendNotificationRequest, anything else is used as the message text so
+// that `echo done | curl --data-binary @- ...` works.
+func decodeNotification(r *http.Request) (*SendNotificationRequest, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		return nil, err
 	}
 
 	var req SendNotificationRequest
-	dec := json.NewDecoder(r.Body)
-	err = dec.Decode(&req)
+	trimmed := bytes.TrimSpace(body)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") || bytes.HasPrefix(trimmed, []byte("{")) {
+		err = json.Unmarshal(body, &req)
+		if err != nil {
+			return nil, CodedError(400, fmt.Sprintf("invalid request body: %v", err))
+		}
+	} else {
+		req.Message = string(trimmed)
+	}
+
+	if err := prepareNotification(&req); err != nil {
+		return nil, CodedError(400, err.Error())
+	}
+	return &req, nil
+}
+
+// prepareNotification fills in the message of req from its alternative
+// fields and checks that it can be sent.
+func prepareNotification(req *SendNotificationRequest) error {
+	// Services posting their own payloads to webhooks often use "text"
+	// rather than "message".
+	if req.Message == "" {
+		req.Message = req.Text
+	}
+	if req.Title != "" {
+		req.Message = strings.TrimSpace(req.Title + "\n\n" + req.Message)
+	}
+
+	if req.Message == "" {
+		return fmt.Errorf("message must not be empty")
+	}
+	switch req.Priority {
+	case "", priorityNormal, priorityHigh:
+	default:
+		return fmt.Errorf("priority must be %q or %q", priorityNormal, priorityHigh)
+	}
+	if req.Format != "" && !bot.ValidFormat(req.Format) {
+		return fmt.Errorf("format must be plain, markdown or html")
+	}
+	return nil
+}
+
+func (s *server) setTokenCIDRs(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	claims := principal.Token
+	if claims == nil {
+		return nil, CodedError(400, "only tokens have an address allowlist")
+	}
+
+	var req SetTokenCIDRsRequest
+	err = json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&req)
+	if err != nil {
+		return nil, CodedError(400, fmt.Sprintf("invalid request body: %v", err))
+	}
+
+	err = s.registry.SetAllowedCIDRs(claims, req.AllowedCIDRs)
+	if err != nil {
+		return nil, CodedError(400, err.Error())
+	}
+
+	rec := s.registry.Get(claims.ID)
+	return &SetTokenCIDRsResponse{AllowedCIDRs: rec.AllowedCIDRs}, nil
+}
+
+func (s *server) setTokenDedupe(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := s.authenticate(r)
 	if err != nil {
 		return nil, err
 	}
+	claims := principal.Token
+	if claims == nil {
+		return nil, CodedError(400, "only tokens have a dedupe window")
+	}
+
+	var req SetTokenDedupeRequest
+	err = json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&req)
+	if err != nil {
+		return nil, CodedError(400, fmt.Sprintf("invalid request body: %v", err))
+	}
 
-	err = s.bot.Notify(chatID, req.Message)
-	return &SendNotificationResponse{}, err
+	var window time.Duration
+	if req.Window != "" {
+		window, err = time.ParseDuration(req.Window)
+		if err != nil || window < 0 {
+			return nil, CodedError(400, "window must be a duration like 10m, or 0 to disable it")
+		}
+	}
+	err = s.registry.SetDedupeWindow(claims, window)
+	if err != nil {
+		return nil, CodedError(400, err.Error())
+	}
+	return &SetTokenDedupeResponse{Window: window.String()}, nil
+}
+
+func (s *server) whoami(w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	principal, err := s.authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &WhoAmIResponse{
+		Kind:         principal.Kind,
+		CredentialID: principal.ID,
+		ChatID:       principal.ChatID,
+		UserID:       principal.UserID,
+		Name:         principal.Name,
+	}
+	if window := s.dedupeWindow(principal); window > 0 {
+		resp.DedupeWindow = window.String()
+	}
+	return resp, nil
 }
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/dedupe"
+	"github.com/endocrimes/endobot/internal/store"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestBatchItemsShareIdempotencyKeysWithNotify(t *testing.T) {
+	st, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dd, err := dedupe.New(st, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{logger: hclog.NewNullLogger(), dedupe: dd}
+	principal := &Principal{ID: "token:1"}
+
+	sends := 0
+	send := func() (interface{}, error) {
+		sends++
+		return &SendNotificationResponse{}, nil
+	}
+
+	single := &SendNotificationRequest{Message: "disk full"}
+	if _, _, err := s.idempotent(principal, "k", single, send); err != nil {
+		t.Fatal(err)
+	}
+
+	var batch []*BatchNotificationRequest
+	if err := json.Unmarshal([]byte(`[{"message": "disk full", "idempotency_key": "k"}]`), &batch); err != nil {
+		t.Fatal(err)
+	}
+	_, replayed, err := s.idempotent(principal, batch[0].IdempotencyKey, &batch[0].SendNotificationRequest, send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !replayed || sends != 1 {
+		t.Fatalf("got replayed=%v after %d sends, want the batch item replayed", replayed, sends)
+	}
+}
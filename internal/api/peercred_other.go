@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package api
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerCredentials is only implemented on linux.
+func peerCredentials(c net.Conn) (*peerCred, error) {
+	return nil, fmt.Errorf("peer credentials are not supported on this platform")
+}
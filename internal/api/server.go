@@ -4,27 +4,87 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/endocrimes/endobot/internal/bot"
+	"github.com/endocrimes/endobot/internal/dedupe"
+	"github.com/endocrimes/endobot/internal/hmacauth"
 	"github.com/endocrimes/endobot/internal/tokensigner"
+	"github.com/endocrimes/endobot/internal/webhook"
 	"github.com/gorilla/mux"
 	"github.com/hashicorp/go-hclog"
 )
 
+// Config holds the operator supplied settings for the API server.
+type Config struct {
+	// TrustedProxies are the networks of reverse proxies allowed to set
+	// RealIPHeader.
+	TrustedProxies []string
+
+	// RealIPHeader names the header trusted proxies use to pass on the
+	// client address, e.g. X-Forwarded-For.
+	RealIPHeader string
+
+	// UnixSocket is the path of an optional unix socket listener. Callers
+	// connecting through it are authenticated by their peer credentials
+	// using UnixUsers and UnixGroups, "user=chat" and "group=chat" mappings.
+	UnixSocket string
+	UnixUsers  []string
+	UnixGroups []string
+}
+
 type server struct {
-	logger        hclog.Logger
-	bot           *bot.Bot
-	tokenUnsigner tokensigner.TokenSigner
+	logger         hclog.Logger
+	bot            *bot.Bot
+	tokenUnsigner  tokensigner.TokenSigner
+	registry       *tokensigner.Registry
+	dedupe         *dedupe.Cache
+	resolvers      []credentialResolver
+	cfg            *Config
+	trustedProxies []*net.IPNet
+	unixUsers      map[uint32]int64
+	unixGroups     map[uint32]int64
 }
 
-func NewServer(logger hclog.Logger, bot *bot.Bot, ts tokensigner.TokenSigner) Server {
-	return &server{
-		logger:        logger,
-		bot:           bot,
-		tokenUnsigner: ts,
+func NewServer(logger hclog.Logger, bot *bot.Bot, ts tokensigner.TokenSigner, reg *tokensigner.Registry, signing *hmacauth.Verifier, webhooks *webhook.Registry, dd *dedupe.Cache, cfg *Config) (Server, error) {
+	proxies, err := tokensigner.ParseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %v", err)
+	}
+	unixUsers, err := parsePeerMappings(cfg.UnixUsers, lookupUID)
+	if err != nil {
+		return nil, err
+	}
+	unixGroups, err := parsePeerMappings(cfg.UnixGroups, lookupGID)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RealIPHeader == "" {
+		cfg.RealIPHeader = "X-Forwarded-For"
+	}
+
+	s := &server{
+		logger:         logger,
+		bot:            bot,
+		tokenUnsigner:  ts,
+		registry:       reg,
+		dedupe:         dd,
+		cfg:            cfg,
+		trustedProxies: proxies,
+		unixUsers:      unixUsers,
+		unixGroups:     unixGroups,
 	}
+	s.resolvers = []credentialResolver{
+		&peerResolver{s: s},
+		&webhookResolver{s: s, webhooks: webhooks},
+		&signedResolver{s: s, signing: signing},
+		&tokenResolver{s: s},
+	}
+	return s, nil
 }
 
 type Server interface {
@@ -39,19 +99,45 @@ func (s *server) Start(ctx context.Context, iface string) error {
 		Handler: r,
 	}
 
+	servers := []*http.Server{hs}
+	errCh := make(chan error, 2)
+
+	if s.cfg.UnixSocket != "" {
+		l, err := listenUnix(s.cfg.UnixSocket)
+		if err != nil {
+			return fmt.Errorf("failed to listen on unix socket: %v", err)
+		}
+		us := &http.Server{
+			Handler:     r,
+			ConnContext: s.unixConnContext,
+		}
+		servers = append(servers, us)
+
+		s.logger.Info("Starting API Server", "socket", s.cfg.UnixSocket)
+		go func() {
+			errCh <- us.Serve(l)
+		}()
+	}
+
 	s.logger.Info("Starting API Server", "address", iface)
 
 	go func() {
 		<-ctx.Done()
 		shutdownCtx, cancelFn := context.WithTimeout(context.Background(), 500*time.Millisecond)
 		defer cancelFn()
-		err := hs.Shutdown(shutdownCtx)
-		if err != nil {
-			s.logger.Error("error during graceful shutdown", "error", err)
+		for _, srv := range servers {
+			err := srv.Shutdown(shutdownCtx)
+			if err != nil {
+				s.logger.Error("error during graceful shutdown", "error", err)
+			}
 		}
 	}()
 
-	return hs.ListenAndServe()
+	go func() {
+		errCh <- hs.ListenAndServe()
+	}()
+
+	return <-errCh
 }
 
 func (s *server) handleErr(resp http.ResponseWriter, req *http.Request, err error) {
@@ -71,17 +157,27 @@ func (s *server) handleErr(resp http.ResponseWriter, req *http.Request, err erro
 	resp.WriteHeader(code)
 	resp.Header().Set("Content-Type", "application/json")
 	resp.Write(buf.Bytes())
-	s.logger.Error("request failed", "method", req.Method, "path", req.URL.String(), "error", err, "code", code)
+	s.logger.Error("request failed", "method", req.Method, "route", routeTemplate(req), "error", err, "code", code)
+}
+
+// routeTemplate returns the route r matched, such as /in/{key}, for logging
+// requests without the webhook keys and tokens their URLs can contain.
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return r.URL.Path
 }
 
 // wrap is used to wrap functions to make them more convenient
 func (s *server) wrap(handler func(resp http.ResponseWriter, req *http.Request) (interface{}, error)) func(resp http.ResponseWriter, req *http.Request) {
 	f := func(resp http.ResponseWriter, req *http.Request) {
 		// Invoke the handler
-		reqURL := req.URL.String()
 		start := time.Now()
 		defer func() {
-			s.logger.Debug("request complete", "method", req.Method, "path", reqURL, "duration", time.Now().Sub(start))
+			s.logger.Debug("request complete", "method", req.Method, "route", routeTemplate(req), "duration", time.Now().Sub(start))
 		}()
 		obj, err := handler(resp, req)
 
@@ -119,15 +215,17 @@ func (s *server) wrap(handler func(resp http.ResponseWriter, req *http.Request)
 	return f
 }
 
-func (s *server) parseToken(r *http.Request) (string, error) {
+// parseToken returns the token presented with r, or an empty string if
+// there is none.
+func (s *server) parseToken(r *http.Request) string {
 	headerToken := r.Header.Get("Authorization")
 	if headerToken != "" {
-		return headerToken, nil
+		return strings.TrimPrefix(headerToken, "Bearer ")
 	}
 
 	if v, ok := r.URL.Query()["token"]; ok {
-		return v[0], nil
+		return v[0]
 	}
 
-	return "", CodedError(401, "Missing token in request")
+	return ""
 }
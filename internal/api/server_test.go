@@ -0,0 +1,22 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestRouteTemplate(t *testing.T) {
+	var got string
+	r := mux.NewRouter()
+	r.HandleFunc("/in/{key}", func(w http.ResponseWriter, req *http.Request) {
+		got = routeTemplate(req)
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/in/secret-key?token=secret-token", nil))
+	if got != "/in/{key}" {
+		t.Fatalf("got %q, want the route template", got)
+	}
+}
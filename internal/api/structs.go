@@ -1,11 +1,210 @@
 package api
 
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// OptionalBool is a boolean that may be left out. Besides JSON booleans it
+// accepts the strings "true" and "false", which older clients send for
+// disable_notification, and an empty string as left out.
+type OptionalBool struct {
+	Set   bool
+	Value bool
+}
+
+func (b *OptionalBool) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case nil:
+		*b = OptionalBool{}
+	case bool:
+		*b = OptionalBool{Set: true, Value: v}
+	case string:
+		if v == "" {
+			*b = OptionalBool{}
+			return nil
+		}
+		parsed, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", v)
+		}
+		*b = OptionalBool{Set: true, Value: parsed}
+	default:
+		return fmt.Errorf("expected a boolean, got %s", data)
+	}
+	return nil
+}
+
+func (b OptionalBool) MarshalJSON() ([]byte, error) {
+	if !b.Set {
+		return []byte("null"), nil
+	}
+	return json.Marshal(b.Value)
+}
+
+// Ptr returns the value, or nil if it was left out.
+func (b OptionalBool) Ptr() *bool {
+	if !b.Set {
+		return nil
+	}
+	v := b.Value
+	return &v
+}
+
 type SendNotificationRequest struct {
-	Message             string `json:"message"`
-	DisableNotification string `json:"disable_notification"`
+	Title               string       `json:"title"`
+	Message             string       `json:"message"`
+	Text                string       `json:"text"`
+	DisableNotification OptionalBool `json:"disable_notification"`
+	Priority            string       `json:"priority"`
+	SendAt              string       `json:"send_at"`
+	Buttons             bool         `json:"buttons"`
+	Format              string       `json:"format"`
+}
+
+// BatchNotificationRequest is a notification in a batch, which can have its
+// own idempotency key.
+type BatchNotificationRequest struct {
+	SendNotificationRequest
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+type BatchNotificationResult struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// RetryAfter is the number of seconds to wait before retrying a
+	// notification refused by the rate limits.
+	RetryAfter int64 `json:"retry_after,omitempty"`
+	Replayed   bool  `json:"replayed,omitempty"`
+	*SendNotificationResponse
+}
+
+type BatchNotificationResponse struct {
+	Results []*BatchNotificationResult `json:"results"`
 }
 
 type SendNotificationResponse struct {
+	ScheduledID string     `json:"scheduled_id,omitempty"`
+	SendAt      *time.Time `json:"send_at,omitempty"`
+	Suppressed  bool       `json:"suppressed,omitempty"`
+	MutedUntil  *time.Time `json:"muted_until,omitempty"`
+	Duplicate   bool       `json:"duplicate,omitempty"`
+}
+
+type ScheduledNotification struct {
+	ID        string    `json:"id"`
+	SendAt    time.Time `json:"send_at"`
+	CreatedAt time.Time `json:"created_at"`
+	CreatedBy string    `json:"created_by"`
+	Message   string    `json:"message"`
+}
+
+type ListScheduledResponse struct {
+	Scheduled []*ScheduledNotification `json:"scheduled"`
+}
+
+type CancelScheduledResponse struct {
+	ID string `json:"id"`
+}
+
+type Message struct {
+	ID          int64      `json:"id"`
+	Source      string     `json:"source"`
+	SourceName  string     `json:"source_name"`
+	Text        string     `json:"text"`
+	ReceivedAt  time.Time  `json:"received_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	ScheduledID string     `json:"scheduled_id,omitempty"`
+}
+
+type ListMessagesResponse struct {
+	Messages []*Message `json:"messages"`
+}
+
+type AuditEntry struct {
+	ID      int64                  `json:"id"`
+	Time    time.Time              `json:"time"`
+	Action  string                 `json:"action"`
+	Actor   string                 `json:"actor"`
+	ChatID  int64                  `json:"chat_id,omitempty"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+type ListAuditResponse struct {
+	Entries []*AuditEntry `json:"entries"`
+}
+
+type AddRecurringRequest struct {
+	Title               string       `json:"title"`
+	Message             string       `json:"message"`
+	Cron                string       `json:"cron"`
+	Timezone            string       `json:"timezone"`
+	DisableNotification OptionalBool `json:"disable_notification"`
+	Priority            string       `json:"priority"`
+}
+
+type RecurringNotification struct {
+	ID        string      `json:"id"`
+	Cron      string      `json:"cron"`
+	Timezone  string      `json:"timezone"`
+	Paused    bool        `json:"paused"`
+	NextRun   *time.Time  `json:"next_run,omitempty"`
+	NextRuns  []time.Time `json:"next_runs,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	CreatedBy string      `json:"created_by"`
+	Message   string      `json:"message"`
+}
+
+type ListRecurringResponse struct {
+	Recurring []*RecurringNotification `json:"recurring"`
+}
+
+type PreviewRecurringResponse struct {
+	Timezone string      `json:"timezone"`
+	Runs     []time.Time `json:"runs"`
+}
+
+type UpdateRecurringResponse struct {
+	ID     string `json:"id"`
+	Paused bool   `json:"paused"`
+}
+
+type DeleteRecurringResponse struct {
+	ID string `json:"id"`
+}
+
+type SetTokenCIDRsRequest struct {
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+}
+
+type SetTokenCIDRsResponse struct {
+	AllowedCIDRs []string `json:"allowed_cidrs"`
+}
+
+type SetTokenDedupeRequest struct {
+	Window string `json:"window"`
+}
+
+type SetTokenDedupeResponse struct {
+	Window string `json:"window"`
+}
+
+type WhoAmIResponse struct {
+	Kind         string `json:"kind"`
+	CredentialID string `json:"credential_id"`
+	ChatID       int64  `json:"chat_id"`
+	UserID       int64  `json:"user_id,omitempty"`
+	Name         string `json:"name"`
+	DedupeWindow string `json:"dedupe_window,omitempty"`
 }
 
 type ErrorResponse struct {
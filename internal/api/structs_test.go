@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeNotificationDisableNotification(t *testing.T) {
+	yes, no := true, false
+	cases := []struct {
+		body    string
+		want    *bool
+		wantErr bool
+	}{
+		{body: `{"message": "hi"}`},
+		{body: `{"message": "hi", "disable_notification": null}`},
+		{body: `{"message": "hi", "disable_notification": true}`, want: &yes},
+		{body: `{"message": "hi", "disable_notification": false}`, want: &no},
+		// Older clients send the flag as a string.
+		{body: `{"message": "hi", "disable_notification": "true"}`, want: &yes},
+		{body: `{"message": "hi", "disable_notification": "false"}`, want: &no},
+		{body: `{"message": "hi", "disable_notification": ""}`},
+		{body: `{"message": "hi", "disable_notification": "maybe"}`, wantErr: true},
+		{body: `{"message": "hi", "disable_notification": 1}`, wantErr: true},
+	}
+
+	for _, tc := range cases {
+		r := httptest.NewRequest("POST", "/notify", strings.NewReader(tc.body))
+		req, err := decodeNotification(r)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.body)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.body, err)
+			continue
+		}
+
+		got := req.DisableNotification.Ptr()
+		switch {
+		case tc.want == nil && got != nil:
+			t.Errorf("%s: got %v, want it left out", tc.body, *got)
+		case tc.want != nil && (got == nil || *got != *tc.want):
+			t.Errorf("%s: got %v, want %v", tc.body, got, *tc.want)
+		}
+	}
+}
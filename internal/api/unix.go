@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/endocrimes/endobot/internal/audit"
+)
+
+type peerCred struct {
+	UID uint32
+	GID uint32
+	PID int32
+}
+
+type peerCredKey struct{}
+
+// parsePeerMappings parses "user=chat" entries, where user is a numeric ID
+// or a name resolved with lookup.
+func parsePeerMappings(entries []string, lookup func(name string) (string, error)) (map[uint32]int64, error) {
+	out := make(map[uint32]int64, len(entries))
+	for _, e := range entries {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid mapping %q, expected id=chat", e)
+		}
+
+		id := kv[0]
+		if _, err := strconv.ParseUint(id, 10, 32); err != nil {
+			id, err = lookup(kv[0])
+			if err != nil {
+				return nil, fmt.Errorf("invalid mapping %q: %v", e, err)
+			}
+		}
+		uid, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mapping %q: %v", e, err)
+		}
+		chatID, err := strconv.ParseInt(kv[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mapping %q: %v", e, err)
+		}
+		out[uint32(uid)] = chatID
+	}
+	return out, nil
+}
+
+func lookupUID(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGID(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// groupName describes the group gid, by name if it has one.
+func groupName(gid uint32) string {
+	g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10))
+	if err != nil {
+		return fmt.Sprintf("gid %d", gid)
+	}
+	return fmt.Sprintf("group %s (gid %d)", g.Name, gid)
+}
+
+// listenUnix creates the unix socket, replacing a stale one left behind by a
+// previous run. Every local user may connect, callers are authorized by
+// their peer credentials.
+func listenUnix(path string) (net.Listener, error) {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, 0666)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// unixConnContext stores the peer credentials of unix socket connections in
+// their context, or nil if they couldn't be read.
+func (s *server) unixConnContext(ctx context.Context, c net.Conn) context.Context {
+	cred, err := peerCredentials(c)
+	if err != nil {
+		s.logger.Error("failed to read peer credentials", "error", err)
+	}
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// authenticatePeer maps the local user, or failing that their primary
+// group, to a chat.
+func (s *server) authenticatePeer(cred *peerCred) (*Principal, error) {
+	if chatID, ok := s.unixUsers[cred.UID]; ok {
+		return &Principal{
+			ID:     fmt.Sprintf("%s:uid:%d", KindUnix, cred.UID),
+			Kind:   KindUnix,
+			ChatID: chatID,
+			Name:   fmt.Sprintf("uid %d", cred.UID),
+		}, nil
+	}
+	if chatID, ok := s.unixGroups[cred.GID]; ok {
+		return &Principal{
+			ID:     fmt.Sprintf("%s:gid:%d", KindUnix, cred.GID),
+			Kind:   KindUnix,
+			ChatID: chatID,
+			Name:   groupName(cred.GID),
+		}, nil
+	}
+
+	s.logger.Info("unmapped unix socket peer", "uid", cred.UID, "gid", cred.GID, "pid", cred.PID)
+	s.bot.RecordAudit(&audit.Entry{
+		Action: audit.ActionAuthFailed,
+		Actor:  fmt.Sprintf("%s:uid:%d", KindUnix, cred.UID),
+		Details: map[string]interface{}{
+			"kind":   KindUnix,
+			"reason": "not mapped to a chat",
+			"gid":    cred.GID,
+			"pid":    cred.PID,
+		},
+	})
+	return nil, CodedError(403, fmt.Sprintf("local user %d is not mapped to a chat", cred.UID))
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParsePeerMappings(t *testing.T) {
+	lookup := func(name string) (string, error) {
+		if name == "ops" {
+			return "1001", nil
+		}
+		return "", fmt.Errorf("unknown user %s", name)
+	}
+
+	got, err := parsePeerMappings([]string{"1000=42", "ops=-100"}, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[1000] != 42 || got[1001] != -100 || len(got) != 2 {
+		t.Fatalf("unexpected mappings %v", got)
+	}
+
+	for _, bad := range []string{"1000", "nobody=1", "1000=chat"} {
+		if _, err := parsePeerMappings([]string{bad}, lookup); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestAuthenticatePeer(t *testing.T) {
+	s := &server{
+		unixUsers:  map[uint32]int64{1000: 1},
+		unixGroups: map[uint32]int64{100: 2, 1000: 3},
+	}
+
+	p, err := s.authenticatePeer(&peerCred{UID: 1000, GID: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != "unix:uid:1000" || p.ChatID != 1 {
+		t.Errorf("users should take precedence over groups, got %+v", p)
+	}
+
+	p, err = s.authenticatePeer(&peerCred{UID: 1001, GID: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ID != "unix:gid:100" || p.ChatID != 2 {
+		t.Errorf("unexpected principal %+v", p)
+	}
+	if !strings.Contains(p.Name, "gid 100") {
+		t.Errorf("a peer admitted by its group should be named after it, got %q", p.Name)
+	}
+}
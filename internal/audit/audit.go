@@ -0,0 +1,214 @@
+// Package audit keeps an append-only record of security relevant events,
+// such as credentials being issued and data being deleted, so they can be
+// reviewed later. Entries are appended to a log in the data directory and
+// kept in memory for querying.
+package audit
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+	"github.com/hashicorp/go-hclog"
+)
+
+const auditLog = "audit"
+
+// Actions recorded in the audit log.
+const (
+	ActionTokenIssued  = "token.issued"
+	ActionTokenRevoked = "token.revoked"
+
+	ActionWebhookCreated = "webhook.created"
+	ActionWebhookRotated = "webhook.rotated"
+	ActionWebhookDeleted = "webhook.deleted"
+
+	ActionSigningKeyCreated = "signing_key.created"
+	ActionSigningKeyDeleted = "signing_key.deleted"
+
+	// ActionUserRevoked is recorded when every credential of a user is
+	// revoked at once.
+	ActionUserRevoked = "user.revoked"
+
+	// ActionAuthFailed is recorded when an API request presents a
+	// credential that can't be verified or may not be used.
+	ActionAuthFailed = "auth.failed"
+
+	// ActionPermissionDenied is recorded when someone runs a command they
+	// aren't allowed to.
+	ActionPermissionDenied = "permission.denied"
+
+	ActionAccessApproved = "access.approved"
+	ActionAccessDenied   = "access.denied"
+
+	// ActionChatDeleted is recorded when the data of a chat is deleted,
+	// through /forgetme or by an owner.
+	ActionChatDeleted = "chat.deleted"
+
+	// ActionLimitChanged is recorded when an owner changes the rate limit
+	// of a source or chat, and ActionThrottled when a source starts being
+	// throttled.
+	ActionLimitChanged = "limit.changed"
+	ActionThrottled    = "limit.throttled"
+
+	// ActionCompacted is recorded when data older than its retention
+	// period is removed.
+	ActionCompacted = "retention.compacted"
+)
+
+// ActorSystem is the actor of events endobot does on its own.
+const ActorSystem = "system"
+
+// Entry is a single event.
+type Entry struct {
+	ID     int64     `json:"id"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+
+	// Actor is who caused the event, e.g. "user:1234", a credential ID
+	// such as "token:<id>", "addr:<ip>" for unauthenticated callers or
+	// ActorSystem.
+	Actor string `json:"actor"`
+
+	// ChatID is the chat the event concerns, if any.
+	ChatID int64 `json:"chat_id,omitempty"`
+
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Query selects entries. Zero fields match everything.
+type Query struct {
+	// Chat reports whether an entry concerns the chat being queried, which
+	// lets callers follow chats that changed ID. Entries that don't concern
+	// any chat never match it.
+	Chat func(chatID int64) bool
+
+	// Action matches the action exactly, or every action in a group when
+	// it ends with a dot, e.g. "token.".
+	Action string
+	Actor  string
+	Since  time.Time
+	Until  time.Time
+
+	// Limit returns only the newest entries.
+	Limit int
+}
+
+func (q *Query) matches(e *Entry) bool {
+	if q.Chat != nil && (e.ChatID == 0 || !q.Chat(e.ChatID)) {
+		return false
+	}
+	if q.Action != "" {
+		if strings.HasSuffix(q.Action, ".") {
+			if !strings.HasPrefix(e.Action, q.Action) {
+				return false
+			}
+		} else if e.Action != q.Action {
+			return false
+		}
+	}
+	if q.Actor != "" && e.Actor != q.Actor {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// Log is the audit log. Entries can only be added, and removed once they are
+// older than the retention period.
+type Log struct {
+	store *store.Store
+
+	mu      sync.Mutex
+	entries []*Entry
+	nextID  int64
+}
+
+func New(st *store.Store, logger hclog.Logger) (*Log, error) {
+	l := &Log{
+		store:  st,
+		nextID: 1,
+	}
+
+	err := st.ReadLog(auditLog, func(data []byte) error {
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			// Most likely a write cut short by a crash.
+			logger.Warn("skipping unreadable audit entry", "error", err)
+			return nil
+		}
+		l.entries = append(l.entries, &e)
+		if e.ID >= l.nextID {
+			l.nextID = e.ID + 1
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Record appends e to the log, assigning its ID and setting its time if it
+// has none.
+func (l *Log) Record(e *Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.ID = l.nextID
+	l.nextID++
+	cp := *e
+	l.entries = append(l.entries, &cp)
+	return l.store.Append(auditLog, &cp)
+}
+
+// Find returns copies of the entries matching q, newest first.
+func (l *Log) Find(q Query) []*Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out []*Entry
+	for i := len(l.entries) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(out) >= q.Limit {
+			break
+		}
+		if e := l.entries[i]; q.matches(e) {
+			cp := *e
+			out = append(out, &cp)
+		}
+	}
+	return out
+}
+
+// Compact removes the entries recorded before t, returning how many were
+// removed.
+func (l *Log) Compact(t time.Time) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var kept []*Entry
+	var entries []interface{}
+	for _, e := range l.entries {
+		if !e.Time.Before(t) {
+			kept = append(kept, e)
+			entries = append(entries, e)
+		}
+	}
+	n := len(l.entries) - len(kept)
+	if n == 0 {
+		return 0, nil
+	}
+	l.entries = kept
+	return n, l.store.ReplaceLog(auditLog, entries)
+}
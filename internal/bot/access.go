@@ -0,0 +1,229 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/endocrimes/endobot/internal/audit"
+	"github.com/endocrimes/endobot/internal/store"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const accessDocument = "access"
+
+// accessState is the persisted result of owner decisions.
+type accessState struct {
+	ApprovedUsers map[int64]bool `json:"approved_users"`
+	DeniedUsers   map[int64]bool `json:"denied_users"`
+}
+
+type accessRequest struct {
+	UserID int64
+	ChatID int64
+	Name   string
+}
+
+// accessList decides who may run privileged commands. Owners and the
+// configured users and chats are always allowed, everyone else has to be
+// approved by an owner first.
+type accessList struct {
+	owners       map[int64]bool
+	allowedUsers map[int64]bool
+	allowedChats map[int64]bool
+
+	store *store.Store
+
+	mu      sync.Mutex
+	state   accessState
+	pending map[int64]*accessRequest
+}
+
+func newAccessList(st *store.Store, cfg *Config) (*accessList, error) {
+	a := &accessList{
+		owners:       int64Set(cfg.Owners),
+		allowedUsers: int64Set(cfg.AllowedUsers),
+		allowedChats: int64Set(cfg.AllowedChats),
+		store:        st,
+		pending:      make(map[int64]*accessRequest),
+		state: accessState{
+			ApprovedUsers: make(map[int64]bool),
+			DeniedUsers:   make(map[int64]bool),
+		},
+	}
+
+	err := st.Load(accessDocument, &a.state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load access list: %v", err)
+	}
+
+	return a, nil
+}
+
+func int64Set(ids []int64) map[int64]bool {
+	set := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+func (a *accessList) IsOwner(userID int64) bool {
+	return a.owners[userID]
+}
+
+func (a *accessList) HasOwners() bool {
+	return len(a.owners) > 0
+}
+
+func (a *accessList) Allowed(userID, chatID int64) bool {
+	if a.owners[userID] || a.allowedUsers[userID] || a.allowedChats[chatID] {
+		return true
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state.ApprovedUsers[userID]
+}
+
+func (a *accessList) Denied(userID int64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state.DeniedUsers[userID]
+}
+
+// AddPending records an access request, returning false if one for the user
+// is already waiting on an owner.
+func (a *accessList) AddPending(req *accessRequest) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.pending[req.UserID]; ok {
+		return false
+	}
+	a.pending[req.UserID] = req
+	return true
+}
+
+// Decide resolves a pending request and persists the outcome.
+func (a *accessList) Decide(userID int64, approve bool) (*accessRequest, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	req, ok := a.pending[userID]
+	if !ok {
+		req = &accessRequest{UserID: userID}
+	}
+	delete(a.pending, userID)
+
+	if approve {
+		a.state.ApprovedUsers[userID] = true
+		delete(a.state.DeniedUsers, userID)
+	} else {
+		a.state.DeniedUsers[userID] = true
+		delete(a.state.ApprovedUsers, userID)
+	}
+
+	return req, a.store.Save(accessDocument, &a.state)
+}
+
+func displayName(user *tgbotapi.User) string {
+	if user.UserName != "" {
+		return "@" + user.UserName
+	}
+	return user.String()
+}
+
+// requestAccess asks the owners to approve the sender of update. The sender
+// is told what happened either way.
+func (b *Bot) requestAccess(update tgbotapi.Update) {
+	msg := update.Message
+	userID := int64(msg.From.ID)
+
+	if !b.access.HasOwners() || b.access.Denied(userID) {
+		b.tg.Send(tgbotapi.NewMessage(msg.Chat.ID, "Sorry, you are not allowed to use that command."))
+		return
+	}
+
+	req := &accessRequest{
+		UserID: userID,
+		ChatID: msg.Chat.ID,
+		Name:   displayName(msg.From),
+	}
+	if !b.access.AddPending(req) {
+		b.tg.Send(tgbotapi.NewMessage(msg.Chat.ID, "Your access request is still waiting for approval."))
+		return
+	}
+
+	where := "a private chat"
+	if !msg.Chat.IsPrivate() {
+		where = fmt.Sprintf("%q", msg.Chat.Title)
+	}
+	prompt := fmt.Sprintf("%s (id %d) wants to use /%s in %s. Allow them?", req.Name, userID, msg.Command(), where)
+	id := strconv.FormatInt(userID, 10)
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Approve", "access:approve:"+id),
+		tgbotapi.NewInlineKeyboardButtonData("Deny", "access:deny:"+id),
+	))
+	for owner := range b.access.owners {
+		m := tgbotapi.NewMessage(owner, prompt)
+		m.ReplyMarkup = keyboard
+		_, err := b.tg.Send(m)
+		if err != nil {
+			b.logger.Error("failed to send access request to owner", "owner_id", owner, "error", err)
+		}
+	}
+
+	b.tg.Send(tgbotapi.NewMessage(msg.Chat.ID, "You're not allowed to do that yet, I've asked the owner for approval."))
+}
+
+var accessCallback = &botCallback{
+	Prefix: "access",
+	RunFunc: func(ctx context.Context, b *Bot, query *tgbotapi.CallbackQuery, args []string) error {
+		if !b.access.IsOwner(int64(query.From.ID)) {
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "Only owners can do that."))
+			return nil
+		}
+		if len(args) != 2 {
+			return fmt.Errorf("malformed access callback: %v", args)
+		}
+		userID, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+
+		approve := args[0] == "approve"
+		req, err := b.access.Decide(userID, approve)
+		if err != nil {
+			return err
+		}
+
+		outcome, action := "Denied", audit.ActionAccessDenied
+		if approve {
+			outcome, action = "Approved", audit.ActionAccessApproved
+		}
+		b.RecordAudit(&audit.Entry{
+			Action:  action,
+			Actor:   userActor(int64(query.From.ID)),
+			ChatID:  req.ChatID,
+			Details: map[string]interface{}{"user_id": userID},
+		})
+		b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, outcome))
+		if query.Message != nil {
+			b.tg.SendContext(ctx, tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID,
+				fmt.Sprintf("%s\n\n%s by %s.", query.Message.Text, outcome, displayName(query.From))))
+		}
+
+		if req.ChatID != 0 {
+			reply := "Sorry, the owner denied your request."
+			if approve {
+				reply = "The owner approved your request, you can use privileged commands now."
+			}
+			if req.Name != "" {
+				reply = req.Name + ": " + reply
+			}
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID, reply))
+		}
+		return nil
+	},
+}
@@ -0,0 +1,139 @@
+package bot
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/endocrimes/endobot/internal/audit"
+	"github.com/endocrimes/endobot/internal/tokensigner"
+)
+
+const (
+	testOwner   = 10
+	testAllowed = 20
+	testGroup   = -300
+)
+
+func newAccessTestBot(t *testing.T) (*Bot, *fakeTelegram, map[string]int) {
+	b, fake := newTestBot(t, openTestStore(t), &Config{
+		Owners:       []int64{testOwner},
+		AllowedUsers: []int64{testAllowed},
+		AllowedChats: []int64{testGroup},
+	})
+
+	runs := make(map[string]int)
+	record := func(ctx context.Context, b *Bot, req *commandRequest) error {
+		runs[strings.Join(req.Path, " ")]++
+		return nil
+	}
+	tool := &botCommand{
+		Alias:      "tool",
+		Permission: permAllowed,
+		RunFunc:    record,
+		Subcommands: []*botCommand{
+			{Alias: "admin", Permission: permOwner, RunFunc: record},
+			{Alias: "open", Permission: permEveryone, RunFunc: record},
+		},
+	}
+	b.commands["tool"] = tool
+	b.commands["public"] = &botCommand{Alias: "public", RunFunc: record}
+	return b, fake, runs
+}
+
+func TestCommandPermissions(t *testing.T) {
+	cases := []struct {
+		name    string
+		chatID  int64
+		userID  int64
+		text    string
+		wantRun string
+		reply   string
+	}{
+		{"everyone", 30, 30, "/public", "public", ""},
+		{"allowed user", testAllowed, testAllowed, "/tool", "tool", ""},
+		{"owner", testOwner, testOwner, "/tool admin", "tool admin", ""},
+		{"member of an allowed chat", testGroup, 30, "/tool", "tool", ""},
+		{"stranger", 30, 30, "/tool", "", "I've asked the owner for approval"},
+		{"allowed user running an owner command", testAllowed, testAllowed, "/tool admin", "", "only owners"},
+		{"allowed chat running an owner command", testGroup, 30, "/tool admin", "", "only owners"},
+		// Subcommands can't grant less than their parent.
+		{"stranger running an open subcommand", 30, 30, "/tool open", "", "I've asked the owner for approval"},
+	}
+	for _, tc := range cases {
+		b, fake, runs := newAccessTestBot(t)
+		b.handleUpdate(messageUpdate(tc.chatID, tc.userID, tc.text))
+
+		if tc.wantRun != "" {
+			if runs[tc.wantRun] != 1 {
+				t.Errorf("%s: %s didn't run: %v", tc.name, tc.wantRun, runs)
+			}
+			continue
+		}
+		if len(runs) != 0 {
+			t.Errorf("%s: the command ran: %v", tc.name, runs)
+		}
+		if got := fake.LastMessage(tc.chatID); !strings.Contains(got, tc.reply) {
+			t.Errorf("%s: replied %q, want it to contain %q", tc.name, got, tc.reply)
+		}
+		denied := b.audit.Find(audit.Query{Action: audit.ActionPermissionDenied})
+		if len(denied) != 1 || denied[0].Actor != userActor(tc.userID) {
+			t.Errorf("%s: got audit entries %v, want the denial recorded", tc.name, denied)
+		}
+	}
+}
+
+func TestAccessRequests(t *testing.T) {
+	b, fake, runs := newAccessTestBot(t)
+	const stranger = 30
+
+	b.handleUpdate(messageUpdate(stranger, stranger, "/tool"))
+	if got := fake.LastMessage(testOwner); !strings.Contains(got, "wants to use /tool") {
+		t.Fatalf("the owner was asked %q", got)
+	}
+	b.handleUpdate(messageUpdate(stranger, stranger, "/tool"))
+	if got := fake.LastMessage(stranger); !strings.Contains(got, "still waiting") {
+		t.Fatalf("a repeated request got %q", got)
+	}
+
+	// Only owners may decide.
+	b.handleUpdate(callbackUpdate(testAllowed, testAllowed, "access:approve:30"))
+	if b.access.Allowed(stranger, stranger) {
+		t.Fatal("an allowed user approved a request")
+	}
+
+	b.handleUpdate(callbackUpdate(testOwner, testOwner, "access:approve:30"))
+	b.handleUpdate(messageUpdate(stranger, stranger, "/tool"))
+	if runs["tool"] != 1 {
+		t.Fatalf("the approved user couldn't run the command: %v", runs)
+	}
+	// Approval doesn't make them an owner.
+	b.handleUpdate(messageUpdate(stranger, stranger, "/tool admin"))
+	if runs["tool admin"] != 0 {
+		t.Fatal("the approved user ran an owner command")
+	}
+
+	b.handleUpdate(callbackUpdate(testOwner, testOwner, "access:deny:30"))
+	fake.Reset()
+	b.handleUpdate(messageUpdate(stranger, stranger, "/tool"))
+	if runs["tool"] != 1 {
+		t.Fatal("the denied user ran the command")
+	}
+	if got := fake.LastMessage(stranger); !strings.Contains(got, "not allowed") {
+		t.Fatalf("the denied user got %q", got)
+	}
+	if got := fake.Messages(testOwner); len(got) != 0 {
+		t.Fatalf("the owner was asked about a denied user again: %q", got)
+	}
+}
+
+func TestNoOwners(t *testing.T) {
+	b, fake := newTestBot(t, openTestStore(t), &Config{})
+	b.handleUpdate(messageUpdate(30, 30, "/token"))
+	if got := fake.LastMessage(30); !strings.Contains(got, "not allowed") {
+		t.Fatalf("got %q, want privileged commands refused without owners", got)
+	}
+	if len(b.registry.List(func(*tokensigner.TokenRecord) bool { return true })) != 0 {
+		t.Fatal("a token was issued")
+	}
+}
@@ -0,0 +1,267 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/audit"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// authFailureWindow is the period over which failed API authentications are
+// counted to decide whether to alert the owners.
+const authFailureWindow = 5 * time.Minute
+
+// auditPageSize is how many entries /audit shows.
+const auditPageSize = 20
+
+// burstDetector counts events in a sliding window and reports when they
+// reach a threshold, at most once per window.
+type burstDetector struct {
+	window    time.Duration
+	threshold int
+
+	mu        sync.Mutex
+	times     []time.Time
+	alertedAt time.Time
+}
+
+// Add records an event at t, returning how many happened in the window and
+// whether that is a burst that hasn't been reported yet.
+func (d *burstDetector) Add(t time.Time) (int, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	cutoff := t.Add(-d.window)
+	i := 0
+	for i < len(d.times) && d.times[i].Before(cutoff) {
+		i++
+	}
+	d.times = append(d.times[i:], t)
+
+	if d.threshold <= 0 || len(d.times) < d.threshold || t.Sub(d.alertedAt) < d.window {
+		return len(d.times), false
+	}
+	d.alertedAt = t
+	return len(d.times), true
+}
+
+// authFailureLog keeps repeated failed authentications from flooding the
+// audit log. The first failure of each actor and address in a window is
+// recorded as it happens; the rest are counted and recorded as a single
+// entry when the window ends.
+type authFailureLog struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	actors map[string]*repeatedAuthFailure
+}
+
+type repeatedAuthFailure struct {
+	start time.Time
+	first time.Time
+	count int
+	last  *audit.Entry
+}
+
+func newAuthFailureLog(window time.Duration) *authFailureLog {
+	return &authFailureLog{
+		window: window,
+		actors: make(map[string]*repeatedAuthFailure),
+	}
+}
+
+// Add returns the entries to record now that e happened: e itself if it is
+// the first failure of its actor in the window, preceded by the summary of
+// the previous window if it had repeats.
+func (l *authFailureLog) Add(e *audit.Entry) []*audit.Entry {
+	key := fmt.Sprintf("%s %v", e.Actor, e.Details["address"])
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out []*audit.Entry
+	r, ok := l.actors[key]
+	if ok && e.Time.Sub(r.start) < l.window {
+		if r.count == 0 {
+			r.first = e.Time
+		}
+		r.count++
+		r.last = e
+		return nil
+	}
+	if summary := r.summary(); summary != nil {
+		out = append(out, summary)
+	}
+	l.actors[key] = &repeatedAuthFailure{start: e.Time}
+	return append(out, e)
+}
+
+// Due returns the summaries of the windows that ended by now.
+func (l *authFailureLog) Due(now time.Time) []*audit.Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out []*audit.Entry
+	for key, r := range l.actors {
+		if now.Sub(r.start) < l.window {
+			continue
+		}
+		if summary := r.summary(); summary != nil {
+			out = append(out, summary)
+		}
+		delete(l.actors, key)
+	}
+	return out
+}
+
+// summary is the entry recording the repeats of a failure, or nil if there
+// were none.
+func (r *repeatedAuthFailure) summary() *audit.Entry {
+	if r == nil || r.count == 0 {
+		return nil
+	}
+	e := *r.last
+	e.ID = 0
+	e.Details = make(map[string]interface{}, len(r.last.Details)+2)
+	for k, v := range r.last.Details {
+		e.Details[k] = v
+	}
+	e.Details["repeated"] = r.count
+	e.Details["since"] = r.first
+	return &e
+}
+
+// RecordAudit appends e to the audit log. Failing to is logged rather than
+// failing the action being audited. Repeated failed authentications are
+// recorded together and bursts of them are reported to the owners.
+func (b *Bot) RecordAudit(e *audit.Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Action != audit.ActionAuthFailed {
+		b.recordAudit(e)
+		return
+	}
+
+	for _, entry := range b.failedAuths.Add(e) {
+		b.recordAudit(entry)
+	}
+	if n, burst := b.authFailures.Add(e.Time); burst {
+		b.alertOwners(fmt.Sprintf("%d API requests failed to authenticate in the last %s, the latest from %s. "+
+			"Send /audit auth.failed to see them.", n, authFailureWindow, e.Actor))
+	}
+}
+
+func (b *Bot) recordAudit(e *audit.Entry) {
+	err := b.audit.Record(e)
+	if err != nil {
+		b.logger.Error("failed to write audit log", "action", e.Action, "error", err)
+	}
+}
+
+// flushAuthFailures records the repeated failed authentications of the
+// windows that ended.
+func (b *Bot) flushAuthFailures(now time.Time) {
+	for _, e := range b.failedAuths.Due(now) {
+		b.recordAudit(e)
+	}
+}
+
+func userActor(userID int64) string {
+	return "user:" + strconv.FormatInt(userID, 10)
+}
+
+// alertOwners sends text to every owner.
+func (b *Bot) alertOwners(text string) {
+	for owner := range b.access.owners {
+		_, err := b.tg.SendIn(laneUrgent, tgbotapi.NewMessage(owner, text))
+		if err != nil {
+			b.logger.Error("failed to alert owner", "owner_id", owner, "error", err)
+		}
+	}
+}
+
+// AuditLog returns the audit entries matching q that userID may see, newest
+// first: owners see everything, anyone else only the entries about chatID.
+// userID must be proven, such as by the signed claims of a token, or zero.
+func (b *Bot) AuditLog(chatID, userID int64, q audit.Query) []*audit.Entry {
+	if !b.access.IsOwner(userID) {
+		chatID = b.chats.Resolve(chatID)
+		q.Chat = func(id int64) bool {
+			return b.chats.Resolve(id) == chatID
+		}
+	}
+	return b.audit.Find(q)
+}
+
+func formatAuditEntry(e *audit.Entry, loc *time.Location) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s by %s", e.Time.In(loc).Format("Jan 2 15:04:05"), e.Action, e.Actor)
+	if e.ChatID != 0 {
+		fmt.Fprintf(&sb, " in %d", e.ChatID)
+	}
+
+	keys := make([]string, 0, len(e.Details))
+	for k := range e.Details {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&sb, " %s=%v", k, e.Details[k])
+	}
+	return sb.String()
+}
+
+// auditFilter turns the argument of /audit into a query: a chat ID, an
+// actor such as user:1234 or an action such as token.issued or token.
+func (b *Bot) auditFilter(s string) audit.Query {
+	q := audit.Query{Limit: auditPageSize}
+	switch {
+	case s == "":
+	case strings.Contains(s, ":"):
+		q.Actor = s
+	default:
+		if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+			id = b.chats.Resolve(id)
+			q.Chat = func(chatID int64) bool { return b.chats.Resolve(chatID) == id }
+		} else {
+			q.Action = s
+		}
+	}
+	return q
+}
+
+var auditCmd = &botCommand{
+	Alias:       "audit",
+	Description: "Show the audit log",
+	Args: []commandArg{
+		{Name: "chat id|actor|action", Kind: argString, Optional: true},
+	},
+	Permission: permOwner,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		chatID := req.ChatID()
+		entries := b.audit.Find(b.auditFilter(req.String("chat id|actor|action")))
+		if len(entries) == 0 {
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, "No audit entries match."))
+			return nil
+		}
+
+		loc := b.settings.Get(chatID).Location()
+		lines := []string{"Latest audit entries:"}
+		for _, e := range entries {
+			lines = append(lines, formatAuditEntry(e, loc))
+		}
+		text := strings.Join(lines, "\n\n")
+		if r := []rune(text); len(r) > maxMessageLength {
+			text = string(r[:maxMessageLength-1]) + "…"
+		}
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, text))
+		return nil
+	},
+}
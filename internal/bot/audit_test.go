@@ -0,0 +1,82 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/audit"
+)
+
+func authFailure(actor, addr string, t time.Time) *audit.Entry {
+	return &audit.Entry{
+		Time:    t,
+		Action:  audit.ActionAuthFailed,
+		Actor:   actor,
+		Details: map[string]interface{}{"address": addr, "reason": "unknown key"},
+	}
+}
+
+func TestAuthFailuresAreAggregated(t *testing.T) {
+	b, _ := newTestBot(t, openTestStore(t), &Config{})
+	start := time.Now()
+	failed := func() []*audit.Entry { return b.audit.Find(audit.Query{Action: audit.ActionAuthFailed}) }
+
+	for i := 0; i < 100; i++ {
+		b.RecordAudit(authFailure("addr:192.0.2.1", "192.0.2.1", start.Add(time.Duration(i)*time.Second)))
+	}
+	b.RecordAudit(authFailure("addr:192.0.2.2", "192.0.2.2", start))
+	if got := failed(); len(got) != 2 {
+		t.Fatalf("got %d entries, want the first failure of each address", len(got))
+	}
+
+	b.flushAuthFailures(start.Add(time.Minute))
+	if got := failed(); len(got) != 2 {
+		t.Fatalf("got %d entries, want the repeats held until the window ends", len(got))
+	}
+
+	b.flushAuthFailures(start.Add(authFailureWindow))
+	got := failed()
+	if len(got) != 3 {
+		t.Fatalf("got %d entries, want the repeats recorded together", len(got))
+	}
+	summary := got[0]
+	if summary.Actor != "addr:192.0.2.1" || summary.Details["repeated"] != 99 || !summary.Time.Equal(start.Add(99*time.Second)) {
+		t.Fatalf("got summary %+v", summary)
+	}
+	if since := summary.Details["since"].(time.Time); !since.Equal(start.Add(time.Second)) {
+		t.Fatalf("got since %v, want the first repeat", since)
+	}
+
+	// A new window starts with the next failure.
+	b.RecordAudit(authFailure("addr:192.0.2.1", "192.0.2.1", start.Add(authFailureWindow+time.Second)))
+	if got := failed(); len(got) != 4 {
+		t.Fatalf("got %d entries, want the failure of a new window recorded", len(got))
+	}
+}
+
+func TestAuthFailureBurstsCountEveryFailure(t *testing.T) {
+	b, fake := newTestBot(t, openTestStore(t), &Config{Owners: []int64{testOwner}, AuthFailureAlert: 10})
+	for i := 0; i < 10; i++ {
+		b.RecordAudit(authFailure("addr:192.0.2.1", "192.0.2.1", time.Now()))
+	}
+	if got := fake.Messages(testOwner); len(got) != 1 {
+		t.Fatalf("got %q, want the owners alerted about the burst", got)
+	}
+}
+
+func TestAuditLogVisibility(t *testing.T) {
+	b, _ := newTestBot(t, openTestStore(t), &Config{Owners: []int64{testOwner}})
+	for _, chatID := range []int64{testAllowed, testGroup, 0} {
+		b.RecordAudit(&audit.Entry{Action: audit.ActionTokenIssued, Actor: "user:1", ChatID: chatID})
+	}
+
+	if got := b.AuditLog(testAllowed, testOwner, audit.Query{}); len(got) != 3 {
+		t.Fatalf("an owner got %d entries, want all of them", len(got))
+	}
+	for _, userID := range []int64{0, testAllowed} {
+		got := b.AuditLog(testAllowed, userID, audit.Query{})
+		if len(got) != 1 || got[0].ChatID != testAllowed {
+			t.Fatalf("user %d got %v, want only the entries about their chat", userID, got)
+		}
+	}
+}
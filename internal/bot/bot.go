@@ -2,68 +2,425 @@ package bot
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/endocrimes/endobot/internal/audit"
+	"github.com/endocrimes/endobot/internal/chats"
+	"github.com/endocrimes/endobot/internal/history"
+	"github.com/endocrimes/endobot/internal/hmacauth"
+	"github.com/endocrimes/endobot/internal/ratelimit"
+	"github.com/endocrimes/endobot/internal/scheduler"
+	"github.com/endocrimes/endobot/internal/store"
 	"github.com/endocrimes/endobot/internal/tokensigner"
+	"github.com/endocrimes/endobot/internal/webhook"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/hashicorp/go-hclog"
 )
 
-type botCommand struct {
-	Alias   string
-	RunFunc func(ctx context.Context, bot *Bot, update tgbotapi.Update) error
+// Config holds the operator supplied settings for the bot.
+type Config struct {
+	// Owners may run every command and approve access requests from
+	// unknown users.
+	Owners []int64
+
+	// AllowedUsers and AllowedChats may run privileged commands without
+	// asking an owner first.
+	AllowedUsers []int64
+	AllowedChats []int64
+
+	// TokenMessageTTL is how long messages containing credentials are kept
+	// before the bot deletes them. Zero keeps them forever.
+	TokenMessageTTL time.Duration
+
+	// PublicURL is the externally reachable address of the API, used to
+	// build usage examples.
+	PublicURL string
+
+	// Workers is the number of updates processed concurrently.
+	Workers int
+
+	// CommandTimeout is the default deadline of commands and callbacks.
+	CommandTimeout time.Duration
+
+	// MissedJobs is what happens to scheduled jobs that came due while the
+	// bot was down: MissedFire or MissedSkip.
+	MissedJobs string
+
+	// HistoryRetention is how long notifications are kept in the history,
+	// TokenRetention how long the records of tokens are kept after they
+	// expire and AuditRetention how long audit log entries are kept. Zero
+	// keeps them forever.
+	HistoryRetention time.Duration
+	TokenRetention   time.Duration
+	AuditRetention   time.Duration
+
+	// AuthFailureAlert alerts the owners when this many API requests fail
+	// to authenticate within a few minutes. Zero disables it.
+	AuthFailureAlert int
+
+	// RateLimit and DailyQuota limit how many notifications each source may
+	// send, and ChatRateLimit and ChatDailyQuota how many every source of a
+	// chat may send together. Rates are like "30/m"; empty and zero values
+	// are unlimited. Owners can change them for a source or chat with
+	// /limit.
+	RateLimit      string
+	DailyQuota     int
+	ChatRateLimit  string
+	ChatDailyQuota int
+}
+
+// botCallback handles inline keyboard presses whose data starts with
+// Prefix followed by a colon. The remaining colon separated fields are
+// passed as args.
+type botCallback struct {
+	Prefix  string
+	RunFunc func(ctx context.Context, bot *Bot, query *tgbotapi.CallbackQuery, args []string) error
 }
 
 type Bot struct {
-	tokenSigner tokensigner.TokenSigner
-	tg          *tgbotapi.BotAPI
-	logger      hclog.Logger
-	commands    map[string]*botCommand
+	tokenSigner   tokensigner.TokenSigner
+	registry      *tokensigner.Registry
+	signing       *hmacauth.Verifier
+	webhooks      *webhook.Registry
+	chats         *chats.Directory
+	tg            *pacedAPI
+	logger        hclog.Logger
+	commands      map[string]*botCommand
+	commandList   []*botCommand
+	callbacks     map[string]*botCallback
+	access        *accessList
+	conversations *conversations
+	settings      *settingsStore
+	digests       *notificationQueue
+	held          *notificationQueue
+	jobs          *scheduler.Scheduler
+	history       *history.Log
+	audit         *audit.Log
+	authFailures  *burstDetector
+	failedAuths   *authFailureLog
+	limits        *limitStore
+	limiter       *ratelimit.Limiter
+	sourceLimit   ratelimit.Limit
+	chatLimit     ratelimit.Limit
+	throttled     *cooldown
+	tokenAlerts   *tokenAlerts
+	cfg           *Config
 }
 
-func New(logger hclog.Logger, tg *tgbotapi.BotAPI, ts tokensigner.TokenSigner) *Bot {
+func New(logger hclog.Logger, tg *tgbotapi.BotAPI, ts tokensigner.TokenSigner, registry *tokensigner.Registry, signing *hmacauth.Verifier, webhooks *webhook.Registry, chats *chats.Directory, st *store.Store, cfg *Config) (*Bot, error) {
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+	if cfg.CommandTimeout <= 0 {
+		cfg.CommandTimeout = 30 * time.Second
+	}
+	switch cfg.MissedJobs {
+	case "":
+		cfg.MissedJobs = MissedFire
+	case MissedFire, MissedSkip:
+	default:
+		return nil, fmt.Errorf("missed jobs must be %q or %q, not %q", MissedFire, MissedSkip, cfg.MissedJobs)
+	}
+
+	access, err := newAccessList(st, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !access.HasOwners() && len(cfg.AllowedUsers) == 0 && len(cfg.AllowedChats) == 0 {
+		logger.Warn("no owners or allowed users configured, privileged commands are disabled")
+	}
+	settings, err := newSettingsStore(st)
+	if err != nil {
+		return nil, err
+	}
+	digests, err := newNotificationQueue(st, digestsDocument)
+	if err != nil {
+		return nil, err
+	}
+	held, err := newNotificationQueue(st, heldDocument)
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := scheduler.New(st, logger.Named("scheduler"))
+	if err != nil {
+		return nil, err
+	}
+	hist, err := history.New(st, logger.Named("history"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load history: %v", err)
+	}
+	auditLog, err := audit.New(st, logger.Named("audit"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load audit log: %v", err)
+	}
+	sourceLimit, err := parseLimit(cfg.RateLimit, cfg.DailyQuota)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit: %v", err)
+	}
+	chatLimit, err := parseLimit(cfg.ChatRateLimit, cfg.ChatDailyQuota)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chat rate limit: %v", err)
+	}
+	limits, err := newLimitStore(st)
+	if err != nil {
+		return nil, err
+	}
+
 	b := &Bot{
-		tokenSigner: ts,
-		logger:      logger,
-		tg:          tg,
-		commands:    make(map[string]*botCommand),
+		tokenSigner:   ts,
+		registry:      registry,
+		signing:       signing,
+		webhooks:      webhooks,
+		chats:         chats,
+		logger:        logger,
+		tg:            &pacedAPI{BotAPI: tg, queue: newSendQueue(logger.Named("send"))},
+		commands:      make(map[string]*botCommand),
+		callbacks:     make(map[string]*botCallback),
+		access:        access,
+		conversations: newConversations(),
+		settings:      settings,
+		digests:       digests,
+		held:          held,
+		jobs:          jobs,
+		history:       hist,
+		audit:         auditLog,
+		authFailures:  &burstDetector{window: authFailureWindow, threshold: cfg.AuthFailureAlert},
+		failedAuths:   newAuthFailureLog(authFailureWindow),
+		limits:        limits,
+		limiter:       ratelimit.New(),
+		sourceLimit:   sourceLimit,
+		chatLimit:     chatLimit,
+		throttled:     &cooldown{interval: throttleWarningInterval},
+		tokenAlerts:   newTokenAlerts(tokenAlertInterval),
+		cfg:           cfg,
 	}
 
 	cmds := []*botCommand{
+		startCmd,
+		helpCmd,
 		tokenCmd,
+		tokensCmd,
+		revokeCmd,
+		signingKeyCmd,
+		webhookCmd,
+		settingsCmd,
+		dndCmd,
+		digestCmd,
+		scheduledCmd,
+		remindCmd,
+		remindersCmd,
+		cronCmd,
+		historyCmd,
+		searchCmd,
+		forgetMeCmd,
+		purgeCmd,
+		auditCmd,
+		limitCmd,
+		queueCmd,
+		cancelCmd,
 	}
 	for _, cmd := range cmds {
 		b.commands[cmd.Alias] = cmd
 	}
+	b.commandList = cmds
 
-	return b
+	callbacks := []*botCallback{
+		accessCallback,
+		tokenCallback,
+		conversationCallback,
+		settingsCallback,
+		scheduledCallback,
+		remindCallback,
+		cronCallback,
+		forgetCallback,
+		notifyCallback,
+	}
+	for _, cb := range callbacks {
+		b.callbacks[cb.Prefix] = cb
+	}
+
+	return b, nil
 }
 
 func (b *Bot) processCommand(cmd string, update tgbotapi.Update) {
 	b.logger.Info("processing command", "command", cmd, "user_id", update.Message.From.ID)
-	impl, ok := b.commands[cmd]
+	root, ok := b.commands[strings.ToLower(cmd)]
 	if !ok {
 		b.logger.Trace("command not found", "command", cmd)
-		b.tg.Send(tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, I didn't recognize that command."))
+		b.tg.Send(tgbotapi.NewMessage(update.Message.Chat.ID,
+			fmt.Sprintf("Sorry, I didn't recognize /%s. Send /help to see what I can do.", cmd)))
+		return
+	}
+
+	impl, path, perm, fields := resolveCommand(root, strings.Fields(update.Message.CommandArguments()))
+	if !b.authorize(perm, update) {
+		b.logger.Info("unauthorized command", "command", strings.Join(path, " "), "user_id", update.Message.From.ID, "chat_id", update.Message.Chat.ID)
+		b.RecordAudit(&audit.Entry{
+			Action:  audit.ActionPermissionDenied,
+			Actor:   userActor(int64(update.Message.From.ID)),
+			ChatID:  update.Message.Chat.ID,
+			Details: map[string]interface{}{"command": strings.Join(path, " ")},
+		})
+		return
+	}
+
+	if impl.RunFunc == nil {
+		b.tg.Send(tgbotapi.NewMessage(update.Message.Chat.ID, "Usage:\n"+impl.usage(path)))
 		return
 	}
+	args, err := impl.parseArgs(fields)
+	if err != nil {
+		b.tg.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Sorry, %v.\n\nUsage:\n%s", err, impl.usage(path))))
+		return
+	}
+
+	req := &commandRequest{
+		Update:  update,
+		Message: update.Message,
+		Path:    path,
+		args:    args,
+	}
 
-	// TODO: Set a timeout.
-	ctx := context.Background()
-	err := impl.RunFunc(ctx, b, update)
+	timeout := impl.Timeout
+	if timeout == 0 {
+		timeout = b.cfg.CommandTimeout
+	}
+	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
+	defer cancelFn()
+	err = impl.RunFunc(ctx, b, req)
+	if ctx.Err() == context.DeadlineExceeded {
+		// The reply is sent without holding up the worker any longer.
+		b.logger.Warn("command timed out", "command", cmd, "timeout", timeout)
+		go b.tg.Send(tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, that took too long :("))
+		return
+	}
 	if err != nil {
 		b.logger.Error("failed to execute command", "error", err, "command", cmd)
-		b.tg.Send(tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, something went wrong :("))
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(update.Message.Chat.ID, "Sorry, something went wrong :("))
+	}
+}
+
+func (b *Bot) processCallback(query *tgbotapi.CallbackQuery) {
+	parts := strings.Split(query.Data, ":")
+	b.logger.Info("processing callback", "callback", parts[0], "user_id", query.From.ID)
+	impl, ok := b.callbacks[parts[0]]
+	if !ok {
+		b.logger.Trace("callback not found", "callback", parts[0])
+		b.tg.AnswerCallbackQuery(tgbotapi.NewCallback(query.ID, "Sorry, that button doesn't work anymore."))
+		return
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), b.cfg.CommandTimeout)
+	defer cancelFn()
+	err := impl.RunFunc(ctx, b, query, parts[1:])
+	if ctx.Err() == context.DeadlineExceeded {
+		b.logger.Warn("callback timed out", "callback", parts[0])
+		return
+	}
+	if err != nil {
+		b.logger.Error("failed to execute callback", "error", err, "callback", parts[0])
+		b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "Sorry, something went wrong :("))
+	}
+}
+
+// jobDeleteMessage jobs delete a message once its TTL has passed. They are
+// persisted like other jobs, so deletions that came due while the bot was
+// down happen as soon as it is back.
+const jobDeleteMessage = "message.delete"
+
+type messageDeletion struct {
+	MessageID int `json:"message_id"`
+}
+
+// deleteAfter removes a message once d has passed.
+func (b *Bot) deleteAfter(chatID int64, messageID int, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	_, err := b.jobs.Add(jobDeleteMessage, chatID, time.Now().Add(d), audit.ActorSystem, &messageDeletion{MessageID: messageID})
+	if err != nil {
+		b.logger.Error("failed to schedule message deletion", "chat_id", chatID, "message_id", messageID, "error", err)
 	}
 }
 
-func (b *Bot) Notify(chatID int64, message string) error {
-	msg := tgbotapi.NewMessage(chatID, message)
-	msg.DisableNotification = false
-	_, err := b.tg.Send(msg)
+// deleteMessage runs a jobDeleteMessage job.
+func (b *Bot) deleteMessage(job *scheduler.Job) error {
+	var d messageDeletion
+	err := job.Decode(&d)
+	if err != nil {
+		return err
+	}
+	_, err = b.tg.DeleteMessage(tgbotapi.NewDeleteMessage(job.ChatID, d.MessageID))
 	return err
 }
 
+// blockedRetryInterval is how long delivery to a chat that blocked the bot
+// fails fast before it is attempted again.
+const blockedRetryInterval = 10 * time.Minute
+
+// checkDelivery records whether a chat is reachable based on the result of
+// sending to it.
+func (b *Bot) checkDelivery(chatID int64, err error) error {
+	if err == nil {
+		if err := b.chats.ClearBlocked(chatID); err != nil {
+			b.logger.Error("failed to update chat state", "chat_id", chatID, "error", err)
+		}
+		return nil
+	}
+
+	err = classifySendError(err)
+	if err == ErrChatBlocked {
+		b.logger.Info("bot is blocked in chat", "chat_id", chatID)
+		if err := b.chats.MarkBlocked(chatID); err != nil {
+			b.logger.Error("failed to update chat state", "chat_id", chatID, "error", err)
+		}
+	}
+	return err
+}
+
+func (b *Bot) handleMigration(from, to int64) {
+	b.logger.Info("chat migrated", "from_chat_id", from, "to_chat_id", to)
+	err := b.chats.Migrate(from, to)
+	if err != nil {
+		b.logger.Error("failed to record chat migration", "from_chat_id", from, "to_chat_id", to, "error", err)
+	}
+
+	// State keyed by chat ID moves with the chat.
+	migrations := []struct {
+		name    string
+		migrate func(from, to int64) error
+	}{
+		{"settings", b.settings.Migrate},
+		{"limits", b.limits.MigrateChat},
+		{"digests", b.digests.Migrate},
+		{"held notifications", b.held.Migrate},
+	}
+	for _, m := range migrations {
+		if err := m.migrate(from, to); err != nil {
+			b.logger.Error("failed to migrate "+m.name, "from_chat_id", from, "to_chat_id", to, "error", err)
+		}
+	}
+}
+
+// inChat returns a filter matching the chat IDs stored for chatID, which may
+// be from before the chat migrated.
+func (b *Bot) inChat(chatID int64) func(id int64) bool {
+	chatID = b.chats.Resolve(chatID)
+	return func(id int64) bool {
+		return b.chats.Resolve(id) == chatID
+	}
+}
+
 func (b *Bot) Run(ctx context.Context) error {
+	go b.tg.queue.Run(ctx)
+
+	err := b.registerCommands()
+	if err != nil {
+		b.logger.Error("failed to register commands with telegram", "error", err)
+	}
+
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 	updates, err := b.tg.GetUpdatesChan(u)
@@ -71,24 +428,81 @@ func (b *Bot) Run(ctx context.Context) error {
 		return err
 	}
 
+	d := newDispatcher(b, b.cfg.Workers)
+	defer d.Drain()
+
+	jobsDone := make(chan struct{})
+	go func() {
+		defer close(jobsDone)
+		b.jobs.Run(ctx, b.runJob)
+	}()
+	defer func() { <-jobsDone }()
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	compactTicker := time.NewTicker(compactInterval)
+	defer compactTicker.Stop()
+	b.compact(time.Now())
+
 	for {
 		select {
 		case <-ctx.Done():
+			b.tg.StopReceivingUpdates()
 			return nil
+		case now := <-ticker.C:
+			b.expireConversations(now)
+			b.flushDigests(now)
+			b.releaseHeld(now)
+			b.flushTokenAlerts(now)
+			b.flushAuthFailures(now)
+		case now := <-compactTicker.C:
+			b.compact(now)
+			b.limiter.Prune(now, limiterMaxIdle)
 		case update := <-updates:
-			if update.Message == nil {
-				// Not sure when message is nil (maybe updates?), but guarding against
-				// it here.
-				continue
-			}
-
-			if !update.Message.IsCommand() {
-				b.logger.Trace("unrecognized message", "user_id", update.Message.From.ID)
-				continue
-			}
-
-			cmd := update.Message.Command()
-			b.processCommand(cmd, update)
+			d.Dispatch(update)
+		}
+	}
+}
+
+// handleUpdate routes a single update from Telegram.
+func (b *Bot) handleUpdate(update tgbotapi.Update) {
+	if update.CallbackQuery != nil {
+		b.processCallback(update.CallbackQuery)
+		return
+	}
+
+	if update.Message == nil {
+		// Not sure when message is nil (maybe updates?), but guarding against
+		// it here.
+		return
+	}
+
+	if update.Message.MigrateToChatID != 0 {
+		b.handleMigration(update.Message.Chat.ID, update.Message.MigrateToChatID)
+		return
+	}
+	if update.Message.MigrateFromChatID != 0 {
+		b.handleMigration(update.Message.MigrateFromChatID, update.Message.Chat.ID)
+		return
+	}
+	// Hearing from a chat means the bot can reach it again.
+	if err := b.chats.ClearBlocked(update.Message.Chat.ID); err != nil {
+		b.logger.Error("failed to update chat state", "chat_id", update.Message.Chat.ID, "error", err)
+	}
+
+	if !update.Message.IsCommand() {
+		reply := &conversationReply{Message: update.Message, Text: update.Message.Text}
+		if b.continueConversation(update.Message.Chat.ID, int64(update.Message.From.ID), reply) {
+			return
 		}
+		b.logger.Trace("unrecognized message", "user_id", update.Message.From.ID)
+		return
+	}
+
+	cmd := update.Message.Command()
+	if cmd != cancelCmd.Alias {
+		// Starting another command abandons the current conversation.
+		b.conversations.remove(update.Message.Chat.ID, int64(update.Message.From.ID))
 	}
+	b.processCommand(cmd, update)
 }
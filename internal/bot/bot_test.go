@@ -0,0 +1,281 @@
+package bot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/chats"
+	"github.com/endocrimes/endobot/internal/hmacauth"
+	"github.com/endocrimes/endobot/internal/ratelimit"
+	"github.com/endocrimes/endobot/internal/store"
+	"github.com/endocrimes/endobot/internal/tokensigner"
+	"github.com/endocrimes/endobot/internal/tokensigner/jwt"
+	"github.com/endocrimes/endobot/internal/webhook"
+	jwtlib "github.com/gbrlsnchs/jwt/v3"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/hashicorp/go-hclog"
+)
+
+// telegramCall is a request the bot made to the Telegram API.
+type telegramCall struct {
+	Method string
+	Params url.Values
+}
+
+// fakeTelegram answers the bot's Telegram API calls and records them.
+type fakeTelegram struct {
+	mu     sync.Mutex
+	calls  []telegramCall
+	nextID int
+
+	// fail returns the error description Telegram answers a call with, or
+	// "" to succeed.
+	fail func(method string, params url.Values) string
+}
+
+func (f *fakeTelegram) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.ParseMultipartForm(1 << 20)
+	params := r.Form
+	if r.MultipartForm != nil {
+		params = r.MultipartForm.Value
+	}
+	method := path.Base(r.URL.Path)
+
+	f.mu.Lock()
+	f.calls = append(f.calls, telegramCall{Method: method, Params: params})
+	f.nextID++
+	id := f.nextID
+	fail := f.fail
+	f.mu.Unlock()
+
+	resp := map[string]interface{}{"ok": true, "result": true}
+	if fail != nil {
+		if desc := fail(method, params); desc != "" {
+			resp = map[string]interface{}{"ok": false, "error_code": 403, "description": desc}
+		}
+	}
+	if resp["ok"] == true && (strings.HasPrefix(method, "send") || strings.HasPrefix(method, "edit")) {
+		chatID, _ := strconv.ParseInt(params.Get("chat_id"), 10, 64)
+		resp["result"] = map[string]interface{}{
+			"message_id": id,
+			"date":       time.Now().Unix(),
+			"chat":       map[string]interface{}{"id": chatID},
+			"text":       params.Get("text"),
+		}
+	}
+
+	body, _ := json.Marshal(resp)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+// Calls returns the calls made with method, oldest first.
+func (f *fakeTelegram) Calls(method string) []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out []url.Values
+	for _, c := range f.calls {
+		if c.Method == method {
+			out = append(out, c.Params)
+		}
+	}
+	return out
+}
+
+// Messages returns the texts sent to chatID, oldest first.
+func (f *fakeTelegram) Messages(chatID int64) []string {
+	var out []string
+	for _, params := range f.Calls("sendMessage") {
+		if params.Get("chat_id") == strconv.FormatInt(chatID, 10) {
+			out = append(out, params.Get("text"))
+		}
+	}
+	return out
+}
+
+// LastMessage returns the latest text sent to chatID.
+func (f *fakeTelegram) LastMessage(chatID int64) string {
+	msgs := f.Messages(chatID)
+	if len(msgs) == 0 {
+		return ""
+	}
+	return msgs[len(msgs)-1]
+}
+
+func (f *fakeTelegram) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = nil
+}
+
+func openTestStore(t *testing.T) *store.Store {
+	st, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// openTestDir returns a store in a directory that is removed when the test
+// ends, for tests that restart the bot.
+func openTestDir(t *testing.T) (*store.Store, string) {
+	dir, err := ioutil.TempDir("", "endobot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	st, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st, dir
+}
+
+// newTestBot returns a bot using st that talks to a fake Telegram. Calls to
+// Telegram are made straight away rather than paced.
+func newTestBot(t *testing.T, st *store.Store, cfg *Config) (*Bot, *fakeTelegram) {
+	registry, err := tokensigner.NewRegistry(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signing, err := hmacauth.New(st, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks, err := webhook.NewRegistry(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chatDir, err := chats.NewDirectory(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := &jwt.TokenSigner{Secret: jwtlib.NewHS256([]byte("secret")), Registry: registry, Chats: chatDir}
+
+	fake := &fakeTelegram{}
+	tg := &tgbotapi.BotAPI{
+		Token:  "test",
+		Client: &http.Client{Transport: fake},
+		Self:   tgbotapi.User{ID: 1, UserName: "endobot"},
+	}
+	b, err := New(hclog.NewNullLogger(), tg, signer, registry, signing, webhooks, chatDir, st, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.tg.queue.stop()
+	return b, fake
+}
+
+// testChat returns a private chat for positive IDs and a group otherwise.
+func testChat(chatID int64) *tgbotapi.Chat {
+	if chatID > 0 {
+		return &tgbotapi.Chat{ID: chatID, Type: "private"}
+	}
+	return &tgbotapi.Chat{ID: chatID, Type: "group", Title: fmt.Sprintf("group %d", -chatID)}
+}
+
+// messageUpdate is a message with text sent by userID to chatID.
+func messageUpdate(chatID, userID int64, text string) tgbotapi.Update {
+	msg := &tgbotapi.Message{
+		MessageID: int(time.Now().UnixNano() % 1e6),
+		From:      &tgbotapi.User{ID: int(userID), UserName: fmt.Sprintf("user%d", userID)},
+		Chat:      testChat(chatID),
+		Date:      int(time.Now().Unix()),
+		Text:      text,
+	}
+	if strings.HasPrefix(text, "/") {
+		length := len(strings.Fields(text)[0])
+		msg.Entities = &[]tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+	return tgbotapi.Update{Message: msg}
+}
+
+// callbackUpdate is userID pressing a button with data on a message in
+// chatID.
+func callbackUpdate(chatID, userID int64, data string) tgbotapi.Update {
+	return tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:   "query",
+		From: &tgbotapi.User{ID: int(userID), UserName: fmt.Sprintf("user%d", userID)},
+		Message: &tgbotapi.Message{
+			MessageID: 1,
+			Chat:      testChat(chatID),
+			Text:      "a message with buttons",
+		},
+		Data: data,
+	}}
+}
+
+func TestMigrationKeepsChatState(t *testing.T) {
+	const supergroup = -1000000000300
+	st, dir := openTestDir(t)
+	b, fake := newTestBot(t, st, &Config{AllowedChats: []int64{testGroup}})
+
+	_, err := b.settings.Update(testGroup, func(cs *chatSettings) {
+		cs.Timezone = "Europe/Berlin"
+		cs.Digest = "1h"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	limit := ratelimit.Limit{Daily: 5}
+	if err := b.limits.Set(chatLimitKey(testGroup), &limit); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Notify(&Notification{ChatID: testGroup, Text: "before"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.held.Add(queueKey{ChatID: testGroup}, queuedNotification{Time: time.Now(), Text: "held"}); err != nil {
+		t.Fatal(err)
+	}
+
+	update := messageUpdate(testGroup, testAllowed, "")
+	update.Message.MigrateToChatID = supergroup
+	b.handleUpdate(update)
+	if err := b.Notify(&Notification{ChatID: supergroup, Text: "after"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The state must survive a restart too.
+	st, err = store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = newTestBot(t, st, &Config{})
+	if got := b.settings.Get(supergroup); got.Timezone != "Europe/Berlin" || got.Digest != "1h" {
+		t.Fatalf("got settings %+v, want them kept", got)
+	}
+	if got := b.limits.Get(chatLimitKey(supergroup), ratelimit.Limit{}); got != limit {
+		t.Fatalf("got limit %v, want %v", got, limit)
+	}
+	for _, q := range []*notificationQueue{b.digests, b.held} {
+		if _, ok := q.Started()[queueKey{ChatID: testGroup}]; ok {
+			t.Fatal("notifications are still queued under the old chat ID")
+		}
+	}
+	digest := b.digests.Entries(queueKey{ChatID: supergroup})
+	if len(digest) != 2 || digest[0].Text != "before" || digest[1].Text != "after" {
+		t.Fatalf("got digest %v, want the notifications from before and after the migration", digest)
+	}
+	if held := b.held.Entries(queueKey{ChatID: supergroup}); len(held) != 1 {
+		t.Fatalf("got held notifications %v", held)
+	}
+	if got := fake.Messages(supergroup); len(got) != 0 {
+		t.Fatalf("sent %q to the new chat, want the notifications in its digest", got)
+	}
+}
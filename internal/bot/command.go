@@ -0,0 +1,319 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// permission is the level of trust needed to run a command.
+type permission int
+
+const (
+	// permEveryone commands can be run by anyone who can message the bot.
+	permEveryone permission = iota
+
+	// permAllowed commands can be run by owners, allowed users and chats,
+	// and users an owner approved.
+	permAllowed
+
+	// permOwner commands can only be run by owners.
+	permOwner
+)
+
+type argKind int
+
+const (
+	argString argKind = iota
+	argInt
+	argDuration
+
+	// argRest consumes every remaining field.
+	argRest
+)
+
+type commandArg struct {
+	Name     string
+	Kind     argKind
+	Optional bool
+}
+
+func (a commandArg) usage() string {
+	name := a.Name
+	if a.Kind == argRest {
+		name += "..."
+	}
+	if a.Optional {
+		return "[" + name + "]"
+	}
+	return "<" + name + ">"
+}
+
+type botCommand struct {
+	Alias       string
+	Description string
+
+	// Args are the positional arguments of the command, in order. Only the
+	// last argument may be an argRest.
+	Args []commandArg
+
+	// Permission is the trust needed to run the command. Subcommands need
+	// the highest permission of themselves and their parents.
+	Permission permission
+
+	// Subcommands are selected by the first argument. When it doesn't name
+	// a subcommand RunFunc is used, or the usage is shown if there is none.
+	Subcommands []*botCommand
+
+	// Hidden commands are not listed in /help or registered with Telegram.
+	Hidden bool
+
+	// Timeout overrides the default command deadline.
+	Timeout time.Duration
+
+	RunFunc func(ctx context.Context, bot *Bot, req *commandRequest) error
+}
+
+// commandRequest is a parsed invocation of a command.
+type commandRequest struct {
+	Update  tgbotapi.Update
+	Message *tgbotapi.Message
+
+	// Path is the command and subcommands that were invoked.
+	Path []string
+
+	args map[string]interface{}
+}
+
+func (r *commandRequest) ChatID() int64 {
+	return r.Message.Chat.ID
+}
+
+func (r *commandRequest) UserID() int64 {
+	return int64(r.Message.From.ID)
+}
+
+// Has reports whether an optional argument was given.
+func (r *commandRequest) Has(name string) bool {
+	_, ok := r.args[name]
+	return ok
+}
+
+func (r *commandRequest) String(name string) string {
+	s, _ := r.args[name].(string)
+	return s
+}
+
+func (r *commandRequest) Int(name string) int64 {
+	i, _ := r.args[name].(int64)
+	return i
+}
+
+func (r *commandRequest) Duration(name string) time.Duration {
+	d, _ := r.args[name].(time.Duration)
+	return d
+}
+
+// Strings returns the fields consumed by an argRest argument.
+func (r *commandRequest) Strings(name string) []string {
+	s, _ := r.args[name].([]string)
+	return s
+}
+
+// Rest returns the fields consumed by an argRest argument as a single
+// string.
+func (r *commandRequest) Rest(name string) string {
+	return strings.Join(r.Strings(name), " ")
+}
+
+// usage describes how to invoke cmd, reached through path.
+func (cmd *botCommand) usage(path []string) string {
+	prefix := "/" + strings.Join(path, " ")
+
+	var lines []string
+	if cmd.RunFunc != nil {
+		parts := []string{prefix}
+		for _, a := range cmd.Args {
+			parts = append(parts, a.usage())
+		}
+		lines = append(lines, strings.Join(parts, " "))
+	}
+	for _, sub := range cmd.Subcommands {
+		lines = append(lines, sub.usage(append(path[:len(path):len(path)], sub.Alias)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (cmd *botCommand) subcommand(alias string) *botCommand {
+	for _, sub := range cmd.Subcommands {
+		if strings.EqualFold(sub.Alias, alias) {
+			return sub
+		}
+	}
+	return nil
+}
+
+// parseArgs converts fields into the typed arguments of cmd.
+func (cmd *botCommand) parseArgs(fields []string) (map[string]interface{}, error) {
+	args := make(map[string]interface{}, len(cmd.Args))
+	for i, spec := range cmd.Args {
+		if i >= len(fields) {
+			if !spec.Optional {
+				return nil, fmt.Errorf("missing %s", spec.usage())
+			}
+			continue
+		}
+
+		field := fields[i]
+		switch spec.Kind {
+		case argString:
+			args[spec.Name] = field
+		case argInt:
+			v, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number", spec.usage())
+			}
+			args[spec.Name] = v
+		case argDuration:
+			v, err := time.ParseDuration(field)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a duration like 30m or 2h", spec.usage())
+			}
+			args[spec.Name] = v
+		case argRest:
+			args[spec.Name] = fields[i:]
+			return args, nil
+		}
+	}
+
+	if len(fields) > len(cmd.Args) {
+		return nil, fmt.Errorf("too many arguments")
+	}
+	return args, nil
+}
+
+// resolveCommand walks the subcommands of cmd selected by fields, returning
+// the command to run, the path taken, the permission needed and the fields
+// left for its arguments.
+func resolveCommand(cmd *botCommand, fields []string) (*botCommand, []string, permission, []string) {
+	path := []string{cmd.Alias}
+	perm := cmd.Permission
+	for len(fields) > 0 {
+		sub := cmd.subcommand(fields[0])
+		if sub == nil {
+			break
+		}
+		cmd = sub
+		path = append(path, sub.Alias)
+		if sub.Permission > perm {
+			perm = sub.Permission
+		}
+		fields = fields[1:]
+	}
+	return cmd, path, perm, fields
+}
+
+// authorize checks that the sender of msg has perm, replying to them if
+// they don't.
+func (b *Bot) authorize(perm permission, update tgbotapi.Update) bool {
+	msg := update.Message
+	userID := int64(msg.From.ID)
+
+	switch perm {
+	case permEveryone:
+		return true
+	case permAllowed:
+		if b.access.Allowed(userID, msg.Chat.ID) {
+			return true
+		}
+		b.requestAccess(update)
+		return false
+	default:
+		if b.access.IsOwner(userID) {
+			return true
+		}
+		b.tg.Send(tgbotapi.NewMessage(msg.Chat.ID, "Sorry, only owners can use that command."))
+		return false
+	}
+}
+
+// visibleCommands returns the commands listed in /help, in registration
+// order.
+func (b *Bot) visibleCommands() []*botCommand {
+	var out []*botCommand
+	for _, cmd := range b.commandList {
+		if !cmd.Hidden {
+			out = append(out, cmd)
+		}
+	}
+	return out
+}
+
+// registerCommands publishes the command list to Telegram so clients can
+// suggest them.
+func (b *Bot) registerCommands() error {
+	type botCommandInfo struct {
+		Command     string `json:"command"`
+		Description string `json:"description"`
+	}
+
+	var infos []botCommandInfo
+	for _, cmd := range b.visibleCommands() {
+		infos = append(infos, botCommandInfo{Command: cmd.Alias, Description: cmd.Description})
+	}
+	data, err := json.Marshal(infos)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.tg.MakeRequest("setMyCommands", url.Values{"commands": {string(data)}})
+	return err
+}
+
+var helpCmd = &botCommand{
+	Alias:       "help",
+	Description: "Show the available commands",
+	Args: []commandArg{
+		{Name: "command", Kind: argString, Optional: true},
+	},
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		if req.Has("command") {
+			name := strings.TrimPrefix(req.String("command"), "/")
+			cmd, ok := b.commands[strings.ToLower(name)]
+			if !ok {
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), fmt.Sprintf("There is no /%s command.", name)))
+				return nil
+			}
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(),
+				fmt.Sprintf("/%s - %s\n\nUsage:\n%s", cmd.Alias, cmd.Description, cmd.usage([]string{cmd.Alias}))))
+			return nil
+		}
+
+		var sb strings.Builder
+		sb.WriteString("I can do these things:\n")
+		for _, cmd := range b.visibleCommands() {
+			fmt.Fprintf(&sb, "\n/%s - %s", cmd.Alias, cmd.Description)
+		}
+		sb.WriteString("\n\nSend /help <command> for details.")
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), sb.String()))
+		return nil
+	},
+}
+
+var startCmd = &botCommand{
+	Alias:       "start",
+	Description: "Introduce the bot",
+	Hidden:      true,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(),
+			"Hi! I deliver notifications from your scripts and services to Telegram. "+
+				"Send /token to get an API token, or /help to see everything I can do."))
+		return nil
+	},
+}
@@ -0,0 +1,101 @@
+package bot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseArgs(t *testing.T) {
+	cmd := &botCommand{
+		Alias: "remind",
+		Args: []commandArg{
+			{Name: "count", Kind: argInt},
+			{Name: "after", Kind: argDuration},
+			{Name: "text", Kind: argRest, Optional: true},
+		},
+	}
+
+	cases := []struct {
+		fields  []string
+		want    map[string]interface{}
+		wantErr bool
+	}{
+		{
+			fields: []string{"3", "30m"},
+			want:   map[string]interface{}{"count": int64(3), "after": 30 * time.Minute},
+		},
+		{
+			fields: []string{"3", "2h", "take", "a", "break"},
+			want: map[string]interface{}{
+				"count": int64(3),
+				"after": 2 * time.Hour,
+				"text":  []string{"take", "a", "break"},
+			},
+		},
+		{fields: []string{"3"}, wantErr: true},
+		{fields: []string{"three", "30m"}, wantErr: true},
+		{fields: []string{"3", "soon"}, wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := cmd.parseArgs(tc.fields)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tc.fields, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.fields, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.fields, got, tc.want)
+		}
+	}
+
+	single := &botCommand{Alias: "ban", Args: []commandArg{{Name: "user", Kind: argString}}}
+	if _, err := single.parseArgs([]string{"alice", "bob"}); err == nil {
+		t.Error("expected an error for too many arguments")
+	}
+}
+
+func TestResolveCommand(t *testing.T) {
+	revoke := &botCommand{Alias: "revoke", Permission: permOwner}
+	list := &botCommand{Alias: "list"}
+	token := &botCommand{
+		Alias:       "token",
+		Permission:  permAllowed,
+		Subcommands: []*botCommand{list, revoke},
+	}
+
+	cases := []struct {
+		fields   []string
+		wantCmd  *botCommand
+		wantPath []string
+		wantPerm permission
+		wantRest []string
+	}{
+		{nil, token, []string{"token"}, permAllowed, nil},
+		{[]string{"list"}, list, []string{"token", "list"}, permAllowed, []string{}},
+		// Subcommands are matched case-insensitively and keep the highest
+		// permission on the path.
+		{[]string{"REVOKE", "abc"}, revoke, []string{"token", "revoke"}, permOwner, []string{"abc"}},
+		{[]string{"unknown", "x"}, token, []string{"token"}, permAllowed, []string{"unknown", "x"}},
+	}
+	for _, tc := range cases {
+		cmd, path, perm, rest := resolveCommand(token, tc.fields)
+		if cmd != tc.wantCmd {
+			t.Errorf("%q: resolved to %s, want %s", tc.fields, cmd.Alias, tc.wantCmd.Alias)
+		}
+		if !reflect.DeepEqual(path, tc.wantPath) {
+			t.Errorf("%q: got path %q, want %q", tc.fields, path, tc.wantPath)
+		}
+		if perm != tc.wantPerm {
+			t.Errorf("%q: got permission %d, want %d", tc.fields, perm, tc.wantPerm)
+		}
+		if !reflect.DeepEqual(rest, tc.wantRest) {
+			t.Errorf("%q: got remaining fields %q, want %q", tc.fields, rest, tc.wantRest)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// defaultConversationTimeout is how long a conversation waits for a reply
+// before it is abandoned.
+const defaultConversationTimeout = 5 * time.Minute
+
+// conversationReply is the user's answer to a prompt, either a message or a
+// press of one of the prompt's buttons.
+type conversationReply struct {
+	Message *tgbotapi.Message
+	Query   *tgbotapi.CallbackQuery
+
+	// Text is the text of the message or the value of the pressed button.
+	Text string
+}
+
+// conversationStep handles the next reply in a conversation. Steps either
+// prompt again, naming the step that handles the answer, or end the
+// conversation.
+type conversationStep func(ctx context.Context, b *Bot, conv *conversation, reply *conversationReply) error
+
+// choice is a button offered by a prompt.
+type choice struct {
+	Label string
+	Value string
+}
+
+type conversationKey struct {
+	ChatID int64
+	UserID int64
+}
+
+// conversation is a multi step exchange with a single user in a chat, used
+// by commands that need several inputs.
+type conversation struct {
+	ChatID int64
+	UserID int64
+
+	// Data holds the answers collected so far.
+	Data map[string]string
+
+	// Timeout is how long each prompt waits for an answer.
+	Timeout time.Duration
+
+	replyTo int
+	next    conversationStep
+	expires time.Time
+}
+
+// conversations tracks the active conversation of each user in each chat.
+type conversations struct {
+	mu       sync.Mutex
+	sessions map[conversationKey]*conversation
+}
+
+func newConversations() *conversations {
+	return &conversations{
+		sessions: make(map[conversationKey]*conversation),
+	}
+}
+
+func (c *conversations) get(chatID, userID int64) *conversation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessions[conversationKey{chatID, userID}]
+}
+
+func (c *conversations) put(conv *conversation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sessions[conversationKey{conv.ChatID, conv.UserID}] = conv
+}
+
+// remove ends the conversation of a user, reporting whether there was one.
+func (c *conversations) remove(chatID, userID int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := conversationKey{chatID, userID}
+	_, ok := c.sessions[key]
+	delete(c.sessions, key)
+	return ok
+}
+
+// expired removes and returns the conversations whose prompt timed out.
+func (c *conversations) expired(now time.Time) []*conversation {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var out []*conversation
+	for key, conv := range c.sessions {
+		if now.After(conv.expires) {
+			out = append(out, conv)
+			delete(c.sessions, key)
+		}
+	}
+	return out
+}
+
+// startConversation begins a conversation with the sender of req,
+// replacing any conversation they already had in the chat.
+func (b *Bot) startConversation(req *commandRequest) *conversation {
+	return b.newConversation(req.ChatID(), req.UserID(), req.Message.MessageID)
+}
+
+// newConversation begins a conversation with a user in a chat, with prompts
+// in groups replying to the message replyTo.
+func (b *Bot) newConversation(chatID, userID int64, replyTo int) *conversation {
+	return &conversation{
+		ChatID:  chatID,
+		UserID:  userID,
+		Data:    make(map[string]string),
+		Timeout: defaultConversationTimeout,
+		replyTo: replyTo,
+	}
+}
+
+// Prompt asks the user for a message, which is handled by next.
+func (conv *conversation) Prompt(ctx context.Context, b *Bot, text string, next conversationStep) error {
+	return conv.PromptChoice(ctx, b, text, nil, next)
+}
+
+// PromptChoice asks the user to press one of choices, one row of buttons
+// per slice, or to send a message. The answer is handled by next.
+func (conv *conversation) PromptChoice(ctx context.Context, b *Bot, text string, choices [][]choice, next conversationStep) error {
+	msg := tgbotapi.NewMessage(conv.ChatID, text)
+	if len(choices) > 0 {
+		var rows [][]tgbotapi.InlineKeyboardButton
+		for _, row := range choices {
+			var buttons []tgbotapi.InlineKeyboardButton
+			for _, c := range row {
+				buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(c.Label, "conv:"+c.Value))
+			}
+			rows = append(rows, buttons)
+		}
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	} else if conv.ChatID != conv.UserID {
+		// In groups the bot may only see messages that reply to it, so ask
+		// the user (and only them) to reply.
+		msg.ReplyToMessageID = conv.replyTo
+		msg.ReplyMarkup = tgbotapi.ForceReply{ForceReply: true, Selective: true}
+	}
+
+	_, err := b.tg.SendContext(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	conv.next = next
+	conv.expires = time.Now().Add(conv.Timeout)
+	b.conversations.put(conv)
+	return nil
+}
+
+// End finishes the conversation, optionally telling the user why.
+func (conv *conversation) End(ctx context.Context, b *Bot, text string) {
+	b.conversations.remove(conv.ChatID, conv.UserID)
+	if text != "" {
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(conv.ChatID, text))
+	}
+}
+
+// continueConversation feeds a reply to the active conversation of its
+// sender, reporting whether there was one.
+func (b *Bot) continueConversation(chatID, userID int64, reply *conversationReply) bool {
+	conv := b.conversations.get(chatID, userID)
+	if conv == nil {
+		return false
+	}
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), b.cfg.CommandTimeout)
+	defer cancelFn()
+	if time.Now().After(conv.expires) {
+		conv.End(ctx, b, "Sorry, that took too long. Please start again.")
+		return true
+	}
+
+	// The step decides whether to continue by prompting again.
+	b.conversations.remove(chatID, userID)
+	step := conv.next
+	conv.next = nil
+
+	err := step(ctx, b, conv, reply)
+	if err != nil {
+		b.logger.Error("failed to continue conversation", "error", err, "chat_id", chatID)
+		conv.End(ctx, b, "Sorry, something went wrong :(")
+	}
+	return true
+}
+
+// expireConversations abandons conversations whose prompt timed out.
+func (b *Bot) expireConversations(now time.Time) {
+	for _, conv := range b.conversations.expired(now) {
+		b.tg.Send(tgbotapi.NewMessage(conv.ChatID, "I stopped waiting for an answer, please start again if you still need to."))
+	}
+}
+
+var conversationCallback = &botCallback{
+	Prefix: "conv",
+	RunFunc: func(ctx context.Context, b *Bot, query *tgbotapi.CallbackQuery, args []string) error {
+		if query.Message == nil || len(args) == 0 {
+			return fmt.Errorf("malformed conversation callback: %v", args)
+		}
+
+		value := args[0]
+		for _, a := range args[1:] {
+			value += ":" + a
+		}
+		reply := &conversationReply{Query: query, Text: value}
+		if !b.continueConversation(query.Message.Chat.ID, int64(query.From.ID), reply) {
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "This question has expired."))
+			return nil
+		}
+		b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, ""))
+		return nil
+	},
+}
+
+var cancelCmd = &botCommand{
+	Alias:       "cancel",
+	Description: "Cancel the current operation",
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		reply := "There's nothing to cancel."
+		if b.conversations.remove(req.ChatID(), req.UserID()) {
+			reply = "Cancelled."
+		}
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), reply))
+		return nil
+	},
+}
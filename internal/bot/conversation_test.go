@@ -0,0 +1,125 @@
+package bot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newWizardTestBot returns a bot with a /wizard command that asks for a name
+// and then a colour, reporting the answers when it is done.
+func newWizardTestBot(t *testing.T) (*Bot, *fakeTelegram) {
+	b, fake := newTestBot(t, openTestStore(t), &Config{
+		AllowedUsers: []int64{testAllowed},
+		AllowedChats: []int64{testGroup},
+	})
+
+	colourStep := func(ctx context.Context, b *Bot, conv *conversation, reply *conversationReply) error {
+		conv.End(ctx, b, "Done: "+conv.Data["name"]+" is "+reply.Text)
+		return nil
+	}
+	nameStep := func(ctx context.Context, b *Bot, conv *conversation, reply *conversationReply) error {
+		conv.Data["name"] = reply.Text
+		return conv.PromptChoice(ctx, b, "Which colour?", [][]choice{{{Label: "Red", Value: "red"}}}, colourStep)
+	}
+	b.commands["wizard"] = &botCommand{
+		Alias:      "wizard",
+		Permission: permAllowed,
+		RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+			return b.startConversation(req).Prompt(ctx, b, "What's the name?", nameStep)
+		},
+	}
+	return b, fake
+}
+
+func TestConversation(t *testing.T) {
+	b, fake := newWizardTestBot(t)
+
+	b.handleUpdate(messageUpdate(testGroup, testAllowed, "/wizard"))
+	if got := fake.LastMessage(testGroup); got != "What's the name?" {
+		t.Fatalf("got %q, want the first prompt", got)
+	}
+	prompt := fake.Calls("sendMessage")[0]
+	if !strings.Contains(prompt.Get("reply_markup"), "force_reply") {
+		t.Fatalf("a prompt in a group doesn't ask for a reply: %v", prompt)
+	}
+
+	// Other members of the chat don't answer for the user.
+	b.handleUpdate(messageUpdate(testGroup, 30, "not me"))
+	b.handleUpdate(messageUpdate(testGroup, testAllowed, "lamp"))
+	if got := fake.LastMessage(testGroup); got != "Which colour?" {
+		t.Fatalf("got %q, want the second prompt", got)
+	}
+
+	b.handleUpdate(callbackUpdate(testGroup, 30, "conv:blue"))
+	if got := fake.Calls("answerCallbackQuery"); len(got) != 1 || !strings.Contains(got[0].Get("text"), "expired") {
+		t.Fatalf("another member's button press was answered with %v", got)
+	}
+	b.handleUpdate(callbackUpdate(testGroup, testAllowed, "conv:red"))
+	if got := fake.LastMessage(testGroup); got != "Done: lamp is red" {
+		t.Fatalf("got %q", got)
+	}
+	if b.conversations.get(testGroup, testAllowed) != nil {
+		t.Fatal("the conversation didn't end")
+	}
+}
+
+func TestConversationCancel(t *testing.T) {
+	b, fake := newWizardTestBot(t)
+
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "/wizard"))
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "/cancel"))
+	if got := fake.LastMessage(testAllowed); got != "Cancelled." {
+		t.Fatalf("got %q", got)
+	}
+
+	fake.Reset()
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "lamp"))
+	if got := fake.Messages(testAllowed); len(got) != 0 {
+		t.Fatalf("a cancelled conversation continued: %q", got)
+	}
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "/cancel"))
+	if got := fake.LastMessage(testAllowed); got != "There's nothing to cancel." {
+		t.Fatalf("got %q", got)
+	}
+
+	// Starting another command abandons the conversation too.
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "/wizard"))
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "/start"))
+	if b.conversations.get(testAllowed, testAllowed) != nil {
+		t.Fatal("another command didn't abandon the conversation")
+	}
+}
+
+func TestConversationTimeout(t *testing.T) {
+	b, fake := newWizardTestBot(t)
+
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "/wizard"))
+	b.expireConversations(time.Now().Add(time.Minute))
+	if b.conversations.get(testAllowed, testAllowed) == nil {
+		t.Fatal("the conversation expired early")
+	}
+
+	b.expireConversations(time.Now().Add(defaultConversationTimeout + time.Second))
+	if got := fake.LastMessage(testAllowed); !strings.Contains(got, "stopped waiting") {
+		t.Fatalf("got %q, want the user told the conversation expired", got)
+	}
+	fake.Reset()
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "lamp"))
+	if got := fake.Messages(testAllowed); len(got) != 0 {
+		t.Fatalf("an expired conversation continued: %q", got)
+	}
+
+	// A reply that arrives late, before the conversation was expired, ends
+	// it too.
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "/wizard"))
+	b.conversations.get(testAllowed, testAllowed).expires = time.Now().Add(-time.Second)
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "lamp"))
+	if got := fake.LastMessage(testAllowed); !strings.Contains(got, "took too long") {
+		t.Fatalf("got %q, want the late reply refused", got)
+	}
+	if b.conversations.get(testAllowed, testAllowed) != nil {
+		t.Fatal("a late reply didn't end the conversation")
+	}
+}
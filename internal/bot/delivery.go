@@ -0,0 +1,191 @@
+package bot
+
+import (
+	"strings"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/history"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Notification is a message sent to a chat through the API.
+type Notification struct {
+	ChatID int64  `json:"chat_id"`
+	Text   string `json:"text"`
+
+	// Silent overrides the chat's default silent delivery setting when set.
+	Silent *bool `json:"silent,omitempty"`
+
+	// Source is the ID of the credential that sent the notification and
+	// SourceName describes it to users.
+	Source     string `json:"source"`
+	SourceName string `json:"source_name"`
+
+	// High priority notifications are delivered immediately and with sound,
+	// even during quiet hours.
+	High bool `json:"high,omitempty"`
+
+	// Buttons attaches buttons to mute the source or snooze the
+	// notification when it is sent on its own.
+	Buttons bool `json:"buttons,omitempty"`
+
+	// Format overrides how the chat's settings parse the text when set:
+	// plain, markdown or html.
+	Format string `json:"format,omitempty"`
+}
+
+// ValidFormat reports whether notification text can be parsed as format.
+func ValidFormat(format string) bool {
+	for _, f := range formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify delivers n according to the settings of its chat: it may be sent
+// silently, formatted, held until quiet hours end or added to the chat's
+// digest. Notifications from muted sources are dropped with a *MutedError.
+// Every notification is recorded in the chat's history.
+func (b *Bot) Notify(n *Notification) error {
+	return b.notifyAndRecord(n, "")
+}
+
+// notifyAndRecord delivers n as Notify does, recording the ID of the
+// scheduled notification that sent it, if any.
+func (b *Bot) notifyAndRecord(n *Notification, scheduledID string) error {
+	rec := &history.Record{
+		ChatID:      b.chats.Resolve(n.ChatID),
+		Source:      n.Source,
+		SourceName:  n.SourceName,
+		Text:        n.Text,
+		ReceivedAt:  time.Now(),
+		ScheduledID: scheduledID,
+	}
+
+	var err error
+	rec.Status, err = b.notify(rec.ChatID, n, rec.ReceivedAt)
+	if _, ok := err.(*MutedError); ok {
+		rec.Status = history.StatusMuted
+	} else if err != nil {
+		rec.Status = history.StatusFailed
+		rec.Error = err.Error()
+	}
+	if rec.Status == history.StatusDelivered {
+		delivered := time.Now()
+		rec.DeliveredAt = &delivered
+	}
+
+	if herr := b.history.Add(rec); herr != nil {
+		b.logger.Error("failed to record notification history", "chat_id", rec.ChatID, "error", herr)
+	}
+	return err
+}
+
+// notify delivers n to chatID, returning what happened to it.
+func (b *Bot) notify(chatID int64, n *Notification, now time.Time) (string, error) {
+	if since, ok := b.chats.BlockedSince(chatID); ok && time.Since(since) < blockedRetryInterval {
+		return "", ErrChatBlocked
+	}
+
+	settings := b.settings.Get(chatID)
+	if until, ok := settings.MutedUntil(n.Source, now); ok {
+		return "", &MutedError{Source: n.SourceName, Until: until}
+	}
+
+	format := settings.Format
+	if n.Format != "" {
+		format = n.Format
+	}
+
+	if n.High {
+		silent := n.Silent != nil && *n.Silent
+		return history.StatusDelivered, b.deliverNotification(laneUrgent, chatID, n, format, silent, now)
+	}
+
+	if source, window, count := settings.digestFor(n.Source); window > 0 {
+		return history.StatusDigested, b.addToDigest(queueKey{chatID, source}, n, count, now)
+	}
+	if settings.Holds(now) {
+		_, err := b.held.Add(queueKey{ChatID: chatID}, queuedNotification{Time: now, Text: n.Text, Source: n.SourceName})
+		return history.StatusHeld, err
+	}
+
+	silent := settings.Silent
+	if n.Silent != nil {
+		silent = *n.Silent
+	}
+	if settings.Quiet(now) {
+		silent = true
+	}
+
+	return history.StatusDelivered, b.deliverNotification(laneBulk, chatID, n, format, silent, now)
+}
+
+// deliverNotification sends n on its own, with buttons if it asks for them.
+// Notifications with buttons are kept for a while so they can be snoozed.
+func (b *Bot) deliverNotification(lane sendLane, chatID int64, n *Notification, format string, silent bool, now time.Time) error {
+	if !n.Buttons {
+		return b.deliver(lane, chatID, n.Text, format, silent, nil)
+	}
+
+	sentID := ""
+	sent, err := b.jobs.Add(jobSentNotification, chatID, now.Add(sentNotificationTTL), n.SourceName, n)
+	if err != nil {
+		// The notification is still worth sending, just without the snooze
+		// button.
+		b.logger.Error("failed to record sent notification", "chat_id", chatID, "error", err)
+	} else {
+		sentID = sent.ID
+	}
+
+	err = b.deliver(lane, chatID, n.Text, format, silent, notificationButtons(n.Source, sentID))
+	if err != nil && sent != nil {
+		if _, cerr := b.jobs.Cancel(sent.ID); cerr != nil {
+			b.logger.Error("failed to forget undelivered notification", "job_id", sent.ID, "error", cerr)
+		}
+	}
+	return err
+}
+
+// deliver sends text to a chat in the given lane, following migrations and
+// recording whether the chat is reachable. markup, if not nil, is attached
+// to the message.
+func (b *Bot) deliver(lane sendLane, chatID int64, text, format string, silent bool, markup interface{}) error {
+	msg := tgbotapi.NewMessage(chatID, text)
+	msg.DisableNotification = silent
+	msg.ParseMode = parseMode(format)
+	if markup != nil {
+		msg.ReplyMarkup = markup
+	}
+
+	_, err := b.tg.SendIn(lane, msg)
+	if tgErr, ok := err.(tgbotapi.Error); ok && tgErr.MigrateToChatID != 0 {
+		b.handleMigration(chatID, tgErr.MigrateToChatID)
+		msg.ChatID = tgErr.MigrateToChatID
+		_, err = b.tg.SendIn(lane, msg)
+	}
+	if err != nil && msg.ParseMode != "" && isParseError(err) {
+		// Better to deliver the raw text than nothing at all.
+		b.logger.Debug("failed to parse formatted message, sending as plain text", "chat_id", msg.ChatID, "error", err)
+		msg.ParseMode = ""
+		_, err = b.tg.SendIn(lane, msg)
+	}
+
+	return b.checkDelivery(msg.ChatID, err)
+}
+
+func parseMode(format string) string {
+	switch format {
+	case formatMarkdown:
+		return tgbotapi.ModeMarkdown
+	case formatHTML:
+		return tgbotapi.ModeHTML
+	}
+	return ""
+}
+
+func isParseError(err error) bool {
+	return strings.Contains(err.Error(), "can't parse entities")
+}
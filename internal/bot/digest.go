@@ -0,0 +1,317 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	digestsDocument = "digests"
+
+	// maxDigestEntries is how many of the most recent notifications are
+	// shown in a digest.
+	maxDigestEntries = 10
+
+	// maxDigestEntryLength is how many characters of each notification are
+	// included in a digest.
+	maxDigestEntryLength = 300
+
+	// maxMessageLength is the longest message Telegram accepts.
+	maxMessageLength = 4096
+)
+
+// digestRule batches the notifications of a single source.
+type digestRule struct {
+	// Name describes the source to users.
+	Name string `json:"name"`
+
+	// Window is how long notifications are collected for, e.g. "15m".
+	Window string `json:"window"`
+
+	// Count sends the digest early once this many notifications are
+	// pending. Zero only uses the window.
+	Count int `json:"count,omitempty"`
+}
+
+// digestFor returns how notifications from source are batched: the source
+// they are grouped under, empty for the whole chat, the window and the count
+// threshold. A zero window means they aren't.
+func (s *chatSettings) digestFor(source string) (string, time.Duration, int) {
+	if rule, ok := s.SourceDigests[source]; ok && source != "" {
+		window, _ := time.ParseDuration(rule.Window)
+		return source, window, rule.Count
+	}
+	return "", s.DigestWindow(), s.DigestCount
+}
+
+func describeDigest(window string, count int) string {
+	if window == "" {
+		return "off"
+	}
+	if count > 0 {
+		return fmt.Sprintf("every %s or %d notifications", window, count)
+	}
+	return "every " + window
+}
+
+// addToDigest queues n for its digest, sending the digest right away if it
+// reached its count threshold.
+func (b *Bot) addToDigest(key queueKey, n *Notification, count int, now time.Time) error {
+	pending, err := b.digests.Add(key, queuedNotification{Time: now, Text: n.Text, Source: n.SourceName})
+	if err != nil {
+		return err
+	}
+
+	settings := b.settings.Get(key.ChatID)
+	if count > 0 && pending >= count && !settings.Holds(now) {
+		b.flushDigest(key, settings, now)
+	}
+	return nil
+}
+
+// flushDigests sends the digests whose window has passed.
+func (b *Bot) flushDigests(now time.Time) {
+	for key, started := range b.digests.Started() {
+		settings := b.settings.Get(key.ChatID)
+		_, window, _ := settings.digestFor(key.Source)
+		if now.Sub(started) < window || settings.Holds(now) {
+			continue
+		}
+		b.flushDigest(key, settings, now)
+	}
+}
+
+// flushDigest sends the notifications pending for key as a single message.
+func (b *Bot) flushDigest(key queueKey, settings *chatSettings, now time.Time) {
+	b.digests.sending.Lock()
+	defer b.digests.sending.Unlock()
+
+	entries := b.digests.Entries(key)
+	if len(entries) == 0 {
+		return
+	}
+
+	text := formatDigest(settings, entries)
+	err := b.deliver(laneBulk, b.chats.Resolve(key.ChatID), text, formatPlain, settings.Silent || settings.Quiet(now), nil)
+	if err != nil && err != ErrChatBlocked && err != ErrChatNotFound {
+		// Try again on the next tick.
+		b.logger.Error("failed to send digest", "chat_id", key.ChatID, "source", key.Source, "error", err)
+		return
+	}
+	if err != nil {
+		b.logger.Info("dropping digest for unreachable chat", "chat_id", key.ChatID, "count", len(entries))
+	}
+
+	err = b.digests.Remove(key, len(entries))
+	if err != nil {
+		b.logger.Error("failed to update digests", "chat_id", key.ChatID, "error", err)
+	}
+}
+
+// formatDigest summarizes entries in a single message.
+func formatDigest(settings *chatSettings, entries []queuedNotification) string {
+	header := fmt.Sprintf(translate(settings.Language, "%d notifications since %s:"),
+		len(entries), entries[0].Time.In(settings.Location()).Format("Jan 2 15:04"))
+	return formatSummary(settings, header, entries)
+}
+
+// formatSummary combines entries in a single message under header: how many
+// came from each source and as many of the most recent ones as fit.
+func formatSummary(settings *chatSettings, header string, entries []queuedNotification) string {
+	loc := settings.Location()
+
+	counts := make(map[string]int)
+	for _, e := range entries {
+		counts[e.Source]++
+	}
+	var sources []string
+	for source := range counts {
+		sources = append(sources, source)
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if counts[sources[i]] != counts[sources[j]] {
+			return counts[sources[i]] > counts[sources[j]]
+		}
+		return sources[i] < sources[j]
+	})
+
+	var sb strings.Builder
+	sb.WriteString(header)
+	if len(sources) > 1 {
+		sb.WriteString("\n")
+		for _, source := range sources {
+			name := source
+			if name == "" {
+				name = translate(settings.Language, "unknown")
+			}
+			fmt.Fprintf(&sb, "\n%s: %d", name, counts[source])
+		}
+	}
+
+	var lines []string
+	length := sb.Len()
+	for i := len(entries) - 1; i >= 0 && len(lines) < maxDigestEntries; i-- {
+		e := entries[i]
+		text := e.Text
+		if r := []rune(text); len(r) > maxDigestEntryLength {
+			text = string(r[:maxDigestEntryLength]) + "…"
+		}
+		line := e.Time.In(loc).Format("15:04") + "  "
+		if len(sources) > 1 && e.Source != "" {
+			line += "[" + e.Source + "] "
+		}
+		line += text
+
+		// Leave room for the trailer below.
+		if length+len(line)+100 > maxMessageLength {
+			break
+		}
+		length += len(line) + 2
+		lines = append(lines, line)
+	}
+
+	if omitted := len(entries) - len(lines); omitted > 0 {
+		sb.WriteString("\n\n")
+		fmt.Fprintf(&sb, translate(settings.Language, "(%d older notifications not shown)"), omitted)
+	}
+	// Show the entries in the order they arrived.
+	for i := len(lines) - 1; i >= 0; i-- {
+		sb.WriteString("\n\n")
+		sb.WriteString(lines[i])
+	}
+	return sb.String()
+}
+
+// resolveSource finds the credential of chatID that s refers to: "all" for
+// every source, a token ID, a webhook name or a credential ID as reported by
+// GET /whoami. It returns the credential ID and a name for it.
+func (b *Bot) resolveSource(chatID int64, s string) (string, string, error) {
+	if strings.EqualFold(s, "all") {
+		return "", "all sources", nil
+	}
+
+	kind, id := "", s
+	if i := strings.Index(s, ":"); i >= 0 {
+		kind, id = s[:i], s[i+1:]
+	}
+
+	if kind == "" || kind == "token" {
+		rec := b.registry.Get(id)
+		if rec != nil && b.chats.Resolve(rec.ChatID) == chatID {
+			return "token:" + rec.ID, "token " + rec.ID, nil
+		}
+	}
+	if kind == "" || kind == "webhook" {
+		for _, h := range b.webhooks.List(b.inChat(chatID)) {
+			if h.ID == id || h.Name == id {
+				return "webhook:" + h.ID, "webhook " + h.Name, nil
+			}
+		}
+	}
+	if kind == "" || kind == "hmac" {
+		for _, c := range b.signing.Clients(b.inChat(chatID)) {
+			if c.ID == id {
+				return "hmac:" + c.ID, "signing key " + c.Name, nil
+			}
+		}
+	}
+	if kind == "unix" && id != "" {
+		return s, s, nil
+	}
+	return "", "", fmt.Errorf("there is no source %q in this chat", s)
+}
+
+var digestCmd = &botCommand{
+	Alias:       "digest",
+	Description: "Batch notifications into periodic summaries",
+	Permission:  permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		settings := b.settings.Get(req.ChatID())
+
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "All sources: %s", describeDigest(settings.Digest, settings.DigestCount))
+		var sources []string
+		for source := range settings.SourceDigests {
+			sources = append(sources, source)
+		}
+		sort.Strings(sources)
+		for _, source := range sources {
+			rule := settings.SourceDigests[source]
+			fmt.Fprintf(&sb, "\n%s: %s", rule.Name, describeDigest(rule.Window, rule.Count))
+		}
+		sb.WriteString("\n\nUsage:\n" + b.commands[req.Path[0]].usage(req.Path))
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), sb.String()))
+		return nil
+	},
+	Subcommands: []*botCommand{
+		{
+			Alias: "set",
+			Args: []commandArg{
+				{Name: "source|all", Kind: argString},
+				{Name: "window", Kind: argDuration},
+				{Name: "count", Kind: argInt, Optional: true},
+			},
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				source, name, err := b.resolveSource(req.ChatID(), req.String("source|all"))
+				if err != nil {
+					b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), fmt.Sprintf("Sorry, %v.", err)))
+					return nil
+				}
+				window, count := req.Duration("window"), int(req.Int("count"))
+				if window < time.Minute || count < 0 {
+					b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), "Sorry, the window must be at least a minute and the count can't be negative."))
+					return nil
+				}
+
+				_, err = b.settings.Update(req.ChatID(), func(cs *chatSettings) {
+					if source == "" {
+						cs.Digest, cs.DigestCount = window.String(), count
+						return
+					}
+					if cs.SourceDigests == nil {
+						cs.SourceDigests = make(map[string]*digestRule)
+					}
+					cs.SourceDigests[source] = &digestRule{Name: name, Window: window.String(), Count: count}
+				})
+				if err != nil {
+					return err
+				}
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(),
+					fmt.Sprintf("Notifications from %s will be sent %s.", name, describeDigest(window.String(), count))))
+				return nil
+			},
+		},
+		{
+			Alias: "off",
+			Args: []commandArg{
+				{Name: "source|all", Kind: argString},
+			},
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				source, name, err := b.resolveSource(req.ChatID(), req.String("source|all"))
+				if err != nil {
+					b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), fmt.Sprintf("Sorry, %v.", err)))
+					return nil
+				}
+
+				_, err = b.settings.Update(req.ChatID(), func(cs *chatSettings) {
+					if source == "" {
+						cs.Digest, cs.DigestCount = "", 0
+						return
+					}
+					delete(cs.SourceDigests, source)
+				})
+				if err != nil {
+					return err
+				}
+				// Anything still pending is sent on the next tick.
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), fmt.Sprintf("Notifications from %s are no longer batched.", name)))
+				return nil
+			},
+		},
+	},
+}
@@ -0,0 +1,124 @@
+package bot
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newDigestTestBot(t *testing.T, fn func(cs *chatSettings)) (*Bot, *fakeTelegram) {
+	b, fake := newTestBot(t, openTestStore(t), &Config{})
+	if _, err := b.settings.Update(testAllowed, fn); err != nil {
+		t.Fatal(err)
+	}
+	return b, fake
+}
+
+func notifyN(t *testing.T, b *Bot, source string, n int) {
+	for i := 1; i <= n; i++ {
+		err := b.Notify(&Notification{ChatID: testAllowed, Text: fmt.Sprintf("%s %d", source, i), Source: source, SourceName: source})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDigestCountThreshold(t *testing.T) {
+	b, fake := newDigestTestBot(t, func(cs *chatSettings) { cs.Digest, cs.DigestCount = "1h", 3 })
+
+	notifyN(t, b, "a", 2)
+	if got := fake.Messages(testAllowed); len(got) != 0 {
+		t.Fatalf("sent %q below the threshold", got)
+	}
+	notifyN(t, b, "b", 1)
+	got := fake.Messages(testAllowed)
+	if len(got) != 1 || !strings.HasPrefix(got[0], "3 notifications since") {
+		t.Fatalf("got %q, want a digest once the threshold was reached", got)
+	}
+	for _, want := range []string{"a: 2", "b: 1", "a 1", "a 2", "[b] b 1"} {
+		if !strings.Contains(got[0], want) {
+			t.Errorf("the digest doesn't contain %q:\n%s", want, got[0])
+		}
+	}
+	if pending := b.digests.Entries(queueKey{ChatID: testAllowed}); len(pending) != 0 {
+		t.Fatalf("%d notifications are still pending", len(pending))
+	}
+}
+
+func TestDigestWindowFlush(t *testing.T) {
+	b, fake := newDigestTestBot(t, func(cs *chatSettings) { cs.Digest = "15m" })
+	start := time.Now()
+
+	notifyN(t, b, "a", 2)
+	b.flushDigests(start.Add(10 * time.Minute))
+	if got := fake.Messages(testAllowed); len(got) != 0 {
+		t.Fatalf("sent %q before the window passed", got)
+	}
+
+	b.flushDigests(start.Add(16 * time.Minute))
+	got := fake.Messages(testAllowed)
+	if len(got) != 1 || !strings.HasPrefix(got[0], "2 notifications since") {
+		t.Fatalf("got %q, want the digest once the window passed", got)
+	}
+	b.flushDigests(start.Add(32 * time.Minute))
+	if got := fake.Messages(testAllowed); len(got) != 1 {
+		t.Fatalf("the digest was sent again: %q", got)
+	}
+}
+
+func TestDigestFlushRetriesFailures(t *testing.T) {
+	b, fake := newDigestTestBot(t, func(cs *chatSettings) { cs.Digest = "15m" })
+	start := time.Now()
+	notifyN(t, b, "a", 2)
+
+	fake.fail = func(method string, params url.Values) string { return "Internal Server Error" }
+	b.flushDigests(start.Add(16 * time.Minute))
+	if pending := b.digests.Entries(queueKey{ChatID: testAllowed}); len(pending) != 2 {
+		t.Fatalf("got %d pending notifications after a failed send, want 2", len(pending))
+	}
+
+	fake.fail = nil
+	fake.Reset()
+	b.flushDigests(start.Add(17 * time.Minute))
+	if got := fake.Messages(testAllowed); len(got) != 1 {
+		t.Fatalf("got %q, want the digest sent on the next tick", got)
+	}
+}
+
+func TestSourceDigests(t *testing.T) {
+	b, fake := newDigestTestBot(t, func(cs *chatSettings) {
+		cs.SourceDigests = map[string]*digestRule{"a": {Name: "a", Window: "1h", Count: 2}}
+	})
+
+	notifyN(t, b, "a", 1)
+	notifyN(t, b, "b", 1)
+	if got := fake.Messages(testAllowed); len(got) != 1 || got[0] != "b 1" {
+		t.Fatalf("got %q, want only the other source delivered", got)
+	}
+	notifyN(t, b, "a", 1)
+	got := fake.Messages(testAllowed)
+	if len(got) != 2 || !strings.HasPrefix(got[1], "2 notifications since") {
+		t.Fatalf("got %q, want the source's digest at its own threshold", got)
+	}
+	if pending := b.digests.Entries(queueKey{testAllowed, "a"}); len(pending) != 0 {
+		t.Fatalf("%d notifications are still pending", len(pending))
+	}
+}
+
+func TestFormatDigestOmitsOlderEntries(t *testing.T) {
+	var entries []queuedNotification
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < maxDigestEntries+5; i++ {
+		entries = append(entries, queuedNotification{Time: start.Add(time.Duration(i) * time.Minute), Text: fmt.Sprintf("entry %d", i)})
+	}
+
+	text := formatDigest(defaultChatSettings(), entries)
+	if !strings.Contains(text, "(5 older notifications not shown)") {
+		t.Fatalf("the digest doesn't say entries were left out:\n%s", text)
+	}
+	if strings.Contains(text, "entry 4\n") || !strings.HasSuffix(text, "entry 14") {
+		t.Fatalf("the digest doesn't show the most recent entries:\n%s", text)
+	}
+}
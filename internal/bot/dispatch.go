@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// dispatcherQueueSize is the number of updates buffered per worker before
+// Dispatch turns updates away.
+const dispatcherQueueSize = 64
+
+// busyReplyInterval is how often a chat is told the bot is too busy.
+const busyReplyInterval = 10 * time.Second
+
+// dispatcher processes updates on a fixed pool of workers. Updates are
+// sharded by chat so that each chat's updates are handled in the order they
+// arrived, while different chats don't hold each other up.
+type dispatcher struct {
+	bot    *Bot
+	queues []chan tgbotapi.Update
+	busy   *cooldown
+	wg     sync.WaitGroup
+}
+
+func newDispatcher(b *Bot, workers int) *dispatcher {
+	d := &dispatcher{
+		bot:    b,
+		queues: make([]chan tgbotapi.Update, workers),
+		busy:   &cooldown{interval: busyReplyInterval},
+	}
+	for i := range d.queues {
+		q := make(chan tgbotapi.Update, dispatcherQueueSize)
+		d.queues[i] = q
+		d.wg.Add(1)
+		go d.work(q)
+	}
+	return d
+}
+
+func (d *dispatcher) work(q <-chan tgbotapi.Update) {
+	defer d.wg.Done()
+	for update := range q {
+		d.handle(update)
+	}
+}
+
+// handle processes one update, recovering from panics so that a broken
+// command can't take the bot down.
+func (d *dispatcher) handle(update tgbotapi.Update) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		d.bot.logger.Error("panic while handling update", "update_id", update.UpdateID, "panic", r, "stack", string(debug.Stack()))
+		if chatID := updateChatID(update); chatID != 0 {
+			d.bot.tg.Send(tgbotapi.NewMessage(chatID, "Sorry, something went wrong :("))
+		}
+		if update.CallbackQuery != nil {
+			d.bot.tg.AnswerCallbackQuery(tgbotapi.NewCallback(update.CallbackQuery.ID, "Sorry, something went wrong :("))
+		}
+	}()
+
+	d.bot.handleUpdate(update)
+}
+
+// Dispatch queues update on the worker responsible for its chat. It never
+// blocks: when the worker is backed up the update is turned away, so that a
+// busy chat can't stall the bot's timers.
+func (d *dispatcher) Dispatch(update tgbotapi.Update) {
+	chatID := updateChatID(update)
+	key := chatID
+	if key < 0 {
+		key = -key
+	}
+	select {
+	case d.queues[key%int64(len(d.queues))] <- update:
+		return
+	default:
+	}
+
+	msg := update.Message
+	if msg != nil && (msg.MigrateToChatID != 0 || msg.MigrateFromChatID != 0) {
+		// Migrations must not be lost and don't depend on the order of
+		// updates.
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.handle(update)
+		}()
+		return
+	}
+
+	d.bot.logger.Warn("worker is busy, dropping update", "update_id", update.UpdateID, "chat_id", chatID)
+	if !d.busy.Ready(strconv.FormatInt(chatID, 10), time.Now()) {
+		return
+	}
+	const busy = "Sorry, I'm busy right now. Please try again in a moment."
+	switch {
+	case update.CallbackQuery != nil:
+		go d.bot.tg.AnswerCallbackQuery(tgbotapi.NewCallback(update.CallbackQuery.ID, busy))
+	case msg != nil && msg.IsCommand():
+		go d.bot.tg.Send(tgbotapi.NewMessage(chatID, busy))
+	}
+}
+
+// Drain stops accepting updates and waits for the queued ones to be
+// processed.
+func (d *dispatcher) Drain() {
+	for _, q := range d.queues {
+		close(q)
+	}
+	d.wg.Wait()
+}
+
+// updateChatID returns the chat an update belongs to, or zero if it has
+// none.
+func updateChatID(update tgbotapi.Update) int64 {
+	switch {
+	case update.Message != nil && update.Message.Chat != nil:
+		return update.Message.Chat.ID
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+		return update.CallbackQuery.Message.Chat.ID
+	case update.CallbackQuery != nil:
+		return int64(update.CallbackQuery.From.ID)
+	}
+	return 0
+}
@@ -0,0 +1,37 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestDispatchDoesNotBlock(t *testing.T) {
+	// A dispatcher without workers, so its queue fills up.
+	d := &dispatcher{
+		bot:    &Bot{logger: hclog.NewNullLogger()},
+		queues: []chan tgbotapi.Update{make(chan tgbotapi.Update, 1)},
+		busy:   &cooldown{interval: busyReplyInterval},
+	}
+	update := func(id int) tgbotapi.Update {
+		return tgbotapi.Update{UpdateID: id, Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}, Text: "hello"}}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.Dispatch(update(1))
+		d.Dispatch(update(2))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Dispatch blocked on a full queue")
+	}
+
+	if got := (<-d.queues[0]).UpdateID; got != 1 {
+		t.Fatalf("got update %d queued, want the first", got)
+	}
+}
@@ -0,0 +1,77 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/ratelimit"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var (
+	// ErrChatBlocked is returned when the bot was blocked by the user or
+	// removed from the chat it is delivering to.
+	ErrChatBlocked = errors.New("the bot was blocked or removed from the chat")
+
+	// ErrChatNotFound is returned when the chat being delivered to no longer
+	// exists.
+	ErrChatNotFound = errors.New("the chat does not exist")
+)
+
+// MutedError is returned when a notification was dropped because its source
+// is muted in the chat.
+type MutedError struct {
+	Source string
+	Until  time.Time
+}
+
+func (e *MutedError) Error() string {
+	return fmt.Sprintf("notifications from %s are muted until %s", e.Source, e.Until.Format(time.RFC3339))
+}
+
+// RateLimitedError is returned when a notification was refused because its
+// source or chat sent too many.
+type RateLimitedError struct {
+	Source string
+
+	// Chat is set when the limit shared by every source of the chat was
+	// exceeded, rather than the limit of the source itself, and Quota when
+	// the daily quota was used up rather than the rate exceeded.
+	Chat  bool
+	Quota bool
+
+	Limit      ratelimit.Limit
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitedError) Error() string {
+	who := "this source"
+	if e.Chat {
+		who = "this chat"
+	}
+	if e.Quota {
+		return fmt.Sprintf("%s has used up its daily quota of %d notifications", who, e.Limit.Daily)
+	}
+	return fmt.Sprintf("%s may only send %s notifications, try again in %s", who, e.Limit.Rate,
+		e.RetryAfter.Round(time.Second))
+}
+
+// classifySendError maps the errors Telegram returns for undeliverable chats
+// to ErrChatBlocked and ErrChatNotFound.
+func classifySendError(err error) error {
+	tgErr, ok := err.(tgbotapi.Error)
+	if !ok {
+		return err
+	}
+
+	msg := strings.ToLower(tgErr.Message)
+	switch {
+	case strings.HasPrefix(msg, "forbidden:"):
+		return ErrChatBlocked
+	case strings.Contains(msg, "chat not found"):
+		return ErrChatNotFound
+	}
+	return err
+}
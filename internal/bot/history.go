@@ -0,0 +1,129 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/history"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// historyPageSize is how many notifications /history and /search show.
+const historyPageSize = 10
+
+// The formats history can be exported in.
+const (
+	ExportJSON = "json"
+	ExportCSV  = "csv"
+)
+
+// Messages returns the notifications recorded for chatID that match q,
+// newest first. q.Source may be anything /digest accepts; sources that no
+// longer exist are matched by their credential ID.
+func (b *Bot) Messages(chatID int64, q history.Query) []*history.Record {
+	chatID = b.chats.Resolve(chatID)
+	q.Chat = func(id int64) bool {
+		return b.chats.Resolve(id) == chatID
+	}
+	if q.Source != "" {
+		if source, _, err := b.resolveSource(chatID, q.Source); err == nil {
+			q.Source = source
+		}
+	}
+	return b.history.Find(q)
+}
+
+// ExportMessages writes records in the given format, json or csv.
+func ExportMessages(w io.Writer, format string, records []*history.Record) error {
+	switch format {
+	case ExportJSON:
+		return history.WriteJSON(w, records)
+	case ExportCSV:
+		return history.WriteCSV(w, records)
+	}
+	return fmt.Errorf("the export format must be %q or %q", ExportJSON, ExportCSV)
+}
+
+func formatHistory(header string, records []*history.Record, loc *time.Location) string {
+	var sb strings.Builder
+	sb.WriteString(header)
+	for _, r := range records {
+		fmt.Fprintf(&sb, "\n\n%s from %s (%s)\n%s", r.ReceivedAt.In(loc).Format("Mon Jan 2 15:04"),
+			r.SourceName, r.Status, preview(r.Text, maxDigestEntryLength))
+	}
+	return sb.String()
+}
+
+var historyCmd = &botCommand{
+	Alias:       "history",
+	Description: "Show the latest notifications, optionally from one source",
+	Args: []commandArg{
+		{Name: "source", Kind: argString, Optional: true},
+	},
+	Permission: permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		chatID := req.ChatID()
+		records := b.Messages(chatID, history.Query{Source: req.String("source"), Limit: historyPageSize})
+		if len(records) == 0 {
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, "No notifications have been recorded for this chat yet."))
+			return nil
+		}
+
+		loc := b.settings.Get(chatID).Location()
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, formatHistory("Latest notifications:", records, loc)))
+		return nil
+	},
+	Subcommands: []*botCommand{
+		{
+			Alias: "export",
+			Args: []commandArg{
+				{Name: "json|csv", Kind: argString},
+				{Name: "source", Kind: argString, Optional: true},
+			},
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				chatID := req.ChatID()
+				format := strings.ToLower(req.String("json|csv"))
+				records := b.Messages(chatID, history.Query{Source: req.String("source")})
+
+				var buf bytes.Buffer
+				err := ExportMessages(&buf, format, records)
+				if err != nil {
+					b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("Sorry, %v.", err)))
+					return nil
+				}
+
+				name := fmt.Sprintf("history-%s.%s", time.Now().Format("2006-01-02"), format)
+				doc := tgbotapi.NewDocumentUpload(chatID, tgbotapi.FileBytes{Name: name, Bytes: buf.Bytes()})
+				doc.Caption = fmt.Sprintf("%d notifications", len(records))
+				_, err = b.tg.SendContext(ctx, doc)
+				return err
+			},
+		},
+	},
+}
+
+var searchCmd = &botCommand{
+	Alias:       "search",
+	Description: "Search the notifications of this chat",
+	Args: []commandArg{
+		{Name: "words", Kind: argRest},
+	},
+	Permission: permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		chatID := req.ChatID()
+		text := req.Rest("words")
+		records := b.Messages(chatID, history.Query{Text: text, Limit: historyPageSize})
+		if len(records) == 0 {
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("No notifications contain %q.", text)))
+			return nil
+		}
+
+		loc := b.settings.Get(chatID).Location()
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, formatHistory(fmt.Sprintf("Latest notifications containing %q:", text), records, loc)))
+		return nil
+	},
+}
@@ -0,0 +1,22 @@
+package bot
+
+// translations maps the English strings of the summaries the bot writes
+// around notifications, digests and held notifications, to their
+// translation in each supported language other than English. Nothing else
+// is translated.
+var translations = map[string]map[string]string{
+	"de": {
+		"unknown":                            "unbekannt",
+		"%d notifications since %s:":         "%d Benachrichtigungen seit %s:",
+		"(%d older notifications not shown)": "(%d ältere Benachrichtigungen nicht angezeigt)",
+		"%d notifications arrived while you weren't to be disturbed:": "%d Benachrichtigungen kamen an, während Sie nicht gestört werden wollten:",
+	},
+}
+
+// translate returns s in lang, or s itself if there is no translation.
+func translate(lang, s string) string {
+	if t, ok := translations[lang][s]; ok {
+		return t
+	}
+	return s
+}
@@ -0,0 +1,182 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/scheduler"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// snoozeDelay is how long the snooze button delays a notification.
+const snoozeDelay = time.Hour
+
+// jobSentNotification jobs keep a notification that was sent with buttons so
+// that it can be snoozed. They do nothing when they run, which deletes them
+// once sentNotificationTTL has passed.
+const jobSentNotification = "notification.sent"
+
+// sentNotificationTTL is how long a notification can be snoozed for after it
+// was sent.
+const sentNotificationTTL = 24 * time.Hour
+
+// muteDurations are how long the mute buttons of a notification mute its
+// source for.
+var muteDurations = map[string]time.Duration{
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+}
+
+// MutedUntil reports whether notifications from source are muted at now, and
+// until when.
+func (s *chatSettings) MutedUntil(source string, now time.Time) (time.Time, bool) {
+	until, ok := s.Mutes[source]
+	if !ok || !until.After(now) {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// mute drops notifications from source in chatID until the given time. A
+// zero time unmutes it.
+func (b *Bot) mute(chatID int64, source string, until time.Time) error {
+	now := time.Now()
+	_, err := b.settings.Update(chatID, func(cs *chatSettings) {
+		for s, u := range cs.Mutes {
+			if !u.After(now) {
+				delete(cs.Mutes, s)
+			}
+		}
+		if until.IsZero() {
+			delete(cs.Mutes, source)
+			return
+		}
+		if cs.Mutes == nil {
+			cs.Mutes = make(map[string]time.Time)
+		}
+		cs.Mutes[source] = until
+	})
+	return err
+}
+
+// notificationButtons are attached to notifications sent with buttons
+// enabled. sentID is the jobSentNotification job that keeps the
+// notification for the snooze button, which is left out if it is empty.
+// Sources too long to fit in callback data get no mute buttons.
+func notificationButtons(source, sentID string) interface{} {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	if len("notify:mute:1d:"+source) <= 64 {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Mute source 1h", "notify:mute:1h:"+source),
+			tgbotapi.NewInlineKeyboardButtonData("Mute source 1d", "notify:mute:1d:"+source),
+		))
+	}
+	if sentID != "" {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Snooze 1h", "notify:snooze:"+sentID),
+		))
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// sentNotification returns the job keeping a notification sent to chatID
+// for its snooze button, or nil if it expired.
+func (b *Bot) sentNotification(chatID int64, id string) *scheduler.Job {
+	job := b.jobs.Get(id)
+	if job == nil || job.Kind != jobSentNotification || b.chats.Resolve(job.ChatID) != b.chats.Resolve(chatID) {
+		return nil
+	}
+	return job
+}
+
+// sourceName describes source to the users of chatID.
+func (b *Bot) sourceName(chatID int64, source string) string {
+	_, name, err := b.resolveSource(chatID, source)
+	if err != nil {
+		return source
+	}
+	return name
+}
+
+var notifyCallback = &botCallback{
+	Prefix: "notify",
+	RunFunc: func(ctx context.Context, b *Bot, query *tgbotapi.CallbackQuery, args []string) error {
+		if query.Message == nil || len(args) < 2 {
+			return fmt.Errorf("malformed notify callback: %v", args)
+		}
+		chatID := query.Message.Chat.ID
+		if !b.access.Allowed(int64(query.From.ID), chatID) {
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "You are not allowed to manage notifications here."))
+			return nil
+		}
+
+		msgID := query.Message.MessageID
+		switch args[0] {
+		case "mute":
+			d, ok := muteDurations[args[1]]
+			if !ok || len(args) < 3 {
+				return fmt.Errorf("malformed notify callback: %v", args)
+			}
+			source := strings.Join(args[2:], ":")
+			until := time.Now().Add(d)
+			err := b.mute(chatID, source, until)
+			if err != nil {
+				return err
+			}
+
+			loc := b.settings.Get(chatID).Location()
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID,
+				fmt.Sprintf("Muted %s until %s", b.sourceName(chatID, source), until.In(loc).Format("Mon 15:04"))))
+			b.tg.SendContext(ctx, tgbotapi.NewEditMessageReplyMarkup(chatID, msgID, tgbotapi.NewInlineKeyboardMarkup(
+				tgbotapi.NewInlineKeyboardRow(
+					tgbotapi.NewInlineKeyboardButtonData("Unmute source", "notify:unmute:"+source)))))
+			return nil
+
+		case "unmute":
+			source := strings.Join(args[1:], ":")
+			err := b.mute(chatID, source, time.Time{})
+			if err != nil {
+				return err
+			}
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "Unmuted "+b.sourceName(chatID, source)))
+			// The snooze button can't be restored as the message doesn't
+			// say which notification it was.
+			if markup, ok := notificationButtons(source, "").(tgbotapi.InlineKeyboardMarkup); ok {
+				b.tg.SendContext(ctx, tgbotapi.NewEditMessageReplyMarkup(chatID, msgID, markup))
+			}
+			return nil
+
+		case "snooze":
+			job := b.sentNotification(chatID, args[1])
+			if job == nil {
+				b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "This notification can no longer be snoozed."))
+				return nil
+			}
+			var n Notification
+			err := job.Decode(&n)
+			if err != nil {
+				return err
+			}
+			_, err = b.Schedule(&n, time.Now().Add(snoozeDelay))
+			if err != nil {
+				return err
+			}
+			// Snoozing it again is done from the notification when it is
+			// sent again.
+			if _, err := b.jobs.Cancel(job.ID); err != nil {
+				b.logger.Error("failed to forget snoozed notification", "job_id", job.ID, "error", err)
+			}
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "Snoozed for an hour"))
+			b.tg.SendContext(ctx, tgbotapi.NewEditMessageReplyMarkup(chatID, msgID, tgbotapi.InlineKeyboardMarkup{
+				InlineKeyboard: [][]tgbotapi.InlineKeyboardButton{},
+			}))
+			return nil
+		}
+		return fmt.Errorf("malformed notify callback: %v", args)
+	},
+}
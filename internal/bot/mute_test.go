@@ -0,0 +1,92 @@
+package bot
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/endocrimes/endobot/internal/scheduler"
+)
+
+// buttonData returns the callback data of the buttons in the reply_markup
+// parameter of a message.
+func buttonData(t *testing.T, markup string) []string {
+	var keyboard struct {
+		InlineKeyboard [][]struct {
+			CallbackData string `json:"callback_data"`
+		} `json:"inline_keyboard"`
+	}
+	if err := json.Unmarshal([]byte(markup), &keyboard); err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, row := range keyboard.InlineKeyboard {
+		for _, button := range row {
+			out = append(out, button.CallbackData)
+		}
+	}
+	return out
+}
+
+func TestSnoozeRedeliversTheNotification(t *testing.T) {
+	b, fake := newTestBot(t, openTestStore(t), &Config{AllowedUsers: []int64{testAllowed}})
+	silent := true
+	n := &Notification{
+		ChatID:     testAllowed,
+		Text:       "*backup* failed",
+		Silent:     &silent,
+		Source:     "token:a",
+		SourceName: "token a",
+		Buttons:    true,
+		Format:     formatMarkdown,
+	}
+	if err := b.Notify(n); err != nil {
+		t.Fatal(err)
+	}
+
+	first := fake.Calls("sendMessage")[0]
+	var snooze string
+	for _, data := range buttonData(t, first.Get("reply_markup")) {
+		if strings.HasPrefix(data, "notify:snooze:") {
+			snooze = data
+		}
+	}
+	if snooze == "" {
+		t.Fatalf("the notification has no snooze button: %v", first)
+	}
+
+	b.handleUpdate(callbackUpdate(testAllowed, testAllowed, snooze))
+	jobs := b.jobs.List(func(job *scheduler.Job) bool { return job.Kind == jobNotification })
+	if len(jobs) != 1 {
+		t.Fatalf("got %d scheduled notifications, want the snoozed one", len(jobs))
+	}
+	var snoozed Notification
+	if err := jobs[0].Decode(&snoozed); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&snoozed, n) {
+		t.Fatalf("snoozed %+v, want the original %+v", snoozed, n)
+	}
+
+	// It can only be snoozed once.
+	b.handleUpdate(callbackUpdate(testAllowed, testAllowed, snooze))
+	if got := fake.Calls("answerCallbackQuery"); !strings.Contains(got[len(got)-1].Get("text"), "no longer be snoozed") {
+		t.Fatalf("a second snooze was answered with %v", got[len(got)-1])
+	}
+
+	fake.Reset()
+	b.runJob(jobs[0], false)
+	again := fake.Calls("sendMessage")
+	if len(again) != 1 {
+		t.Fatalf("got %d messages, want the notification sent again", len(again))
+	}
+	for _, param := range []string{"text", "parse_mode", "disable_notification"} {
+		if again[0].Get(param) != first.Get(param) {
+			t.Errorf("sent %s %q again, want %q", param, again[0].Get(param), first.Get(param))
+		}
+	}
+	if buttons := buttonData(t, again[0].Get("reply_markup")); len(buttons) != 3 || buttons[2] == snooze {
+		t.Errorf("got buttons %v, want new ones", buttons)
+	}
+}
@@ -0,0 +1,191 @@
+package bot
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+)
+
+type queuedNotification struct {
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+
+	// Source is the name of the credential that sent the notification.
+	Source string `json:"source,omitempty"`
+}
+
+// queueKey identifies a group of pending notifications. Source is empty when
+// notifications from every source of the chat are grouped together.
+type queueKey struct {
+	ChatID int64
+	Source string
+}
+
+func (k queueKey) String() string {
+	if k.Source == "" {
+		return strconv.FormatInt(k.ChatID, 10)
+	}
+	return fmt.Sprintf("%d/%s", k.ChatID, k.Source)
+}
+
+type pendingNotifications struct {
+	ChatID  int64                `json:"chat_id"`
+	Source  string               `json:"source,omitempty"`
+	Started time.Time            `json:"started"`
+	Entries []queuedNotification `json:"entries"`
+}
+
+// notificationQueue holds notifications waiting to be sent together, such
+// as digests. It is persisted so notifications aren't lost if the bot
+// restarts.
+type notificationQueue struct {
+	store    *store.Store
+	document string
+
+	mu      sync.Mutex
+	pending map[string]*pendingNotifications
+
+	// sending is held while pending notifications are sent, so the same
+	// notifications aren't sent twice.
+	sending sync.Mutex
+}
+
+func newNotificationQueue(st *store.Store, document string) (*notificationQueue, error) {
+	q := &notificationQueue{
+		store:    st,
+		document: document,
+		pending:  make(map[string]*pendingNotifications),
+	}
+
+	err := st.Load(document, &q.pending)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", document, err)
+	}
+	for key, p := range q.pending {
+		// Queues saved before they were grouped by source are keyed by
+		// chat ID only.
+		if p.ChatID == 0 {
+			p.ChatID, _ = strconv.ParseInt(key, 10, 64)
+		}
+	}
+
+	return q, nil
+}
+
+// Add queues a notification and returns how many are now pending for key.
+func (q *notificationQueue) Add(key queueKey, entry queuedNotification) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p, ok := q.pending[key.String()]
+	if !ok {
+		p = &pendingNotifications{ChatID: key.ChatID, Source: key.Source, Started: entry.Time}
+		q.pending[key.String()] = p
+	}
+	p.Entries = append(p.Entries, entry)
+
+	return len(p.Entries), q.store.Save(q.document, q.pending)
+}
+
+// Started returns when the notifications pending for each key began
+// collecting.
+func (q *notificationQueue) Started() map[queueKey]time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	out := make(map[queueKey]time.Time, len(q.pending))
+	for _, p := range q.pending {
+		out[queueKey{p.ChatID, p.Source}] = p.Started
+	}
+	return out
+}
+
+// Entries returns the notifications pending for key, oldest first.
+func (q *notificationQueue) Entries(key queueKey) []queuedNotification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p, ok := q.pending[key.String()]
+	if !ok {
+		return nil
+	}
+	return append([]queuedNotification(nil), p.Entries...)
+}
+
+// Remove drops the first n notifications pending for key once they were
+// sent. Notifications queued in the meantime are kept.
+func (q *notificationQueue) Remove(key queueKey, n int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p, ok := q.pending[key.String()]
+	if !ok {
+		return nil
+	}
+	if n >= len(p.Entries) {
+		delete(q.pending, key.String())
+	} else {
+		p.Entries = p.Entries[n:]
+		p.Started = p.Entries[0].Time
+	}
+
+	return q.store.Save(q.document, q.pending)
+}
+
+// RemoveChat drops every notification pending for chatID, returning how
+// many there were.
+func (q *notificationQueue) RemoveChat(chatID int64) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	for key, p := range q.pending {
+		if p.ChatID == chatID {
+			n += len(p.Entries)
+			delete(q.pending, key)
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, q.store.Save(q.document, q.pending)
+}
+
+// Migrate moves the notifications pending for the chat from to its new ID
+// to, merging them with any queued under the new ID.
+func (q *notificationQueue) Migrate(from, to int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	moved := false
+	for key, p := range q.pending {
+		if p.ChatID != from {
+			continue
+		}
+		delete(q.pending, key)
+		moved = true
+
+		newKey := queueKey{to, p.Source}.String()
+		existing, ok := q.pending[newKey]
+		if !ok {
+			p.ChatID = to
+			q.pending[newKey] = p
+			continue
+		}
+		existing.Entries = append(p.Entries, existing.Entries...)
+		sort.SliceStable(existing.Entries, func(i, j int) bool {
+			return existing.Entries[i].Time.Before(existing.Entries[j].Time)
+		})
+		if p.Started.Before(existing.Started) {
+			existing.Started = p.Started
+		}
+	}
+	if !moved {
+		return nil
+	}
+	return q.store.Save(q.document, q.pending)
+}
@@ -0,0 +1,261 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const heldDocument = "held"
+
+const (
+	// quietSilent delivers notifications without sound during quiet hours.
+	quietSilent = "silent"
+
+	// quietHold keeps notifications until quiet hours end and then sends
+	// them together.
+	quietHold = "hold"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// quietWindow is a range of the day, in minutes since midnight, on some days
+// of the week. Windows that end before they start run past midnight into
+// the next day.
+type quietWindow struct {
+	Days  [7]bool
+	Start int
+	End   int
+}
+
+// contains reports whether the local time t falls within the window.
+func (w quietWindow) contains(t time.Time) bool {
+	now := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.Start < w.End {
+		return w.Days[day] && now >= w.Start && now < w.End
+	}
+	yesterday := (day + 6) % 7
+	return (w.Days[day] && now >= w.Start) || (w.Days[yesterday] && now < w.End)
+}
+
+// parseQuietHours parses windows separated by semicolons, each a time range
+// optionally preceded by the days it applies to, e.g.
+// "mon-fri 22:00-07:00; sat,sun 23:00-09:00". Days can be listed, given as
+// ranges or as daily, weekdays or weekends.
+func parseQuietHours(s string) ([]quietWindow, error) {
+	var windows []quietWindow
+	for _, entry := range strings.Split(s, ";") {
+		fields := strings.Fields(entry)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 2 {
+			return nil, fmt.Errorf("%q should be days followed by a range like 22:00-07:00", strings.TrimSpace(entry))
+		}
+
+		var w quietWindow
+		var err error
+		w.Days, err = parseDays("daily")
+		if len(fields) == 2 {
+			w.Days, err = parseDays(fields[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+		w.Start, w.End, err = parseClockRange(fields[len(fields)-1])
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("expected a range like 22:00-07:00")
+	}
+	return windows, nil
+}
+
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	switch strings.ToLower(s) {
+	case "daily":
+		return [7]bool{true, true, true, true, true, true, true}, nil
+	case "weekdays":
+		return [7]bool{false, true, true, true, true, true, false}, nil
+	case "weekends":
+		return [7]bool{true, false, false, false, false, false, true}, nil
+	}
+
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return days, fmt.Errorf("%q is not a day of the week", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, ok = weekdays[bounds[1]]
+			if !ok {
+				return days, fmt.Errorf("%q is not a day of the week", bounds[1])
+			}
+		}
+		// Ranges may wrap around the end of the week, e.g. fri-mon.
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClockRange parses "HH:MM-HH:MM" into minutes since midnight.
+func parseClockRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("expected a range like 22:00-07:00")
+	}
+	start, err := parseClock(parts[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(parts[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	return start, end, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time like 07:30", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// InQuietHours reports whether t falls within the chat's quiet hours.
+func (s *chatSettings) InQuietHours(t time.Time) bool {
+	windows, err := parseQuietHours(s.QuietHours)
+	if err != nil {
+		return false
+	}
+
+	local := t.In(s.Location())
+	for _, w := range windows {
+		if w.contains(local) {
+			return true
+		}
+	}
+	return false
+}
+
+// Quiet reports whether the chat asked not to be disturbed at t, either
+// through quiet hours or /dnd.
+func (s *chatSettings) Quiet(t time.Time) bool {
+	return t.Before(s.DNDUntil) || s.InQuietHours(t)
+}
+
+// Holds reports whether notifications are held, rather than delivered
+// silently, while the chat is quiet at t.
+func (s *chatSettings) Holds(t time.Time) bool {
+	return s.QuietMode == quietHold && s.Quiet(t)
+}
+
+// releaseHeld sends the notifications held for chats that are no longer
+// quiet.
+func (b *Bot) releaseHeld(now time.Time) {
+	b.held.sending.Lock()
+	defer b.held.sending.Unlock()
+
+	for key := range b.held.Started() {
+		chatID := key.ChatID
+		settings := b.settings.Get(chatID)
+		if settings.Quiet(now) {
+			continue
+		}
+
+		entries := b.held.Entries(key)
+		if len(entries) == 0 {
+			continue
+		}
+
+		header := fmt.Sprintf(translate(settings.Language, "%d notifications arrived while you weren't to be disturbed:"), len(entries))
+		err := b.deliver(laneBulk, b.chats.Resolve(chatID), formatSummary(settings, header, entries), formatPlain, settings.Silent, nil)
+		if err != nil && err != ErrChatBlocked && err != ErrChatNotFound {
+			// Try again on the next tick.
+			b.logger.Error("failed to release held notifications", "chat_id", chatID, "error", err)
+			continue
+		}
+		if err != nil {
+			b.logger.Info("dropping held notifications for unreachable chat", "chat_id", chatID, "count", len(entries))
+		}
+
+		err = b.held.Remove(key, len(entries))
+		if err != nil {
+			b.logger.Error("failed to update held notifications", "chat_id", chatID, "error", err)
+		}
+	}
+}
+
+var dndCmd = &botCommand{
+	Alias:       "dnd",
+	Description: "Don't disturb this chat for a while",
+	Args: []commandArg{
+		{Name: "duration|off", Kind: argString, Optional: true},
+	},
+	Permission: permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		chatID := req.ChatID()
+		if !req.Has("duration|off") {
+			settings := b.settings.Get(chatID)
+			reply := "Do not disturb is off. Send /dnd 2h to turn it on."
+			if until := settings.DNDUntil; time.Now().Before(until) {
+				reply = fmt.Sprintf("Do not disturb is on until %s. Send /dnd off to end it.",
+					until.In(settings.Location()).Format("Jan 2 15:04 MST"))
+			}
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, reply))
+			return nil
+		}
+
+		arg := req.String("duration|off")
+		var until time.Time
+		if !strings.EqualFold(arg, "off") {
+			d, err := time.ParseDuration(arg)
+			if err != nil || d <= 0 {
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, "Sorry, the duration must be like 30m or 2h."))
+				return nil
+			}
+			until = time.Now().Add(d)
+		}
+
+		settings, err := b.settings.Update(chatID, func(cs *chatSettings) { cs.DNDUntil = until })
+		if err != nil {
+			return err
+		}
+
+		reply := "Do not disturb is off."
+		if !until.IsZero() {
+			what := "delivered silently"
+			if settings.QuietMode == quietHold {
+				what = "held until then"
+			}
+			reply = fmt.Sprintf("Do not disturb until %s. Notifications will be %s unless they are high priority.",
+				until.In(settings.Location()).Format("Jan 2 15:04 MST"), what)
+		}
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, reply))
+		return nil
+	},
+}
@@ -0,0 +1,83 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseQuietHours(t *testing.T) {
+	weekdaysOnly := [7]bool{false, true, true, true, true, true, false}
+	weekend := [7]bool{true, false, false, false, false, false, true}
+	everyDay := [7]bool{true, true, true, true, true, true, true}
+
+	cases := []struct {
+		in      string
+		want    []quietWindow
+		wantErr bool
+	}{
+		{in: "22:00-07:00", want: []quietWindow{{everyDay, 22 * 60, 7 * 60}}},
+		{
+			in: "mon-fri 22:00-07:00; sat,sun 23:30-09:00",
+			want: []quietWindow{
+				{weekdaysOnly, 22 * 60, 7 * 60},
+				{weekend, 23*60 + 30, 9 * 60},
+			},
+		},
+		// Day ranges wrap around the end of the week.
+		{in: "Sat-Sun 12:00-14:00;", want: []quietWindow{{weekend, 12 * 60, 14 * 60}}},
+		{in: "weekends 12:00-14:00", want: []quietWindow{{weekend, 12 * 60, 14 * 60}}},
+		{in: "", wantErr: true},
+		{in: "22:00", wantErr: true},
+		{in: "22:00-25:00", wantErr: true},
+		{in: "someday 22:00-07:00", wantErr: true},
+		{in: "mon 22:00 - 07:00", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := parseQuietHours(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.in, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%q: window %d is %v, want %v", tc.in, i, got[i], tc.want[i])
+			}
+		}
+	}
+}
+
+func TestInQuietHours(t *testing.T) {
+	settings := &chatSettings{QuietHours: "mon-fri 22:00-07:00", Timezone: "UTC"}
+
+	cases := []struct {
+		at   time.Time
+		want bool
+	}{
+		// Monday evening.
+		{time.Date(2026, 10, 19, 22, 30, 0, 0, time.UTC), true},
+		{time.Date(2026, 10, 19, 21, 59, 0, 0, time.UTC), false},
+		// Tuesday morning, still in Monday's window.
+		{time.Date(2026, 10, 20, 6, 59, 0, 0, time.UTC), true},
+		{time.Date(2026, 10, 20, 7, 0, 0, 0, time.UTC), false},
+		// Saturday morning is the end of Friday's window, Sunday's isn't.
+		{time.Date(2026, 10, 24, 6, 0, 0, 0, time.UTC), true},
+		{time.Date(2026, 10, 25, 6, 0, 0, 0, time.UTC), false},
+		// Monday morning follows a Sunday without quiet hours.
+		{time.Date(2026, 10, 19, 6, 0, 0, 0, time.UTC), false},
+	}
+	for _, tc := range cases {
+		if got := settings.InQuietHours(tc.at); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.at.Format("Mon 15:04"), got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/audit"
+	"github.com/endocrimes/endobot/internal/ratelimit"
+	"github.com/endocrimes/endobot/internal/store"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const limitsDocument = "limits"
+
+// throttleWarningInterval is how often a chat is warned about the same
+// source being throttled.
+const throttleWarningInterval = time.Hour
+
+// limiterMaxIdle is how long unused rate limit state is kept, the longest
+// period a rate can have.
+const limiterMaxIdle = 24 * time.Hour
+
+// limitStore holds the limits owners set for individual sources and chats,
+// keyed by the ID of the credential or chatLimitKey.
+type limitStore struct {
+	store *store.Store
+
+	mu     sync.Mutex
+	limits map[string]*ratelimit.Limit
+}
+
+func newLimitStore(st *store.Store) (*limitStore, error) {
+	s := &limitStore{
+		store:  st,
+		limits: make(map[string]*ratelimit.Limit),
+	}
+
+	err := st.Load(limitsDocument, &s.limits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load limits: %v", err)
+	}
+	return s, nil
+}
+
+// Get returns the limit set for key, or def if there is none.
+func (s *limitStore) Get(key string, def ratelimit.Limit) ratelimit.Limit {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l, ok := s.limits[key]; ok {
+		return *l
+	}
+	return def
+}
+
+// Set replaces the limit of key. A nil limit restores the default.
+func (s *limitStore) Set(key string, l *ratelimit.Limit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l == nil {
+		delete(s.limits, key)
+	} else {
+		cp := *l
+		s.limits[key] = &cp
+	}
+	return s.store.Save(limitsDocument, s.limits)
+}
+
+// List returns the keys that have a limit set, sorted.
+func (s *limitStore) List() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]string, 0, len(s.limits))
+	for key := range s.limits {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// MigrateChat moves the limit set for the chat from to its new ID to, unless
+// the new chat already has one.
+func (s *limitStore) MigrateChat(from, to int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.limits[chatLimitKey(from)]
+	if !ok {
+		return nil
+	}
+	if _, ok := s.limits[chatLimitKey(to)]; !ok {
+		s.limits[chatLimitKey(to)] = l
+	}
+	delete(s.limits, chatLimitKey(from))
+	return s.store.Save(limitsDocument, s.limits)
+}
+
+func chatLimitKey(chatID int64) string {
+	return "chat:" + strconv.FormatInt(chatID, 10)
+}
+
+// cooldown lets something happen at most once per interval for each key.
+type cooldown struct {
+	interval time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// Ready reports whether key may happen at now, recording it if so.
+func (c *cooldown) Ready(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if last, ok := c.last[key]; ok && now.Sub(last) < c.interval {
+		return false
+	}
+	if c.last == nil {
+		c.last = make(map[string]time.Time)
+	}
+	c.last[key] = now
+	return true
+}
+
+// parseLimit builds a limit from a rate such as "30/m" and a daily quota,
+// both of which may be empty or zero for no limit.
+func parseLimit(rate string, daily int) (ratelimit.Limit, error) {
+	r, err := ratelimit.ParseRate(rate)
+	if err != nil {
+		return ratelimit.Limit{}, err
+	}
+	if daily < 0 {
+		return ratelimit.Limit{}, fmt.Errorf("the daily quota must not be negative")
+	}
+	return ratelimit.Limit{Rate: r, Daily: daily}, nil
+}
+
+// CheckRateLimit counts a notification from source to chatID against the
+// limits of both, returning a *RateLimitedError if either is exceeded. The
+// chat is warned when a source starts being throttled.
+func (b *Bot) CheckRateLimit(source string, chatID int64) error {
+	now := time.Now()
+	chatID = b.chats.Resolve(chatID)
+	chatKey := chatLimitKey(chatID)
+
+	exceeded := b.limiter.Allow(now,
+		ratelimit.Check{Key: source, Limit: b.limits.Get(source, b.sourceLimit)},
+		ratelimit.Check{Key: chatKey, Limit: b.limits.Get(chatKey, b.chatLimit)},
+	)
+	if exceeded == nil {
+		return nil
+	}
+
+	err := &RateLimitedError{
+		Source:     source,
+		Chat:       exceeded.Key == chatKey,
+		Quota:      exceeded.Quota,
+		Limit:      exceeded.Limit,
+		RetryAfter: exceeded.RetryAfter,
+	}
+	if b.throttled.Ready(source, now) {
+		b.warnThrottled(chatID, err)
+	}
+	return err
+}
+
+// warnThrottled tells the chat a source is being throttled, offering to
+// revoke it if it is a token, and records it in the audit log.
+func (b *Bot) warnThrottled(chatID int64, e *RateLimitedError) {
+	name := b.sourceName(chatID, e.Source)
+	b.logger.Info("throttling notifications", "chat_id", chatID, "source", e.Source, "chat_limit", e.Chat, "quota", e.Quota)
+	b.RecordAudit(&audit.Entry{
+		Action: audit.ActionThrottled,
+		Actor:  e.Source,
+		ChatID: chatID,
+		Details: map[string]interface{}{
+			"chat_limit": e.Chat,
+			"quota":      e.Quota,
+			"limit":      e.Limit.String(),
+		},
+	})
+
+	var text string
+	switch {
+	case e.Chat && e.Quota:
+		text = fmt.Sprintf("This chat has used up its daily quota of %d notifications. Notifications from %s and every "+
+			"other source are rejected until midnight UTC.", e.Limit.Daily, name)
+	case e.Chat:
+		text = fmt.Sprintf("This chat is receiving more than %s notifications. Notifications from %s and every other "+
+			"source are rejected until they slow down.", e.Limit.Rate, name)
+	case e.Quota:
+		text = fmt.Sprintf("%s has used up its daily quota of %d notifications. Its notifications are rejected until "+
+			"midnight UTC.", capitalize(name), e.Limit.Daily)
+	default:
+		text = fmt.Sprintf("%s is sending more than %s notifications. Its notifications are rejected until it slows down.",
+			capitalize(name), e.Limit.Rate)
+	}
+
+	msg := tgbotapi.NewMessage(chatID, text)
+	if id := strings.TrimPrefix(e.Source, "token:"); id != e.Source {
+		msg.Text += " If this isn't expected, revoke the token."
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Revoke this token", "token:revoke:"+id),
+		))
+	}
+	if _, err := b.tg.SendIn(laneUrgent, msg); err != nil {
+		b.logger.Error("failed to send throttling warning", "chat_id", chatID, "error", err)
+	}
+}
+
+func capitalize(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// limitTarget turns the first argument of /limit into the key its limit is
+// stored under and a description: a chat ID, a source of this chat as
+// /digest accepts it, or a credential ID such as webhook:<id>. Anything else
+// is taken to be a token ID.
+func (b *Bot) limitTarget(chatID int64, s string) (key, name string, targetChat int64) {
+	if id, err := strconv.ParseInt(s, 10, 64); err == nil {
+		id = b.chats.Resolve(id)
+		return chatLimitKey(id), fmt.Sprintf("chat %d", id), id
+	}
+	if source, name, err := b.resolveSource(chatID, s); err == nil && source != "" {
+		return source, name, 0
+	}
+	if strings.Contains(s, ":") {
+		return s, s, 0
+	}
+	return "token:" + s, "token " + s, 0
+}
+
+// limitDefault returns the limit key has when no limit is set for it.
+func (b *Bot) limitDefault(key string) ratelimit.Limit {
+	if strings.HasPrefix(key, "chat:") {
+		return b.chatLimit
+	}
+	return b.sourceLimit
+}
+
+var limitCmd = &botCommand{
+	Alias:       "limit",
+	Description: "Show or change the rate limits of sources and chats",
+	Args: []commandArg{
+		{Name: "chat id|source", Kind: argString, Optional: true},
+		{Name: "rate|off|default", Kind: argString, Optional: true},
+		{Name: "daily quota", Kind: argInt, Optional: true},
+	},
+	Permission: permOwner,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		chatID := req.ChatID()
+		if !req.Has("chat id|source") {
+			lines := []string{
+				fmt.Sprintf("Each source may send %s notifications and each chat %s.", b.sourceLimit, b.chatLimit),
+			}
+			for _, key := range b.limits.List() {
+				lines = append(lines, fmt.Sprintf("%s: %s", key, b.limits.Get(key, b.limitDefault(key))))
+			}
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, strings.Join(lines, "\n")))
+			return nil
+		}
+
+		key, name, targetChat := b.limitTarget(chatID, req.String("chat id|source"))
+		if !req.Has("rate|off|default") {
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("The limit of %s is %s.", name,
+				b.limits.Get(key, b.limitDefault(key)))))
+			return nil
+		}
+
+		var limit *ratelimit.Limit
+		if rate := req.String("rate|off|default"); rate != "default" {
+			l, err := parseLimit(rate, int(req.Int("daily quota")))
+			if err != nil {
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("Sorry, %v. Usage: %s", err,
+					b.commands[req.Path[0]].usage(req.Path))))
+				return nil
+			}
+			limit = &l
+		}
+		err := b.limits.Set(key, limit)
+		if err != nil {
+			return err
+		}
+
+		current := b.limits.Get(key, b.limitDefault(key))
+		b.RecordAudit(&audit.Entry{
+			Action:  audit.ActionLimitChanged,
+			Actor:   userActor(req.UserID()),
+			ChatID:  targetChat,
+			Details: map[string]interface{}{"target": key, "limit": current.String(), "default": limit == nil},
+		})
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("The limit of %s is now %s.", name, current)))
+		return nil
+	},
+}
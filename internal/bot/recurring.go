@@ -0,0 +1,308 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/scheduler"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// jobRecurring jobs deliver a Notification whenever a cron expression
+// matches.
+const jobRecurring = "recurring"
+
+// DefaultPreviewRuns is how many upcoming runs are shown for a recurring
+// notification.
+const DefaultPreviewRuns = 5
+
+// RecurringNotification is a notification sent whenever a cron expression
+// matches.
+type RecurringNotification struct {
+	ID        string
+	Cron      string
+	Timezone  string
+	Paused    bool
+	NextRun   time.Time
+	CreatedAt time.Time
+	CreatedBy string
+
+	Notification *Notification
+}
+
+func recurringNotification(job *scheduler.Job) (*RecurringNotification, error) {
+	var n Notification
+	err := job.Decode(&n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode recurring notification %s: %v", job.ID, err)
+	}
+	return &RecurringNotification{
+		ID:           job.ID,
+		Cron:         job.Cron,
+		Timezone:     job.Timezone,
+		Paused:       job.Paused,
+		NextRun:      job.RunAt,
+		CreatedAt:    job.CreatedAt,
+		CreatedBy:    job.CreatedBy,
+		Notification: &n,
+	}, nil
+}
+
+// Timezone returns the timezone configured for chatID in /settings.
+func (b *Bot) Timezone(chatID int64) string {
+	return b.settings.Get(b.chats.Resolve(chatID)).Timezone
+}
+
+// PreviewCron returns the next n times the cron expression spec matches in
+// timezone.
+func (b *Bot) PreviewCron(spec, timezone string, n int) ([]time.Time, error) {
+	return scheduler.NextRuns(spec, timezone, time.Now(), n)
+}
+
+// AddRecurring sends n whenever the cron expression spec matches in
+// timezone.
+func (b *Bot) AddRecurring(n *Notification, spec, timezone string) (*RecurringNotification, error) {
+	job, err := b.jobs.AddRecurring(jobRecurring, n.ChatID, spec, timezone, n.SourceName, n)
+	if err != nil {
+		return nil, err
+	}
+	return recurringNotification(job)
+}
+
+// Recurring returns the recurring notifications of chatID, soonest first.
+func (b *Bot) Recurring(chatID int64) []*RecurringNotification {
+	chatID = b.chats.Resolve(chatID)
+	jobs := b.jobs.List(func(job *scheduler.Job) bool {
+		return job.Kind == jobRecurring && b.chats.Resolve(job.ChatID) == chatID
+	})
+
+	var out []*RecurringNotification
+	for _, job := range jobs {
+		rn, err := recurringNotification(job)
+		if err != nil {
+			b.logger.Error("skipping recurring notification", "error", err)
+			continue
+		}
+		out = append(out, rn)
+	}
+	return out
+}
+
+func (b *Bot) recurringJob(chatID int64, id string) *scheduler.Job {
+	job := b.jobs.Get(id)
+	if job == nil || job.Kind != jobRecurring || b.chats.Resolve(job.ChatID) != b.chats.Resolve(chatID) {
+		return nil
+	}
+	return job
+}
+
+// SetRecurringPaused pauses or resumes a recurring notification of chatID,
+// reporting whether there was one.
+func (b *Bot) SetRecurringPaused(chatID int64, id string, paused bool) (bool, error) {
+	if b.recurringJob(chatID, id) == nil {
+		return false, nil
+	}
+	return b.jobs.SetPaused(id, paused)
+}
+
+// DeleteRecurring deletes a recurring notification of chatID, reporting
+// whether there was one.
+func (b *Bot) DeleteRecurring(chatID int64, id string) (bool, error) {
+	if b.recurringJob(chatID, id) == nil {
+		return false, nil
+	}
+	return b.jobs.Cancel(id)
+}
+
+// splitCron separates a cron expression, five fields or a macro such as
+// @daily, from the fields that follow it.
+func splitCron(fields []string) (string, []string, error) {
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "@") {
+		return fields[0], fields[1:], nil
+	}
+	if len(fields) < 5 {
+		return "", nil, fmt.Errorf("a cron expression has 5 fields")
+	}
+	return strings.Join(fields[:5], " "), fields[5:], nil
+}
+
+func formatRuns(runs []time.Time) string {
+	var lines []string
+	for _, t := range runs {
+		lines = append(lines, t.Format("Mon Jan 2 2006 15:04 MST"))
+	}
+	return strings.Join(lines, "\n")
+}
+
+var cronCmd = &botCommand{
+	Alias:       "cron",
+	Description: "Send notifications on a recurring schedule",
+	Permission:  permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		chatID := req.ChatID()
+		recurring := b.Recurring(chatID)
+		if len(recurring) == 0 {
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, "There are no recurring notifications in this chat.\n\nUsage:\n"+
+				b.commands[req.Path[0]].usage(req.Path)))
+			return nil
+		}
+
+		var sb strings.Builder
+		var rows [][]tgbotapi.InlineKeyboardButton
+		sb.WriteString("Recurring notifications:\n")
+		for _, rn := range recurring {
+			state := "next " + rn.NextRun.In(loadLocation(rn.Timezone)).Format("Mon Jan 2 15:04 MST")
+			toggle := tgbotapi.NewInlineKeyboardButtonData("Pause "+rn.ID, "cron:pause:"+rn.ID)
+			if rn.Paused {
+				state = "paused"
+				toggle = tgbotapi.NewInlineKeyboardButtonData("Resume "+rn.ID, "cron:resume:"+rn.ID)
+			}
+			fmt.Fprintf(&sb, "\n%s %q in %s (%s): %s", rn.ID, rn.Cron, rn.Timezone, state, preview(rn.Notification.Text, 60))
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(toggle,
+				tgbotapi.NewInlineKeyboardButtonData("Delete "+rn.ID, "cron:delete:"+rn.ID)))
+		}
+
+		msg := tgbotapi.NewMessage(chatID, sb.String())
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+		b.tg.SendContext(ctx, msg)
+		return nil
+	},
+	Subcommands: []*botCommand{
+		{
+			Alias: "add",
+			Args: []commandArg{
+				{Name: "schedule message", Kind: argRest},
+			},
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				chatID := req.ChatID()
+				spec, rest, err := splitCron(req.Strings("schedule message"))
+				if err == nil && len(rest) == 0 {
+					err = fmt.Errorf("missing the message")
+				}
+				if err != nil {
+					b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("Sorry, %v. For example: /cron add 0 9 * * mon rotate on-call", err)))
+					return nil
+				}
+
+				user := req.Message.From
+				rn, err := b.AddRecurring(&Notification{
+					ChatID:     chatID,
+					Text:       strings.Join(rest, " "),
+					Source:     "user:" + strconv.Itoa(user.ID),
+					SourceName: displayName(user),
+				}, spec, b.Timezone(chatID))
+				if err != nil {
+					b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("Sorry, %v.", err)))
+					return nil
+				}
+
+				runs, _ := b.PreviewCron(rn.Cron, rn.Timezone, DefaultPreviewRuns)
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("Added recurring notification %s. The next runs are:\n%s",
+					rn.ID, formatRuns(runs))))
+				return nil
+			},
+		},
+		{
+			Alias: "preview",
+			Args: []commandArg{
+				{Name: "schedule", Kind: argRest},
+			},
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				chatID := req.ChatID()
+				spec, rest, err := splitCron(req.Strings("schedule"))
+				count := DefaultPreviewRuns
+				if err == nil && len(rest) > 0 {
+					count, err = strconv.Atoi(rest[0])
+					if err != nil || count < 1 || count > 50 || len(rest) > 1 {
+						err = fmt.Errorf("the count must be a number from 1 to 50")
+					}
+				}
+				var runs []time.Time
+				if err == nil {
+					runs, err = b.PreviewCron(spec, b.Timezone(chatID), count)
+				}
+				if err != nil {
+					b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("Sorry, %v.", err)))
+					return nil
+				}
+				if len(runs) == 0 {
+					b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, "That schedule never runs."))
+					return nil
+				}
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, "The next runs are:\n"+formatRuns(runs)))
+				return nil
+			},
+		},
+		cronActionCmd("pause", "Paused.", func(b *Bot, chatID int64, id string) (bool, error) {
+			return b.SetRecurringPaused(chatID, id, true)
+		}),
+		cronActionCmd("resume", "Resumed.", func(b *Bot, chatID int64, id string) (bool, error) {
+			return b.SetRecurringPaused(chatID, id, false)
+		}),
+		cronActionCmd("delete", "Deleted.", func(b *Bot, chatID int64, id string) (bool, error) {
+			return b.DeleteRecurring(chatID, id)
+		}),
+	},
+}
+
+// cronActionCmd builds a subcommand that changes a recurring notification by
+// ID.
+func cronActionCmd(alias, done string, fn func(b *Bot, chatID int64, id string) (bool, error)) *botCommand {
+	return &botCommand{
+		Alias: alias,
+		Args: []commandArg{
+			{Name: "id", Kind: argString},
+		},
+		RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+			ok, err := fn(b, req.ChatID(), req.String("id"))
+			if err != nil {
+				return err
+			}
+			reply := done
+			if !ok {
+				reply = "There is no recurring notification with that ID in this chat."
+			}
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), reply))
+			return nil
+		},
+	}
+}
+
+var cronCallback = &botCallback{
+	Prefix: "cron",
+	RunFunc: func(ctx context.Context, b *Bot, query *tgbotapi.CallbackQuery, args []string) error {
+		if query.Message == nil || len(args) != 2 {
+			return fmt.Errorf("malformed cron callback: %v", args)
+		}
+		chatID := query.Message.Chat.ID
+		if !b.access.Allowed(int64(query.From.ID), chatID) {
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "You are not allowed to change recurring notifications here."))
+			return nil
+		}
+
+		var ok bool
+		var err error
+		switch args[0] {
+		case "pause":
+			ok, err = b.SetRecurringPaused(chatID, args[1], true)
+		case "resume":
+			ok, err = b.SetRecurringPaused(chatID, args[1], false)
+		case "delete":
+			ok, err = b.DeleteRecurring(chatID, args[1])
+		default:
+			return fmt.Errorf("malformed cron callback: %v", args)
+		}
+		if err != nil {
+			return err
+		}
+		reply := "Done"
+		if !ok {
+			reply = "It no longer exists"
+		}
+		b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, reply))
+		return nil
+	},
+}
@@ -0,0 +1,303 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/scheduler"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// jobReminder jobs send a reminder set with /remind.
+const jobReminder = "reminder"
+
+// jobSentReminder jobs keep a reminder that was sent so that the buttons of
+// its message can snooze it. They do nothing when they fire, which removes
+// them once sentReminderTTL has passed.
+const jobSentReminder = "reminder.sent"
+
+// sentReminderTTL is how long the buttons of a reminder keep working.
+const sentReminderTTL = 7 * 24 * time.Hour
+
+// reminderPrefix starts every reminder message.
+const reminderPrefix = "Reminder: "
+
+type reminder struct {
+	Text   string `json:"text"`
+	UserID int64  `json:"user_id"`
+
+	// Every is set for reminders that repeat.
+	Every *recurrence `json:"every,omitempty"`
+}
+
+// addReminder schedules r for chatID at the given time.
+func (b *Bot) addReminder(chatID int64, at time.Time, createdBy string, r *reminder) (*scheduler.Job, error) {
+	return b.jobs.Add(jobReminder, chatID, at, createdBy, r)
+}
+
+// runReminder sends a due reminder and schedules its next occurrence if it
+// repeats.
+func (b *Bot) runReminder(job *scheduler.Job, missed bool) error {
+	var r reminder
+	err := job.Decode(&r)
+	if err != nil {
+		return err
+	}
+
+	chatID := b.chats.Resolve(job.ChatID)
+	settings := b.settings.Get(chatID)
+	if r.Every != nil {
+		next := r.Every.next(time.Now(), settings.Location())
+		_, err := b.addReminder(chatID, next, job.CreatedBy, &r)
+		if err != nil {
+			b.logger.Error("failed to schedule next reminder", "job_id", job.ID, "error", err)
+		}
+	}
+	if b.skipMissed(job, missed) {
+		return nil
+	}
+
+	msg := tgbotapi.NewMessage(chatID, reminderPrefix+r.Text)
+	msg.DisableNotification = settings.Silent || settings.Quiet(time.Now())
+	sent, err := b.jobs.Add(jobSentReminder, chatID, time.Now().Add(sentReminderTTL), job.CreatedBy, &r)
+	if err != nil {
+		// The reminder is still worth sending, just without buttons.
+		b.logger.Error("failed to record sent reminder", "job_id", job.ID, "error", err)
+	} else {
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Snooze 10m", "remind:snooze:10m:"+sent.ID),
+				tgbotapi.NewInlineKeyboardButtonData("Snooze 1h", "remind:snooze:1h:"+sent.ID),
+				tgbotapi.NewInlineKeyboardButtonData("Tomorrow", "remind:snooze:tomorrow:"+sent.ID),
+			),
+			tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Done", "remind:done:"+sent.ID),
+			),
+		)
+	}
+	_, err = b.tg.SendIn(laneBulk, msg)
+	return b.checkDelivery(chatID, err)
+}
+
+// snoozeUntil returns when a reminder snoozed at now with one of the snooze
+// buttons is due again: after a duration such as 10m, or "tomorrow" at the
+// time parseWhen uses for dates without one.
+func snoozeUntil(option string, now time.Time, loc *time.Location) (time.Time, error) {
+	if option == "tomorrow" {
+		local := now.In(loc)
+		return time.Date(local.Year(), local.Month(), local.Day()+1,
+			defaultReminderMinute/60, defaultReminderMinute%60, 0, 0, loc), nil
+	}
+	d, err := time.ParseDuration(option)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("malformed snooze duration: %v", err)
+	}
+	return now.Add(d), nil
+}
+
+// sentReminder returns the job keeping a reminder sent to chatID, or nil if
+// it expired.
+func (b *Bot) sentReminder(chatID int64, id string) *scheduler.Job {
+	job := b.jobs.Get(id)
+	if job == nil || job.Kind != jobSentReminder || b.chats.Resolve(job.ChatID) != b.chats.Resolve(chatID) {
+		return nil
+	}
+	return job
+}
+
+// reminders returns the reminders pending in chatID, soonest first.
+func (b *Bot) reminders(chatID int64) []*scheduler.Job {
+	return b.jobs.List(func(job *scheduler.Job) bool {
+		return job.Kind == jobReminder && b.chats.Resolve(job.ChatID) == chatID
+	})
+}
+
+// cancelReminder cancels a reminder of chatID, reporting whether there was
+// one.
+func (b *Bot) cancelReminder(chatID int64, id string) (bool, error) {
+	job := b.jobs.Get(id)
+	if job == nil || job.Kind != jobReminder || b.chats.Resolve(job.ChatID) != chatID {
+		return false, nil
+	}
+	return b.jobs.Cancel(id)
+}
+
+func describeReminderTime(at time.Time, every *recurrence, loc *time.Location) string {
+	when := at.In(loc).Format("Mon Jan 2 15:04 MST")
+	if every != nil {
+		when += " and then " + every.String()
+	}
+	return when
+}
+
+var remindCmd = &botCommand{
+	Alias:       "remind",
+	Description: "Remind this chat of something later",
+	Args: []commandArg{
+		{Name: "when what", Kind: argRest},
+	},
+	Permission: permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		chatID := req.ChatID()
+		loc := b.settings.Get(chatID).Location()
+
+		at, every, rest, err := parseWhen(req.Strings("when what"), time.Now(), loc)
+		if err == nil && len(rest) > 0 && strings.EqualFold(rest[0], "to") {
+			rest = rest[1:]
+		}
+		if err == nil && len(rest) == 0 {
+			err = fmt.Errorf("missing what to remind you of")
+		}
+		if err != nil {
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("Sorry, %v.\n\n"+
+				"Try /remind in 20m check the oven, /remind tomorrow 9am standup, "+
+				"/remind every monday 10:00 planning or /remind on 2026-12-01 at 18:30 call mum.", err)))
+			return nil
+		}
+
+		r := &reminder{
+			Text:   strings.Join(rest, " "),
+			UserID: req.UserID(),
+			Every:  every,
+		}
+		job, err := b.addReminder(chatID, at, displayName(req.Message.From), r)
+		if err != nil {
+			return err
+		}
+
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, fmt.Sprintf("OK, I'll remind you on %s (reminder %s).",
+			describeReminderTime(at, every, loc), job.ID)))
+		return nil
+	},
+}
+
+var remindersCmd = &botCommand{
+	Alias:       "reminders",
+	Description: "List and cancel the reminders of this chat",
+	Permission:  permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		chatID := req.ChatID()
+		jobs := b.reminders(chatID)
+		if len(jobs) == 0 {
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, "There are no reminders in this chat. Set one with /remind."))
+			return nil
+		}
+
+		loc := b.settings.Get(chatID).Location()
+		var sb strings.Builder
+		var rows [][]tgbotapi.InlineKeyboardButton
+		sb.WriteString("Reminders:\n")
+		for _, job := range jobs {
+			var r reminder
+			if err := job.Decode(&r); err != nil {
+				b.logger.Error("skipping reminder", "job_id", job.ID, "error", err)
+				continue
+			}
+			fmt.Fprintf(&sb, "\n%s on %s by %s: %s", job.ID, describeReminderTime(job.RunAt, r.Every, loc),
+				job.CreatedBy, preview(r.Text, 60))
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Cancel "+job.ID, "remind:cancel:"+job.ID)))
+		}
+
+		msg := tgbotapi.NewMessage(chatID, sb.String())
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+		b.tg.SendContext(ctx, msg)
+		return nil
+	},
+	Subcommands: []*botCommand{
+		{
+			Alias: "cancel",
+			Args: []commandArg{
+				{Name: "id", Kind: argString},
+			},
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				ok, err := b.cancelReminder(req.ChatID(), req.String("id"))
+				if err != nil {
+					return err
+				}
+				reply := "Cancelled."
+				if !ok {
+					reply = "There is no reminder with that ID in this chat."
+				}
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), reply))
+				return nil
+			},
+		},
+	},
+}
+
+var remindCallback = &botCallback{
+	Prefix: "remind",
+	RunFunc: func(ctx context.Context, b *Bot, query *tgbotapi.CallbackQuery, args []string) error {
+		if query.Message == nil || len(args) == 0 {
+			return fmt.Errorf("malformed remind callback: %v", args)
+		}
+		chatID := query.Message.Chat.ID
+		if !b.access.Allowed(int64(query.From.ID), chatID) {
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "You are not allowed to manage reminders here."))
+			return nil
+		}
+
+		switch {
+		case args[0] == "cancel" && len(args) == 2:
+			ok, err := b.cancelReminder(chatID, args[1])
+			if err != nil {
+				return err
+			}
+			reply := "Cancelled"
+			if !ok {
+				reply = "It was already sent or cancelled"
+			}
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, reply))
+			return nil
+
+		case args[0] == "done" && len(args) <= 2:
+			if len(args) == 2 && b.sentReminder(chatID, args[1]) != nil {
+				if _, err := b.jobs.Cancel(args[1]); err != nil {
+					return err
+				}
+			}
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "Done"))
+			b.closeReminder(ctx, query, "Done")
+			return nil
+
+		case args[0] == "snooze" && len(args) == 3:
+			sent := b.sentReminder(chatID, args[2])
+			if sent == nil {
+				b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "This reminder can no longer be snoozed."))
+				return nil
+			}
+			var r reminder
+			if err := sent.Decode(&r); err != nil {
+				return err
+			}
+
+			loc := b.settings.Get(chatID).Location()
+			at, err := snoozeUntil(args[1], time.Now(), loc)
+			if err != nil {
+				return err
+			}
+			_, err = b.addReminder(chatID, at, displayName(query.From), &reminder{Text: r.Text, UserID: int64(query.From.ID)})
+			if err != nil {
+				return err
+			}
+			if _, err := b.jobs.Cancel(sent.ID); err != nil {
+				b.logger.Error("failed to forget sent reminder", "job_id", sent.ID, "error", err)
+			}
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "Snoozed"))
+			b.closeReminder(ctx, query, "Snoozed until "+at.In(loc).Format("Mon Jan 2 15:04"))
+			return nil
+		}
+		return fmt.Errorf("malformed remind callback: %v", args)
+	},
+}
+
+// closeReminder removes the buttons of a reminder message, noting what
+// happened to it.
+func (b *Bot) closeReminder(ctx context.Context, query *tgbotapi.CallbackQuery, note string) {
+	edit := tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID,
+		fmt.Sprintf("%s\n\n%s by %s", query.Message.Text, note, displayName(query.From)))
+	b.tg.SendContext(ctx, edit)
+}
@@ -0,0 +1,39 @@
+package bot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnoozeUntil(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 23:50 in Berlin.
+	now := time.Date(2026, 3, 28, 22, 50, 0, 0, time.UTC)
+
+	cases := []struct {
+		option string
+		want   time.Time
+	}{
+		{"10m", now.Add(10 * time.Minute)},
+		{"1h", now.Add(time.Hour)},
+		// The next morning, across the switch to summer time.
+		{"tomorrow", time.Date(2026, 3, 29, 9, 0, 0, 0, loc)},
+	}
+	for _, tc := range cases {
+		got, err := snoozeUntil(tc.option, now, loc)
+		if err != nil {
+			t.Errorf("%s: %v", tc.option, err)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.option, got, tc.want)
+		}
+	}
+
+	if _, err := snoozeUntil("later", now, loc); err == nil {
+		t.Error("expected an error for an unknown option")
+	}
+}
@@ -0,0 +1,210 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/audit"
+	"github.com/endocrimes/endobot/internal/history"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// compactInterval is how often data older than its retention period is
+// removed.
+const compactInterval = time.Hour
+
+// compact removes history, token records and audit log entries older than
+// their retention period, recording what was removed in the audit log.
+// Scheduled jobs need no retention as they are removed once they ran or were
+// cancelled.
+func (b *Bot) compact(now time.Time) {
+	if b.cfg.HistoryRetention > 0 {
+		before := now.Add(-b.cfg.HistoryRetention)
+		n, err := b.history.Delete(func(r *history.Record) bool {
+			return r.ReceivedAt.Before(before)
+		})
+		b.recordCompaction("history", before, n, err)
+	}
+	if b.cfg.TokenRetention > 0 {
+		before := now.Add(-b.cfg.TokenRetention)
+		n, err := b.registry.Compact(before)
+		b.recordCompaction("tokens", before, n, err)
+	}
+	if b.cfg.AuditRetention > 0 {
+		before := now.Add(-b.cfg.AuditRetention)
+		n, err := b.audit.Compact(before)
+		b.recordCompaction("audit", before, n, err)
+	}
+}
+
+func (b *Bot) recordCompaction(data string, before time.Time, n int, err error) {
+	if err != nil {
+		b.logger.Error("failed to remove old data", "data", data, "error", err)
+	}
+	if n == 0 {
+		return
+	}
+	b.logger.Info("removed old data", "data", data, "before", before, "removed", n)
+	b.RecordAudit(&audit.Entry{
+		Action: audit.ActionCompacted,
+		Actor:  audit.ActorSystem,
+		Details: map[string]interface{}{
+			"data":    data,
+			"before":  before,
+			"removed": n,
+		},
+	})
+}
+
+// deletedChat counts what was removed by deleteChat.
+type deletedChat struct {
+	Messages    int
+	Jobs        int
+	Pending     int
+	Webhooks    int
+	SigningKeys int
+	Tokens      int
+}
+
+func (d *deletedChat) String() string {
+	return fmt.Sprintf("Deleted %d notifications, %d scheduled jobs, %d pending notifications, %d webhooks, "+
+		"%d signing keys and the chat's settings and limits, and revoked %d tokens.",
+		d.Messages, d.Jobs, d.Pending, d.Webhooks, d.SigningKeys, d.Tokens)
+}
+
+// deleteChat deletes everything stored about chatID and revokes its tokens,
+// recording who did it in the audit log. It carries on past failures so as
+// much as possible is deleted, returning the first error.
+func (b *Bot) deleteChat(chatID int64, actor string) (*deletedChat, error) {
+	chatID = b.chats.Resolve(chatID)
+	inChat := b.inChat(chatID)
+
+	var d deletedChat
+	var errs []error
+	collect := func(n int, err error) int {
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return n
+	}
+
+	d.Messages = collect(b.history.Delete(func(r *history.Record) bool { return inChat(r.ChatID) }))
+	d.Jobs = collect(b.jobs.CancelChat(inChat))
+	d.Pending = collect(b.digests.RemoveChat(chatID))
+	d.Pending += collect(b.held.RemoveChat(chatID))
+	d.Webhooks = collect(b.webhooks.DeleteChat(inChat))
+	d.SigningKeys = collect(b.signing.DeleteChat(inChat))
+	d.Tokens = collect(b.registry.RevokeChat(inChat))
+	_, err := b.settings.Delete(chatID)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	err = b.limits.Set(chatLimitKey(chatID), nil)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	entry := &audit.Entry{
+		Action: audit.ActionChatDeleted,
+		Actor:  actor,
+		ChatID: chatID,
+		Details: map[string]interface{}{
+			"messages":       d.Messages,
+			"jobs":           d.Jobs,
+			"pending":        d.Pending,
+			"webhooks":       d.Webhooks,
+			"signing_keys":   d.SigningKeys,
+			"revoked_tokens": d.Tokens,
+		},
+	}
+	if len(errs) > 0 {
+		entry.Details["error"] = errs[0].Error()
+	}
+	b.RecordAudit(entry)
+	b.logger.Info("deleted chat data", "chat_id", chatID, "actor", actor, "errors", len(errs))
+
+	if len(errs) > 0 {
+		return &d, errs[0]
+	}
+	return &d, nil
+}
+
+// confirmForget asks for confirmation before deleting the data of chatID.
+func (b *Bot) confirmForget(ctx context.Context, req *commandRequest, chatID int64, text string) {
+	msg := tgbotapi.NewMessage(req.ChatID(), text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("Delete everything", "forget:"+strconv.FormatInt(chatID, 10)),
+			tgbotapi.NewInlineKeyboardButtonData("Cancel", "forget:cancel"),
+		),
+	)
+	b.tg.SendContext(ctx, msg)
+}
+
+var forgetMeCmd = &botCommand{
+	Alias:       "forgetme",
+	Description: "Delete everything stored about this chat",
+	Permission:  permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		b.confirmForget(ctx, req, req.ChatID(), "This deletes the notification history, scheduled and recurring "+
+			"notifications, reminders, webhooks, signing keys and settings of this chat and revokes all of its "+
+			"tokens. It can't be undone. Are you sure?")
+		return nil
+	},
+}
+
+var purgeCmd = &botCommand{
+	Alias:       "purge",
+	Description: "Delete everything stored about a chat",
+	Args: []commandArg{
+		{Name: "chat id", Kind: argInt},
+	},
+	Permission: permOwner,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		chatID := req.Int("chat id")
+		b.confirmForget(ctx, req, chatID, fmt.Sprintf("This deletes everything stored about chat %d and revokes "+
+			"all of its tokens. It can't be undone. Are you sure?", chatID))
+		return nil
+	},
+}
+
+var forgetCallback = &botCallback{
+	Prefix: "forget",
+	RunFunc: func(ctx context.Context, b *Bot, query *tgbotapi.CallbackQuery, args []string) error {
+		if query.Message == nil || len(args) != 1 {
+			return fmt.Errorf("malformed forget callback: %v", args)
+		}
+		if args[0] == "cancel" {
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "Cancelled"))
+			b.tg.SendContext(ctx, tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, "Nothing was deleted."))
+			return nil
+		}
+
+		chatID, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("malformed forget callback: %v", args)
+		}
+		userID := int64(query.From.ID)
+		allowed := b.access.IsOwner(userID)
+		if chatID == query.Message.Chat.ID {
+			allowed = allowed || b.access.Allowed(userID, chatID)
+		}
+		if !allowed {
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "You are not allowed to delete this chat's data."))
+			return nil
+		}
+
+		d, err := b.deleteChat(chatID, userActor(userID))
+		if err != nil {
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "Some data could not be deleted"))
+			b.tg.SendContext(ctx, tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID,
+				fmt.Sprintf("%s Some data could not be deleted, please try again: %v", d, err)))
+			return nil
+		}
+		b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "Deleted"))
+		b.tg.SendContext(ctx, tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID, d.String()))
+		return nil
+	},
+}
@@ -0,0 +1,187 @@
+package bot
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/audit"
+	"github.com/endocrimes/endobot/internal/history"
+	"github.com/endocrimes/endobot/internal/ratelimit"
+	"github.com/endocrimes/endobot/internal/store"
+	"github.com/endocrimes/endobot/internal/tokensigner"
+)
+
+func TestCompact(t *testing.T) {
+	st, dir := openTestDir(t)
+	cfg := &Config{
+		HistoryRetention: 24 * time.Hour,
+		TokenRetention:   24 * time.Hour,
+		AuditRetention:   48 * time.Hour,
+	}
+	b, _ := newTestBot(t, st, cfg)
+	now := time.Now()
+
+	for _, age := range []time.Duration{3 * 24 * time.Hour, time.Hour} {
+		if err := b.history.Add(&history.Record{ChatID: testAllowed, Text: age.String(), ReceivedAt: now.Add(-age)}); err != nil {
+			t.Fatal(err)
+		}
+		if err := b.audit.Record(&audit.Entry{Time: now.Add(-age), Action: audit.ActionTokenIssued, Actor: age.String()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expired := &tokensigner.TokenRecord{ID: "expired", IssuedAt: now.Add(-tokensigner.TokenLifetime - 2*24*time.Hour)}
+	valid := &tokensigner.TokenRecord{ID: "valid", IssuedAt: now.Add(-time.Hour)}
+	for _, rec := range []*tokensigner.TokenRecord{expired, valid} {
+		if err := b.registry.Register(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.compact(now)
+
+	st, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = newTestBot(t, st, cfg)
+	if got := b.history.Find(history.Query{}); len(got) != 1 || got[0].Text != "1h0m0s" {
+		t.Fatalf("got history %v, want only the recent record", got)
+	}
+	if b.registry.Get("expired") != nil || b.registry.Get("valid") == nil {
+		t.Fatal("got the wrong tokens removed")
+	}
+	if got := b.audit.Find(audit.Query{Action: audit.ActionTokenIssued}); len(got) != 1 || got[0].Actor != "1h0m0s" {
+		t.Fatalf("got audit entries %v, want only the recent one", got)
+	}
+	compacted := b.audit.Find(audit.Query{Action: audit.ActionCompacted})
+	var data []string
+	for _, e := range compacted {
+		data = append(data, e.Details["data"].(string))
+	}
+	if strings.Join(data, ",") != "audit,tokens,history" {
+		t.Fatalf("got compactions of %v recorded, want audit, tokens and history", data)
+	}
+
+	// Nothing is removed without a retention period.
+	b, _ = newTestBot(t, openTestStore(t), &Config{})
+	if err := b.history.Add(&history.Record{ChatID: testAllowed, ReceivedAt: now.Add(-10 * 365 * 24 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	b.compact(now)
+	if len(b.history.Find(history.Query{})) != 1 || len(b.audit.Find(audit.Query{})) != 0 {
+		t.Fatal("data was removed without a retention period")
+	}
+}
+
+// addChatData stores something of every kind for chatID.
+func addChatData(t *testing.T, b *Bot, chatID int64) {
+	if err := b.Notify(&Notification{ChatID: chatID, Text: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Schedule(&Notification{ChatID: chatID, Text: "later"}, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.held.Add(queueKey{ChatID: chatID}, queuedNotification{Time: time.Now(), Text: "held"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.webhooks.Create(chatID, b.inChat(chatID), "hook", testAllowed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.signing.NewClient(chatID, "key", testAllowed); err != nil {
+		t.Fatal(err)
+	}
+	issueTestToken(t, b, chatID, testAllowed)
+	if _, err := b.settings.Update(chatID, func(cs *chatSettings) { cs.Timezone = "Europe/Berlin" }); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.limits.Set(chatLimitKey(chatID), &ratelimit.Limit{Daily: 5}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteChat(t *testing.T) {
+	b, _ := newTestBot(t, openTestStore(t), &Config{})
+	addChatData(t, b, testAllowed)
+	addChatData(t, b, testGroup)
+
+	d, err := b.deleteChat(testAllowed, userActor(testOwner))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := deletedChat{Messages: 1, Jobs: 1, Pending: 1, Webhooks: 1, SigningKeys: 1, Tokens: 1}
+	if *d != want {
+		t.Fatalf("deleted %+v, want %+v", *d, want)
+	}
+
+	inChat := b.inChat(testAllowed)
+	if len(b.history.Find(history.Query{Chat: inChat})) != 0 || len(b.Scheduled(testAllowed)) != 0 ||
+		len(b.held.Entries(queueKey{ChatID: testAllowed})) != 0 || len(b.webhooks.List(inChat)) != 0 ||
+		len(b.signing.Clients(inChat)) != 0 {
+		t.Fatal("some of the chat's data is left")
+	}
+	for _, rec := range b.registry.List(func(rec *tokensigner.TokenRecord) bool { return inChat(rec.ChatID) }) {
+		if !rec.Revoked {
+			t.Fatalf("token %s wasn't revoked", rec.ID)
+		}
+	}
+	if b.settings.Get(testAllowed).Timezone != "UTC" {
+		t.Fatal("the chat's settings weren't reset")
+	}
+	if got := b.limits.Get(chatLimitKey(testAllowed), ratelimit.Limit{}); got != (ratelimit.Limit{}) {
+		t.Fatalf("the chat's limit %v wasn't removed", got)
+	}
+
+	// Other chats are left alone.
+	other := b.inChat(testGroup)
+	if len(b.history.Find(history.Query{Chat: other})) != 1 || len(b.Scheduled(testGroup)) != 1 ||
+		len(b.webhooks.List(other)) != 1 || b.settings.Get(testGroup).Timezone != "Europe/Berlin" {
+		t.Fatal("another chat's data was deleted")
+	}
+
+	entries := b.audit.Find(audit.Query{Action: audit.ActionChatDeleted})
+	if len(entries) != 1 || entries[0].Actor != userActor(testOwner) || entries[0].ChatID != testAllowed {
+		t.Fatalf("got audit entries %v, want the deletion recorded", entries)
+	}
+}
+
+func TestForgetMe(t *testing.T) {
+	const stranger = 30
+	b, fake := newTestBot(t, openTestStore(t), &Config{
+		Owners:       []int64{testOwner},
+		AllowedUsers: []int64{testAllowed},
+	})
+	addChatData(t, b, testAllowed)
+	forget := "forget:" + strconv.Itoa(testAllowed)
+
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "/forgetme"))
+	if got := fake.LastMessage(testAllowed); !strings.Contains(got, "Are you sure?") {
+		t.Fatalf("got %q, want a confirmation", got)
+	}
+
+	b.handleUpdate(callbackUpdate(testAllowed, testAllowed, "forget:cancel"))
+	if len(b.webhooks.List(b.inChat(testAllowed))) != 1 {
+		t.Fatal("cancelling deleted the data")
+	}
+
+	// Only owners may delete the data of another chat.
+	b.handleUpdate(callbackUpdate(stranger, stranger, forget))
+	if len(b.webhooks.List(b.inChat(testAllowed))) != 1 {
+		t.Fatal("a stranger deleted the data of a chat")
+	}
+
+	b.handleUpdate(callbackUpdate(testAllowed, testAllowed, forget))
+	edits := fake.Calls("editMessageText")
+	if last := edits[len(edits)-1].Get("text"); !strings.HasPrefix(last, "Deleted 1 notifications") {
+		t.Fatalf("got %q, want what was deleted", last)
+	}
+	if len(b.webhooks.List(b.inChat(testAllowed))) != 0 {
+		t.Fatal("the chat's data wasn't deleted")
+	}
+
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "/purge 20"))
+	if got := fake.LastMessage(testAllowed); !strings.Contains(got, "only owners") {
+		t.Fatalf("got %q, want /purge refused", got)
+	}
+}
@@ -0,0 +1,132 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/endocrimes/endobot/internal/audit"
+	"github.com/endocrimes/endobot/internal/tokensigner"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var tokensCmd = &botCommand{
+	Alias:       "tokens",
+	Description: "List the API tokens issued for this chat",
+	Permission:  permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		chatID := req.ChatID()
+		tokens := b.registry.List(func(rec *tokensigner.TokenRecord) bool {
+			return b.chats.Resolve(rec.ChatID) == chatID
+		})
+		if len(tokens) == 0 {
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, "No tokens have been issued for this chat."))
+			return nil
+		}
+
+		var sb strings.Builder
+		sb.WriteString("Tokens for this chat:\n")
+		for _, rec := range tokens {
+			fmt.Fprintf(&sb, "\n%s issued to %s", rec.ID, recordOwner(rec))
+			if !rec.IssuedAt.IsZero() {
+				fmt.Fprintf(&sb, " on %s", rec.IssuedAt.Format("2006-01-02"))
+			}
+			if rec.Revoked {
+				sb.WriteString(" (revoked)")
+			}
+		}
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, sb.String()))
+		return nil
+	},
+}
+
+func recordOwner(rec *tokensigner.TokenRecord) string {
+	switch {
+	case rec.Username != "":
+		return fmt.Sprintf("@%s (%d)", rec.Username, rec.UserID)
+	case rec.UserID != 0:
+		return fmt.Sprintf("user %d", rec.UserID)
+	}
+	return "an unknown user"
+}
+
+var revokeCmd = &botCommand{
+	Alias:       "revoke",
+	Description: "Revoke API credentials",
+	Args: []commandArg{
+		{Name: "token id", Kind: argString},
+	},
+	Permission: permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		chatID := req.ChatID()
+		rec := b.registry.Get(req.String("token id"))
+		if rec == nil || (b.chats.Resolve(rec.ChatID) != chatID && !b.access.IsOwner(req.UserID())) {
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, "There is no token with that id in this chat."))
+			return nil
+		}
+
+		err := b.tokenSigner.RevokeToken(rec.ID)
+		if err != nil {
+			return err
+		}
+		b.logger.Info("token revoked", "token_id", rec.ID, "user_id", req.UserID())
+		b.RecordAudit(&audit.Entry{
+			Action:  audit.ActionTokenRevoked,
+			Actor:   userActor(req.UserID()),
+			ChatID:  rec.ChatID,
+			Details: map[string]interface{}{"token_id": rec.ID},
+		})
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, "Token revoked."))
+		return nil
+	},
+	Subcommands: []*botCommand{
+		{
+			Alias: "mine",
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				return b.revokeUser(ctx, req.ChatID(), req.UserID(), req.UserID())
+			},
+		},
+		{
+			Alias: "user",
+			Args: []commandArg{
+				{Name: "user id", Kind: argInt},
+			},
+			Permission: permOwner,
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				return b.revokeUser(ctx, req.ChatID(), req.UserID(), req.Int("user id"))
+			},
+		},
+	},
+}
+
+// revokeUser revokes every credential owned by userID on behalf of actorID
+// and reports the result to chatID.
+func (b *Bot) revokeUser(ctx context.Context, chatID, actorID, userID int64) error {
+	tokens, err := b.registry.RevokeUser(userID)
+	if err != nil {
+		return err
+	}
+	hooks, err := b.webhooks.DeleteUser(userID)
+	if err != nil {
+		return err
+	}
+	keys, err := b.signing.DeleteUser(userID)
+	if err != nil {
+		return err
+	}
+
+	b.logger.Info("revoked user credentials", "user_id", userID, "tokens", tokens, "webhooks", hooks, "signing_keys", keys)
+	b.RecordAudit(&audit.Entry{
+		Action: audit.ActionUserRevoked,
+		Actor:  userActor(actorID),
+		Details: map[string]interface{}{
+			"user_id":      userID,
+			"tokens":       tokens,
+			"webhooks":     hooks,
+			"signing_keys": keys,
+		},
+	})
+	b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID,
+		fmt.Sprintf("Revoked %d tokens, %d webhooks and %d signing keys of user %d.", tokens, hooks, keys, userID)))
+	return nil
+}
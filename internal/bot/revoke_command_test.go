@@ -0,0 +1,78 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/endocrimes/endobot/internal/tokensigner"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func issueTestToken(t *testing.T, b *Bot, chatID, userID int64) *tokensigner.Claims {
+	_, claims, err := b.tokenSigner.GenerateToken(testChat(chatID), &tgbotapi.User{ID: int(userID)}, &tokensigner.TokenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestRevokeToken(t *testing.T) {
+	const other = 21
+	b, fake := newTestBot(t, openTestStore(t), &Config{
+		Owners:       []int64{testOwner},
+		AllowedUsers: []int64{testAllowed, other},
+	})
+	claims := issueTestToken(t, b, testAllowed, testAllowed)
+
+	// Tokens of other chats can't be revoked, or told apart from ones that
+	// don't exist.
+	b.handleUpdate(messageUpdate(other, other, "/revoke "+claims.ID))
+	if got := fake.LastMessage(other); !strings.Contains(got, "no token with that id") {
+		t.Fatalf("got %q", got)
+	}
+	if b.registry.Get(claims.ID).Revoked {
+		t.Fatal("a token was revoked from another chat")
+	}
+
+	b.handleUpdate(messageUpdate(testOwner, testOwner, "/revoke "+claims.ID))
+	if !b.registry.Get(claims.ID).Revoked {
+		t.Fatal("an owner couldn't revoke a token of another chat")
+	}
+}
+
+func TestRevokeUserTokens(t *testing.T) {
+	const other = 21
+	b, fake := newTestBot(t, openTestStore(t), &Config{
+		Owners:       []int64{testOwner},
+		AllowedUsers: []int64{testAllowed, other},
+		AllowedChats: []int64{testGroup},
+	})
+	mine := []*tokensigner.Claims{
+		issueTestToken(t, b, testAllowed, testAllowed),
+		issueTestToken(t, b, testGroup, testAllowed),
+	}
+	theirs := issueTestToken(t, b, testGroup, other)
+
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "/revoke user 21"))
+	if got := fake.LastMessage(testAllowed); !strings.Contains(got, "only owners") {
+		t.Fatalf("got %q, want /revoke user refused", got)
+	}
+	if b.registry.Get(theirs.ID).Revoked {
+		t.Fatal("a user revoked someone else's tokens")
+	}
+
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "/revoke mine"))
+	for _, claims := range mine {
+		if !b.registry.Get(claims.ID).Revoked {
+			t.Fatalf("token %s of the caller wasn't revoked", claims.ID)
+		}
+	}
+	if b.registry.Get(theirs.ID).Revoked {
+		t.Fatal("/revoke mine revoked someone else's token")
+	}
+
+	b.handleUpdate(messageUpdate(testOwner, testOwner, "/revoke user 21"))
+	if !b.registry.Get(theirs.ID).Revoked {
+		t.Fatal("an owner couldn't revoke a user's tokens")
+	}
+}
@@ -0,0 +1,232 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/history"
+	"github.com/endocrimes/endobot/internal/scheduler"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// jobNotification jobs deliver a Notification sent through the API with
+// send_at.
+const jobNotification = "notification"
+
+const (
+	// MissedFire delivers jobs that came due while the bot was down as soon
+	// as it is back.
+	MissedFire = "fire"
+
+	// MissedSkip drops jobs that came due while the bot was down.
+	MissedSkip = "skip"
+)
+
+// ScheduledNotification is a notification waiting to be sent.
+type ScheduledNotification struct {
+	ID        string
+	SendAt    time.Time
+	CreatedAt time.Time
+	CreatedBy string
+
+	Notification *Notification
+}
+
+func scheduledNotification(job *scheduler.Job) (*ScheduledNotification, error) {
+	var n Notification
+	err := job.Decode(&n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode scheduled notification %s: %v", job.ID, err)
+	}
+	return &ScheduledNotification{
+		ID:           job.ID,
+		SendAt:       job.RunAt,
+		CreatedAt:    job.CreatedAt,
+		CreatedBy:    job.CreatedBy,
+		Notification: &n,
+	}, nil
+}
+
+// Schedule delivers n at the given time.
+func (b *Bot) Schedule(n *Notification, at time.Time) (*ScheduledNotification, error) {
+	job, err := b.jobs.Add(jobNotification, n.ChatID, at, n.SourceName, n)
+	if err != nil {
+		return nil, err
+	}
+	return scheduledNotification(job)
+}
+
+// Scheduled returns the notifications waiting to be sent to chatID, soonest
+// first.
+func (b *Bot) Scheduled(chatID int64) []*ScheduledNotification {
+	chatID = b.chats.Resolve(chatID)
+	jobs := b.jobs.List(func(job *scheduler.Job) bool {
+		return job.Kind == jobNotification && b.chats.Resolve(job.ChatID) == chatID
+	})
+
+	var out []*ScheduledNotification
+	for _, job := range jobs {
+		sn, err := scheduledNotification(job)
+		if err != nil {
+			b.logger.Error("skipping scheduled notification", "error", err)
+			continue
+		}
+		out = append(out, sn)
+	}
+	return out
+}
+
+// CancelScheduled cancels a notification scheduled for chatID, reporting
+// whether there was one.
+func (b *Bot) CancelScheduled(chatID int64, id string) (bool, error) {
+	chatID = b.chats.Resolve(chatID)
+	job := b.jobs.Get(id)
+	if job == nil || job.Kind != jobNotification || b.chats.Resolve(job.ChatID) != chatID {
+		return false, nil
+	}
+	return b.jobs.Cancel(id)
+}
+
+// skipMissed reports whether a job that came due while the bot was down
+// should be skipped.
+func (b *Bot) skipMissed(job *scheduler.Job, missed bool) bool {
+	if missed && b.cfg.MissedJobs == MissedSkip {
+		b.logger.Info("skipping job missed while the bot was down", "job_id", job.ID, "kind", job.Kind, "run_at", job.RunAt)
+		return true
+	}
+	return false
+}
+
+// runScheduled delivers the notification of a scheduled or recurring job.
+// Notifications skipped because they came due while the bot was down are
+// recorded in the chat's history.
+func (b *Bot) runScheduled(job *scheduler.Job, missed bool) error {
+	var n Notification
+	err := job.Decode(&n)
+	if err != nil {
+		return err
+	}
+	if !b.skipMissed(job, missed) {
+		return b.notifyAndRecord(&n, job.ID)
+	}
+	return b.history.Add(&history.Record{
+		ChatID:      b.chats.Resolve(n.ChatID),
+		Source:      n.Source,
+		SourceName:  n.SourceName,
+		Text:        n.Text,
+		ReceivedAt:  time.Now(),
+		Status:      history.StatusSkipped,
+		Error:       fmt.Sprintf("came due at %s while the bot was down", job.RunAt.UTC().Format(time.RFC3339)),
+		ScheduledID: job.ID,
+	})
+}
+
+// runJob does the work of a scheduled job that is due.
+func (b *Bot) runJob(job *scheduler.Job, missed bool) {
+	var err error
+	switch job.Kind {
+	case jobNotification, jobRecurring:
+		err = b.runScheduled(job, missed)
+	case jobReminder:
+		err = b.runReminder(job, missed)
+	case jobSentReminder, jobSentNotification:
+		// Its buttons have expired.
+	case jobDeleteMessage:
+		err = b.deleteMessage(job)
+	default:
+		err = fmt.Errorf("unknown job kind %q", job.Kind)
+	}
+	if muted, ok := err.(*MutedError); ok {
+		b.logger.Debug("dropped scheduled notification from a muted source", "job_id", job.ID, "source", muted.Source)
+		return
+	}
+	if err != nil {
+		b.logger.Error("failed to run scheduled job", "job_id", job.ID, "kind", job.Kind, "chat_id", job.ChatID, "error", err)
+	}
+}
+
+// preview shortens text to a single line for listings.
+func preview(text string, n int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > n {
+		return string(r[:n]) + "…"
+	}
+	return text
+}
+
+var scheduledCmd = &botCommand{
+	Alias:       "scheduled",
+	Description: "List and cancel scheduled notifications",
+	Permission:  permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		chatID := req.ChatID()
+		scheduled := b.Scheduled(chatID)
+		if len(scheduled) == 0 {
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(chatID, "No notifications are scheduled for this chat."))
+			return nil
+		}
+
+		loc := b.settings.Get(chatID).Location()
+		var sb strings.Builder
+		var rows [][]tgbotapi.InlineKeyboardButton
+		sb.WriteString("Scheduled notifications:\n")
+		for _, sn := range scheduled {
+			fmt.Fprintf(&sb, "\n%s at %s from %s: %s", sn.ID, sn.SendAt.In(loc).Format("Jan 2 15:04 MST"),
+				sn.CreatedBy, preview(sn.Notification.Text, 60))
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Cancel "+sn.ID, "scheduled:cancel:"+sn.ID)))
+		}
+
+		msg := tgbotapi.NewMessage(chatID, sb.String())
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+		b.tg.SendContext(ctx, msg)
+		return nil
+	},
+	Subcommands: []*botCommand{
+		{
+			Alias: "cancel",
+			Args: []commandArg{
+				{Name: "id", Kind: argString},
+			},
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				ok, err := b.CancelScheduled(req.ChatID(), req.String("id"))
+				if err != nil {
+					return err
+				}
+				reply := "Cancelled."
+				if !ok {
+					reply = "There is no scheduled notification with that ID in this chat."
+				}
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), reply))
+				return nil
+			},
+		},
+	},
+}
+
+var scheduledCallback = &botCallback{
+	Prefix: "scheduled",
+	RunFunc: func(ctx context.Context, b *Bot, query *tgbotapi.CallbackQuery, args []string) error {
+		if query.Message == nil || len(args) != 2 || args[0] != "cancel" {
+			return fmt.Errorf("malformed scheduled callback: %v", args)
+		}
+		chatID := query.Message.Chat.ID
+		if !b.access.Allowed(int64(query.From.ID), chatID) {
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "You are not allowed to cancel notifications here."))
+			return nil
+		}
+
+		ok, err := b.CancelScheduled(chatID, args[1])
+		if err != nil {
+			return err
+		}
+		reply := "Cancelled"
+		if !ok {
+			reply = "It was already sent or cancelled"
+		}
+		b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, reply))
+		return nil
+	},
+}
@@ -0,0 +1,45 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/history"
+)
+
+func TestMissedScheduledNotifications(t *testing.T) {
+	cases := []struct {
+		missedJobs string
+		missed     bool
+		status     string
+	}{
+		{MissedFire, false, history.StatusDelivered},
+		{MissedFire, true, history.StatusDelivered},
+		{MissedSkip, false, history.StatusDelivered},
+		{MissedSkip, true, history.StatusSkipped},
+	}
+	for _, tc := range cases {
+		b, fake := newTestBot(t, openTestStore(t), &Config{MissedJobs: tc.missedJobs})
+		sn, err := b.Schedule(&Notification{ChatID: testAllowed, Text: "backup done", Source: "token:a"}, time.Now().Add(-time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.runJob(b.jobs.Get(sn.ID), tc.missed)
+
+		recs := b.Messages(testAllowed, history.Query{})
+		if len(recs) != 1 {
+			t.Fatalf("%s, missed %v: got %d history records, want 1", tc.missedJobs, tc.missed, len(recs))
+		}
+		if rec := recs[0]; rec.Status != tc.status || rec.ScheduledID != sn.ID || rec.Text != "backup done" {
+			t.Errorf("%s, missed %v: got %+v, want status %s for %s", tc.missedJobs, tc.missed, rec, tc.status, sn.ID)
+		}
+		sent := len(fake.Messages(testAllowed)) == 1
+		if sent != (tc.status == history.StatusDelivered) {
+			t.Errorf("%s, missed %v: sent %v", tc.missedJobs, tc.missed, sent)
+		}
+		if tc.status == history.StatusSkipped && !strings.Contains(recs[0].Error, "while the bot was down") {
+			t.Errorf("the skipped record doesn't say why: %q", recs[0].Error)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/ratelimit"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+	"github.com/hashicorp/go-hclog"
+)
+
+// sendLane is the priority of an outbound Telegram call. A lane is only
+// served when no higher lane has a call that may be sent.
+type sendLane int
+
+const (
+	// laneUrgent is for high priority notifications and security alerts.
+	laneUrgent sendLane = iota
+
+	// laneInteractive is for replies to commands and button presses.
+	laneInteractive
+
+	// laneBulk is for notifications, digests and other unattended traffic.
+	laneBulk
+
+	numLanes
+)
+
+// Telegram's limits on how fast a bot may send: about 30 messages a second
+// overall, 20 a minute to a group and one a second to a private chat.
+var (
+	globalSendRate  = ratelimit.Rate{Count: 30, Per: time.Second}
+	groupSendRate   = ratelimit.Rate{Count: 20, Per: time.Minute}
+	privateSendRate = ratelimit.Rate{Count: 1, Per: time.Second}
+)
+
+const globalSendKey = "global"
+
+const (
+	// maxSendRetries is how often a call Telegram asked to retry later is
+	// retried before its error is returned.
+	maxSendRetries = 3
+
+	// sendQueueWarnDepth is the number of waiting calls above which a
+	// warning is logged, at most once per sendQueueWarnInterval.
+	sendQueueWarnDepth    = 100
+	sendQueueWarnInterval = time.Minute
+)
+
+// chatSendRate returns how fast messages may be sent to chatID. Groups and
+// channels have negative IDs.
+func chatSendRate(chatID int64) ratelimit.Rate {
+	if chatID < 0 {
+		return groupSendRate
+	}
+	return privateSendRate
+}
+
+type sendJob struct {
+	lane    sendLane
+	chatID  int64
+	call    func() error
+	queued  time.Time
+	retries int
+	done    chan error
+}
+
+// laneQueue holds the calls waiting in a lane for each chat and the order in
+// which the chats take turns.
+type laneQueue struct {
+	chats map[int64][]*sendJob
+	order []int64
+}
+
+func (l *laneQueue) push(job *sendJob, front bool) {
+	jobs, ok := l.chats[job.chatID]
+	if !ok {
+		l.order = append(l.order, job.chatID)
+	}
+	if front {
+		jobs = append([]*sendJob{job}, jobs...)
+	} else {
+		jobs = append(jobs, job)
+	}
+	l.chats[job.chatID] = jobs
+}
+
+// remove takes job out of the queue, reporting whether it was waiting.
+func (l *laneQueue) remove(job *sendJob) bool {
+	jobs := l.chats[job.chatID]
+	for i, j := range jobs {
+		if j != job {
+			continue
+		}
+		jobs = append(jobs[:i:i], jobs[i+1:]...)
+		if len(jobs) > 0 {
+			l.chats[job.chatID] = jobs
+			return true
+		}
+		delete(l.chats, job.chatID)
+		for k, chatID := range l.order {
+			if chatID == job.chatID {
+				l.order = append(l.order[:k], l.order[k+1:]...)
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// pop removes the first call of the i-th chat in order, which then goes to
+// the back of the line if it has more.
+func (l *laneQueue) pop(i int) *sendJob {
+	chatID := l.order[i]
+	jobs := l.chats[chatID]
+	l.order = append(l.order[:i], l.order[i+1:]...)
+	if len(jobs) == 1 {
+		delete(l.chats, chatID)
+	} else {
+		l.chats[chatID] = jobs[1:]
+		l.order = append(l.order, chatID)
+	}
+	return jobs[0]
+}
+
+// sendQueue paces outbound Telegram calls to stay within Telegram's limits.
+// Calls wait in lanes by priority and within a lane chats take turns, so a
+// busy chat can't hold up the others. Calls made before Run starts wait for
+// it and calls made after it stops are sent straight away.
+type sendQueue struct {
+	logger  hclog.Logger
+	limiter *ratelimit.Limiter
+	warned  *cooldown
+	wake    chan struct{}
+
+	mu    sync.Mutex
+	lanes [numLanes]*laneQueue
+
+	// paused holds when chats Telegram asked to slow down may be sent to
+	// again. Chat zero pauses every call.
+	paused map[int64]time.Time
+
+	// sending holds the chats a call is being made to. Calls to a chat are
+	// made one at a time so messages arrive in order.
+	sending map[int64]bool
+	stopped bool
+}
+
+func newSendQueue(logger hclog.Logger) *sendQueue {
+	q := &sendQueue{
+		logger:  logger,
+		limiter: ratelimit.New(),
+		warned:  &cooldown{interval: sendQueueWarnInterval},
+		wake:    make(chan struct{}, 1),
+		paused:  make(map[int64]time.Time),
+		sending: make(map[int64]bool),
+	}
+	for i := range q.lanes {
+		q.lanes[i] = &laneQueue{chats: make(map[int64][]*sendJob)}
+	}
+	return q
+}
+
+// Do runs call in lane once the limits allow it and returns its error.
+// chatID is the chat the call sends to, or zero if it doesn't send to one.
+func (q *sendQueue) Do(lane sendLane, chatID int64, call func() error) error {
+	return q.DoContext(context.Background(), lane, chatID, call)
+}
+
+// DoContext is Do, but gives up waiting with the error of ctx when it is
+// done before the call was made. Calls already being made are waited for.
+func (q *sendQueue) DoContext(ctx context.Context, lane sendLane, chatID int64, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	job := &sendJob{
+		lane:   lane,
+		chatID: chatID,
+		call:   call,
+		queued: time.Now(),
+		done:   make(chan error, 1),
+	}
+
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return call()
+	}
+	q.lanes[lane].push(job, false)
+	depth := q.depthLocked()
+	q.mu.Unlock()
+
+	if depth > sendQueueWarnDepth && q.warned.Ready("depth", job.queued) {
+		q.logger.Warn("outbound messages are backing up", "queued", depth)
+	}
+	q.signal()
+
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+	}
+
+	q.mu.Lock()
+	removed := q.lanes[lane].remove(job)
+	q.mu.Unlock()
+	if removed {
+		return ctx.Err()
+	}
+	return <-job.done
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run sends queued calls as the limits allow until ctx is done, after which
+// the calls still waiting are sent without pacing.
+func (q *sendQueue) Run(ctx context.Context) {
+	for {
+		job, wait := q.next(time.Now())
+		if job != nil {
+			go q.execute(job)
+			continue
+		}
+
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-ctx.Done():
+			q.stop()
+		case <-q.wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// next returns the call to send now, or how long to wait until one may be
+// sent, zero if none are waiting.
+func (q *sendQueue) next(now time.Time) (*sendJob, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if until := q.paused[0]; now.Before(until) {
+		return nil, until.Sub(now)
+	}
+
+	var wait time.Duration
+	soonest := func(d time.Duration) {
+		if wait == 0 || d < wait {
+			wait = d
+		}
+	}
+	for _, lane := range q.lanes {
+		for i, chatID := range lane.order {
+			if q.sending[chatID] {
+				continue
+			}
+			if until, ok := q.paused[chatID]; ok && chatID != 0 {
+				if now.Before(until) {
+					soonest(until.Sub(now))
+					continue
+				}
+				delete(q.paused, chatID)
+			}
+
+			checks := []ratelimit.Check{{Key: globalSendKey, Limit: ratelimit.Limit{Rate: globalSendRate}}}
+			if chatID != 0 {
+				checks = append(checks, ratelimit.Check{Key: chatLimitKey(chatID), Limit: ratelimit.Limit{Rate: chatSendRate(chatID)}})
+			}
+			if exceeded := q.limiter.Allow(now, checks...); exceeded != nil {
+				soonest(exceeded.RetryAfter)
+				if exceeded.Key == globalSendKey {
+					return nil, wait
+				}
+				continue
+			}
+			if chatID != 0 {
+				q.sending[chatID] = true
+			}
+			return lane.pop(i), 0
+		}
+	}
+	return nil, wait
+}
+
+// execute makes a call. When Telegram asks to retry later the chat is
+// paused for as long as it asked and the call goes back to the front of its
+// line.
+func (q *sendQueue) execute(job *sendJob) {
+	err := job.call()
+
+	q.mu.Lock()
+	delete(q.sending, job.chatID)
+	tgErr, ok := err.(tgbotapi.Error)
+	retry := ok && tgErr.RetryAfter > 0 && job.retries < maxSendRetries && !q.stopped
+	if retry {
+		retryAfter := time.Duration(tgErr.RetryAfter) * time.Second
+		q.logger.Warn("Telegram asked to slow down", "chat_id", job.chatID, "retry_after", retryAfter)
+		job.retries++
+		q.paused[job.chatID] = time.Now().Add(retryAfter)
+		q.lanes[job.lane].push(job, true)
+	}
+	q.mu.Unlock()
+
+	if !retry {
+		job.done <- err
+	}
+	q.signal()
+}
+
+// stop sends every waiting call without pacing and makes later calls skip
+// the queue.
+func (q *sendQueue) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.stopped = true
+	for _, lane := range q.lanes {
+		for len(lane.order) > 0 {
+			job := lane.pop(0)
+			go func() { job.done <- job.call() }()
+		}
+	}
+}
+
+func (q *sendQueue) depthLocked() int {
+	n := 0
+	for _, lane := range q.lanes {
+		for _, jobs := range lane.chats {
+			n += len(jobs)
+		}
+	}
+	return n
+}
+
+// sendQueueStats describes the calls waiting to be sent.
+type sendQueueStats struct {
+	Lanes  [numLanes]int
+	Chats  int
+	Oldest time.Duration
+}
+
+func (q *sendQueue) Stats(now time.Time) sendQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var s sendQueueStats
+	chats := make(map[int64]bool)
+	for i, lane := range q.lanes {
+		for chatID, jobs := range lane.chats {
+			s.Lanes[i] += len(jobs)
+			chats[chatID] = true
+			if wait := now.Sub(jobs[0].queued); wait > s.Oldest {
+				s.Oldest = wait
+			}
+		}
+	}
+	s.Chats = len(chats)
+	return s
+}
+
+// pacedAPI is the Telegram client with the calls that send, edit or delete
+// messages going through a sendQueue.
+type pacedAPI struct {
+	*tgbotapi.BotAPI
+	queue *sendQueue
+}
+
+// Send sends c in the interactive lane.
+func (p *pacedAPI) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return p.SendInContext(context.Background(), laneInteractive, c)
+}
+
+// SendContext sends c in the interactive lane, giving up if ctx is done
+// before it could be sent.
+func (p *pacedAPI) SendContext(ctx context.Context, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return p.SendInContext(ctx, laneInteractive, c)
+}
+
+// SendIn sends c in the given lane.
+func (p *pacedAPI) SendIn(lane sendLane, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return p.SendInContext(context.Background(), lane, c)
+}
+
+// SendInContext sends c in the given lane, giving up if ctx is done before
+// it could be sent.
+func (p *pacedAPI) SendInContext(ctx context.Context, lane sendLane, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var msg tgbotapi.Message
+	err := p.queue.DoContext(ctx, lane, chattableChat(c), func() error {
+		var err error
+		msg, err = p.BotAPI.Send(c)
+		return err
+	})
+	return msg, err
+}
+
+func (p *pacedAPI) AnswerCallbackQuery(config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error) {
+	return p.AnswerCallbackQueryContext(context.Background(), config)
+}
+
+func (p *pacedAPI) AnswerCallbackQueryContext(ctx context.Context, config tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error) {
+	var resp tgbotapi.APIResponse
+	err := p.queue.DoContext(ctx, laneInteractive, 0, func() error {
+		var err error
+		resp, err = p.BotAPI.AnswerCallbackQuery(config)
+		return err
+	})
+	return resp, err
+}
+
+func (p *pacedAPI) DeleteMessage(config tgbotapi.DeleteMessageConfig) (tgbotapi.APIResponse, error) {
+	var resp tgbotapi.APIResponse
+	err := p.queue.Do(laneBulk, config.ChatID, func() error {
+		var err error
+		resp, err = p.BotAPI.DeleteMessage(config)
+		return err
+	})
+	return resp, err
+}
+
+// chattableChat returns the chat c sends to, or zero if it isn't known.
+func chattableChat(c tgbotapi.Chattable) int64 {
+	switch c := c.(type) {
+	case tgbotapi.MessageConfig:
+		return c.ChatID
+	case tgbotapi.DocumentConfig:
+		return c.ChatID
+	case tgbotapi.EditMessageTextConfig:
+		return c.ChatID
+	case tgbotapi.EditMessageReplyMarkupConfig:
+		return c.ChatID
+	case tgbotapi.ChatActionConfig:
+		return c.ChatID
+	}
+	return 0
+}
+
+var queueCmd = &botCommand{
+	Alias:       "queue",
+	Description: "Show how many messages are waiting to be sent",
+	Permission:  permOwner,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		s := b.tg.queue.Stats(time.Now())
+		text := fmt.Sprintf("Waiting to be sent: %d urgent, %d interactive and %d bulk messages to %d chats.",
+			s.Lanes[laneUrgent], s.Lanes[laneInteractive], s.Lanes[laneBulk], s.Chats)
+		if s.Oldest > 0 {
+			text += fmt.Sprintf(" The oldest has waited %s.", s.Oldest.Round(time.Second))
+		}
+		// Sent in the urgent lane so it isn't stuck behind what it reports.
+		_, err := b.tg.SendInContext(ctx, laneUrgent, tgbotapi.NewMessage(req.ChatID(), text))
+		return err
+	},
+}
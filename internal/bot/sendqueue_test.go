@@ -0,0 +1,176 @@
+package bot
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+func TestSendQueueDoContextGivesUp(t *testing.T) {
+	// Without Run nothing is sent, so the call waits until ctx is done.
+	q := newSendQueue(hclog.NewNullLogger())
+
+	ctx, cancelFn := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelFn()
+	called := false
+	err := q.DoContext(ctx, laneInteractive, 1, func() error {
+		called = true
+		return nil
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want the deadline error", err)
+	}
+	if called {
+		t.Fatal("the call was made after giving up")
+	}
+	if s := q.Stats(time.Now()); s.Lanes[laneInteractive] != 0 || s.Chats != 0 {
+		t.Fatalf("the call is still queued: %+v", s)
+	}
+}
+
+// queueJobs adds a call to chatID in lane for each name, in order, recording
+// their names in jobs.
+func queueJobs(q *sendQueue, jobs map[*sendJob]string, lane sendLane, chatID int64, names ...string) {
+	for _, name := range names {
+		job := &sendJob{lane: lane, chatID: chatID, done: make(chan error, 1)}
+		q.lanes[lane].push(job, false)
+		jobs[job] = name
+	}
+}
+
+func TestSendQueueNext(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name  string
+		queue func(q *sendQueue, jobs map[*sendJob]string)
+		want  []string
+	}{
+		{
+			name: "higher lanes first",
+			queue: func(q *sendQueue, jobs map[*sendJob]string) {
+				queueJobs(q, jobs, laneBulk, 1, "bulk")
+				queueJobs(q, jobs, laneInteractive, 2, "reply")
+				queueJobs(q, jobs, laneUrgent, 3, "alert")
+			},
+			want: []string{"alert", "reply", "bulk"},
+		},
+		{
+			name: "chats take turns",
+			queue: func(q *sendQueue, jobs map[*sendJob]string) {
+				queueJobs(q, jobs, laneBulk, 1, "a1", "a2", "a3")
+				queueJobs(q, jobs, laneBulk, 2, "b1", "b2")
+				queueJobs(q, jobs, laneBulk, 3, "c1")
+			},
+			want: []string{"a1", "b1", "c1", "a2", "b2", "a3"},
+		},
+	}
+	for _, tc := range cases {
+		q := newSendQueue(hclog.NewNullLogger())
+		jobs := make(map[*sendJob]string)
+		tc.queue(q, jobs)
+
+		var got []string
+		at := now
+		for len(got) < len(tc.want) {
+			job, _ := q.next(at)
+			if job == nil {
+				// Wait out the pace of private chats.
+				at = at.Add(time.Second)
+				continue
+			}
+			got = append(got, jobs[job])
+			delete(q.sending, job.chatID)
+		}
+		if job, wait := q.next(at.Add(time.Hour)); job != nil || wait != 0 {
+			t.Errorf("%s: the queue isn't empty: %v %v", tc.name, jobs[job], wait)
+		}
+		for i := range tc.want {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSendQueueNextOneCallPerChat(t *testing.T) {
+	q := newSendQueue(hclog.NewNullLogger())
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	queueJobs(q, make(map[*sendJob]string), laneBulk, -100, "first", "second")
+
+	first, _ := q.next(now)
+	if first == nil {
+		t.Fatal("nothing was sent")
+	}
+	// The group's pace allows another call, but the first is still being
+	// made.
+	if job, wait := q.next(now.Add(time.Minute)); job != nil || wait != 0 {
+		t.Fatalf("sent a second call to the chat while the first was being made: %v", wait)
+	}
+	delete(q.sending, first.chatID)
+	if job, _ := q.next(now.Add(time.Minute)); job == nil {
+		t.Fatal("the second call wasn't sent after the first finished")
+	}
+}
+
+func TestSendQueueNextPacing(t *testing.T) {
+	q := newSendQueue(hclog.NewNullLogger())
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	// A group may be sent 20 messages a minute.
+	jobs := make(map[*sendJob]string)
+	queueJobs(q, jobs, laneUrgent, -100, make([]string, 21)...)
+	queueJobs(q, jobs, laneBulk, 7, "private")
+	for i := 0; i < 20; i++ {
+		job, _ := q.next(now)
+		if job == nil || job.chatID != -100 {
+			t.Fatalf("call %d to the group wasn't sent", i)
+		}
+		delete(q.sending, job.chatID)
+	}
+
+	// The paced group doesn't hold up a lower lane.
+	job, _ := q.next(now)
+	if job == nil || job.chatID != 7 {
+		t.Fatalf("the private chat wasn't sent to while the group was paced")
+	}
+	delete(q.sending, job.chatID)
+
+	job, wait := q.next(now)
+	if job != nil || wait != 3*time.Second {
+		t.Fatalf("got %v and a wait of %v, want to wait 3s for the group", job, wait)
+	}
+	if job, _ := q.next(now.Add(3 * time.Second)); job == nil {
+		t.Fatal("the group wasn't sent to once its pace allowed")
+	}
+}
+
+func TestSendQueueNextPaused(t *testing.T) {
+	q := newSendQueue(hclog.NewNullLogger())
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	jobs := make(map[*sendJob]string)
+	queueJobs(q, jobs, laneUrgent, 1, "paused")
+	queueJobs(q, jobs, laneBulk, 2, "other")
+
+	// A chat Telegram asked to slow down waits, the others don't.
+	q.paused[1] = now.Add(10 * time.Second)
+	job, _ := q.next(now)
+	if job == nil || job.chatID != 2 {
+		t.Fatal("the chat that isn't paused wasn't sent to")
+	}
+	if job, wait := q.next(now); job != nil || wait != 10*time.Second {
+		t.Fatalf("got %v and a wait of %v, want to wait 10s", job, wait)
+	}
+
+	// Chat zero pauses everything.
+	q.paused[0] = now.Add(20 * time.Second)
+	if job, wait := q.next(now.Add(15 * time.Second)); job != nil || wait != 5*time.Second {
+		t.Fatalf("got %v and a wait of %v, want to wait 5s", job, wait)
+	}
+	if job, _ := q.next(now.Add(20 * time.Second)); job == nil || job.chatID != 1 {
+		t.Fatal("the paused chat wasn't sent to once the pause ended")
+	}
+}
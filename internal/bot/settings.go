@@ -0,0 +1,375 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const settingsDocument = "settings"
+
+const (
+	formatPlain    = "plain"
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+)
+
+var (
+	formats    = []string{formatPlain, formatMarkdown, formatHTML}
+	languages  = []string{"en", "de"}
+	quietModes = []string{quietSilent, quietHold}
+
+	digestWindows = []string{"off", "15m", "1h", "6h", "24h"}
+
+	commonTimezones = []string{"UTC", "Europe/London", "Europe/Berlin", "America/New_York", "America/Los_Angeles", "Asia/Tokyo"}
+)
+
+// chatSettings are the per-chat preferences consulted when delivering
+// notifications.
+type chatSettings struct {
+	// Silent delivers every notification without sound.
+	Silent bool `json:"silent"`
+
+	// Timezone is the IANA name of the chat's timezone.
+	Timezone string `json:"timezone"`
+
+	// QuietHours are the windows, in Timezone, during which notifications
+	// are delivered silently or held, e.g. "mon-fri 22:00-07:00; sat,sun
+	// 23:00-09:00". Empty disables it.
+	QuietHours string `json:"quiet_hours"`
+
+	// QuietMode is what happens to notifications during quiet hours: they
+	// are delivered silently or held until the quiet hours end.
+	QuietMode string `json:"quiet_mode"`
+
+	// DNDUntil is when do not disturb, set by /dnd, ends.
+	DNDUntil time.Time `json:"dnd_until"`
+
+	// Format is how notification text is parsed: plain, markdown or html.
+	Format string `json:"format"`
+
+	// Digest batches notifications over the window, e.g. "1h", instead of
+	// sending them as they arrive. Empty disables it.
+	Digest string `json:"digest"`
+
+	// DigestCount sends the digest early once this many notifications are
+	// pending. Zero only uses the window.
+	DigestCount int `json:"digest_count,omitempty"`
+
+	// SourceDigests are digest rules for individual credentials, keyed by
+	// the ID of the credential, that replace Digest and DigestCount for the
+	// notifications it sends.
+	SourceDigests map[string]*digestRule `json:"source_digests,omitempty"`
+
+	// Mutes are the sources whose notifications are dropped, keyed by the ID
+	// of the credential, until the given time.
+	Mutes map[string]time.Time `json:"mutes,omitempty"`
+
+	// Language is the language of the digests and summaries of held
+	// notifications the bot writes. Command replies are always English.
+	Language string `json:"language"`
+}
+
+func defaultChatSettings() *chatSettings {
+	return &chatSettings{
+		Timezone:  "UTC",
+		QuietMode: quietSilent,
+		Format:    formatPlain,
+		Language:  "en",
+	}
+}
+
+func (s *chatSettings) copy() *chatSettings {
+	cp := *s
+	if s.SourceDigests != nil {
+		cp.SourceDigests = make(map[string]*digestRule, len(s.SourceDigests))
+		for source, rule := range s.SourceDigests {
+			r := *rule
+			cp.SourceDigests[source] = &r
+		}
+	}
+	if s.Mutes != nil {
+		cp.Mutes = make(map[string]time.Time, len(s.Mutes))
+		for source, until := range s.Mutes {
+			cp.Mutes[source] = until
+		}
+	}
+	return &cp
+}
+
+// Location returns the chat's timezone, falling back to UTC.
+func (s *chatSettings) Location() *time.Location {
+	return loadLocation(s.Timezone)
+}
+
+// loadLocation returns the named timezone, or UTC if it is unknown.
+func loadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// DigestWindow returns how long notifications are batched for, or zero if
+// they aren't.
+func (s *chatSettings) DigestWindow() time.Duration {
+	d, err := time.ParseDuration(s.Digest)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+type settingsStore struct {
+	store *store.Store
+
+	mu    sync.Mutex
+	chats map[int64]*chatSettings
+}
+
+func newSettingsStore(st *store.Store) (*settingsStore, error) {
+	s := &settingsStore{
+		store: st,
+		chats: make(map[int64]*chatSettings),
+	}
+
+	err := st.Load(settingsDocument, &s.chats)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load settings: %v", err)
+	}
+	for _, cs := range s.chats {
+		// Settings saved before quiet modes existed.
+		if cs.QuietMode == "" {
+			cs.QuietMode = quietSilent
+		}
+	}
+
+	return s, nil
+}
+
+// Get returns a copy of the settings of chatID.
+func (s *settingsStore) Get(chatID int64) *chatSettings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs, ok := s.chats[chatID]
+	if !ok {
+		return defaultChatSettings()
+	}
+	return cs.copy()
+}
+
+// Update applies fn to the settings of chatID and persists the result.
+func (s *settingsStore) Update(chatID int64, fn func(cs *chatSettings)) (*chatSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs, ok := s.chats[chatID]
+	if !ok {
+		cs = defaultChatSettings()
+		s.chats[chatID] = cs
+	}
+	fn(cs)
+
+	return cs.copy(), s.store.Save(settingsDocument, s.chats)
+}
+
+// Delete resets the settings of chatID to the defaults, reporting whether
+// it had any.
+func (s *settingsStore) Delete(chatID int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.chats[chatID]; !ok {
+		return false, nil
+	}
+	delete(s.chats, chatID)
+	return true, s.store.Save(settingsDocument, s.chats)
+}
+
+// Migrate moves the settings of the chat from to its new ID to. Settings
+// already made in the new chat are kept.
+func (s *settingsStore) Migrate(from, to int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cs, ok := s.chats[from]
+	if !ok {
+		return nil
+	}
+	if _, ok := s.chats[to]; !ok {
+		s.chats[to] = cs
+	}
+	delete(s.chats, from)
+	return s.store.Save(settingsDocument, s.chats)
+}
+
+// next returns the option after current, wrapping around.
+func next(options []string, current string) string {
+	for i, o := range options {
+		if o == current {
+			return options[(i+1)%len(options)]
+		}
+	}
+	return options[0]
+}
+
+func onOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+func orOff(s string) string {
+	if s == "" {
+		return "off"
+	}
+	return s
+}
+
+// settingsMenu renders the settings of a chat and the buttons that change
+// them.
+func settingsMenu(cs *chatSettings) (string, tgbotapi.InlineKeyboardMarkup) {
+	text := "Settings for this chat. Press a button to change a setting."
+	button := func(label, value, action string) tgbotapi.InlineKeyboardButton {
+		return tgbotapi.NewInlineKeyboardButtonData(fmt.Sprintf("%s: %s", label, value), "settings:"+action)
+	}
+
+	keyboard := tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(button("Silent", onOff(cs.Silent), "silent")),
+		tgbotapi.NewInlineKeyboardRow(button("Timezone", cs.Timezone, "timezone")),
+		tgbotapi.NewInlineKeyboardRow(button("Quiet hours", orOff(cs.QuietHours), "quiet")),
+		tgbotapi.NewInlineKeyboardRow(button("During quiet hours", cs.QuietMode, "quietmode")),
+		tgbotapi.NewInlineKeyboardRow(button("Format", cs.Format, "format")),
+		tgbotapi.NewInlineKeyboardRow(button("Digest", orOff(cs.Digest), "digest")),
+		tgbotapi.NewInlineKeyboardRow(button("Summary language", cs.Language, "language")),
+	)
+	return text, keyboard
+}
+
+// refreshSettingsMenu redraws a settings menu after a change.
+func (b *Bot) refreshSettingsMenu(ctx context.Context, chatID int64, messageID int) {
+	text, keyboard := settingsMenu(b.settings.Get(chatID))
+	edit := tgbotapi.NewEditMessageText(chatID, messageID, text)
+	edit.ReplyMarkup = &keyboard
+	b.tg.SendContext(ctx, edit)
+}
+
+var settingsCmd = &botCommand{
+	Alias:       "settings",
+	Description: "Change how notifications are delivered to this chat",
+	Permission:  permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		text, keyboard := settingsMenu(b.settings.Get(req.ChatID()))
+		msg := tgbotapi.NewMessage(req.ChatID(), text)
+		msg.ReplyMarkup = keyboard
+		_, err := b.tg.SendContext(ctx, msg)
+		return err
+	},
+}
+
+var settingsCallback = &botCallback{
+	Prefix: "settings",
+	RunFunc: func(ctx context.Context, b *Bot, query *tgbotapi.CallbackQuery, args []string) error {
+		if query.Message == nil || len(args) != 1 {
+			return fmt.Errorf("malformed settings callback: %v", args)
+		}
+		chatID := query.Message.Chat.ID
+		userID := int64(query.From.ID)
+		if !b.access.Allowed(userID, chatID) {
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "You are not allowed to change settings here."))
+			return nil
+		}
+		menuID := query.Message.MessageID
+
+		var err error
+		switch args[0] {
+		case "silent":
+			_, err = b.settings.Update(chatID, func(cs *chatSettings) { cs.Silent = !cs.Silent })
+		case "quietmode":
+			_, err = b.settings.Update(chatID, func(cs *chatSettings) { cs.QuietMode = next(quietModes, cs.QuietMode) })
+		case "format":
+			_, err = b.settings.Update(chatID, func(cs *chatSettings) { cs.Format = next(formats, cs.Format) })
+		case "language":
+			_, err = b.settings.Update(chatID, func(cs *chatSettings) { cs.Language = next(languages, cs.Language) })
+		case "digest":
+			_, err = b.settings.Update(chatID, func(cs *chatSettings) {
+				cs.Digest = next(digestWindows, orOff(cs.Digest))
+				if cs.Digest == "off" {
+					cs.Digest = ""
+				}
+			})
+		case "timezone":
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, ""))
+			var choices [][]choice
+			for _, tz := range commonTimezones {
+				choices = append(choices, []choice{{Label: tz, Value: tz}})
+			}
+			conv := b.newConversation(chatID, userID, menuID)
+			return conv.PromptChoice(ctx, b, "Which timezone is this chat in? Pick one or send its name, e.g. Europe/Paris.", choices,
+				settingsTimezoneStep(menuID))
+		case "quiet":
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, ""))
+			conv := b.newConversation(chatID, userID, menuID)
+			return conv.PromptChoice(ctx, b, "When should notifications be quiet? Send a range like 22:00-07:00, "+
+				"optionally with days, e.g. mon-fri 22:00-07:00; sat,sun 23:00-10:00",
+				[][]choice{{{Label: "Turn off", Value: "off"}}}, settingsQuietStep(menuID))
+		default:
+			return fmt.Errorf("unknown setting: %q", args[0])
+		}
+		if err != nil {
+			return err
+		}
+
+		b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "Saved"))
+		b.refreshSettingsMenu(ctx, chatID, menuID)
+		return nil
+	},
+}
+
+func settingsTimezoneStep(menuID int) conversationStep {
+	var step conversationStep
+	step = func(ctx context.Context, b *Bot, conv *conversation, reply *conversationReply) error {
+		name := strings.TrimSpace(reply.Text)
+		if _, err := time.LoadLocation(name); err != nil || name == "" {
+			return conv.Prompt(ctx, b, fmt.Sprintf("I don't know the timezone %q, please try again or /cancel.", name), step)
+		}
+
+		_, err := b.settings.Update(conv.ChatID, func(cs *chatSettings) { cs.Timezone = name })
+		if err != nil {
+			return err
+		}
+		conv.End(ctx, b, fmt.Sprintf("Timezone set to %s.", name))
+		b.refreshSettingsMenu(ctx, conv.ChatID, menuID)
+		return nil
+	}
+	return step
+}
+
+func settingsQuietStep(menuID int) conversationStep {
+	var step conversationStep
+	step = func(ctx context.Context, b *Bot, conv *conversation, reply *conversationReply) error {
+		value := strings.TrimSpace(reply.Text)
+		if value == "off" {
+			value = ""
+		} else if _, err := parseQuietHours(value); err != nil {
+			return conv.Prompt(ctx, b, fmt.Sprintf("Sorry, %v. Please try again or /cancel.", err), step)
+		}
+
+		_, err := b.settings.Update(conv.ChatID, func(cs *chatSettings) { cs.QuietHours = value })
+		if err != nil {
+			return err
+		}
+		conv.End(ctx, b, fmt.Sprintf("Quiet hours set to %s.", orOff(value)))
+		b.refreshSettingsMenu(ctx, conv.ChatID, menuID)
+		return nil
+	}
+	return step
+}
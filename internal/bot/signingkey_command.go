@@ -0,0 +1,90 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/endocrimes/endobot/internal/audit"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var signingKeyCmd = &botCommand{
+	Alias:       "signingkey",
+	Description: "Create a key for signing API requests",
+	Args: []commandArg{
+		{Name: "name", Kind: argString, Optional: true},
+	},
+	Permission: permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		name := "unnamed"
+		if req.Has("name") {
+			name = req.String("name")
+		}
+		client, err := b.signing.NewClient(req.ChatID(), name, req.UserID())
+		if err != nil {
+			return err
+		}
+
+		text := fmt.Sprintf("Signing key %s\n\nCredential: `%s`\nSecret: `%s`\n\nSign requests as described in the endobot README.",
+			escapeMarkdown(client.Name), client.ID, client.Secret)
+		delivered, err := b.sendSecret(ctx, req.Message, text)
+		if !delivered {
+			if _, err := b.signing.DeleteClient(b.inChat(req.ChatID()), client.ID); err != nil {
+				b.logger.Error("failed to delete undelivered signing key", "client_id", client.ID, "error", err)
+			}
+			return err
+		}
+		b.RecordAudit(&audit.Entry{
+			Action:  audit.ActionSigningKeyCreated,
+			Actor:   userActor(req.UserID()),
+			ChatID:  req.ChatID(),
+			Details: map[string]interface{}{"client_id": client.ID, "name": client.Name},
+		})
+		return err
+	},
+	Subcommands: []*botCommand{
+		{
+			Alias: "list",
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				clients := b.signing.Clients(b.inChat(req.ChatID()))
+				if len(clients) == 0 {
+					b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), "There are no signing keys for this chat."))
+					return nil
+				}
+				var sb strings.Builder
+				sb.WriteString("Signing keys for this chat:\n")
+				for _, c := range clients {
+					fmt.Fprintf(&sb, "\n%s %s (created %s)", c.ID, c.Name, c.CreatedAt.Format("2006-01-02"))
+				}
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), sb.String()))
+				return nil
+			},
+		},
+		{
+			Alias: "delete",
+			Args: []commandArg{
+				{Name: "id", Kind: argString},
+			},
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				ok, err := b.signing.DeleteClient(b.inChat(req.ChatID()), req.String("id"))
+				if err != nil {
+					return err
+				}
+				reply := "Signing key deleted."
+				if !ok {
+					reply = "There is no signing key with that id in this chat."
+				} else {
+					b.RecordAudit(&audit.Entry{
+						Action:  audit.ActionSigningKeyDeleted,
+						Actor:   userActor(req.UserID()),
+						ChatID:  req.ChatID(),
+						Details: map[string]interface{}{"client_id": req.String("id")},
+					})
+				}
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), reply))
+				return nil
+			},
+		},
+	},
+}
@@ -3,19 +3,273 @@ package bot
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/endocrimes/endobot/internal/audit"
+	"github.com/endocrimes/endobot/internal/tokensigner"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
 var tokenCmd = &botCommand{
-	Alias: "token",
-	RunFunc: func(ctx context.Context, b *Bot, update tgbotapi.Update) error {
-		tokenBytes, err := b.tokenSigner.GenerateToken(update.Message.Chat, update.Message.From)
+	Alias:       "token",
+	Description: "Create an API token for this chat",
+	Args: []commandArg{
+		{Name: "cidr", Kind: argRest, Optional: true},
+	},
+	Permission: permAllowed,
+	RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+		opts := &tokensigner.TokenOptions{
+			AllowedCIDRs: req.Strings("cidr"),
+		}
+		if _, err := tokensigner.ParseCIDRs(opts.AllowedCIDRs); err != nil {
+			b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), fmt.Sprintf("%v. Usage: /token [cidr...]", err)))
+			return nil
+		}
+
+		tokenBytes, claims, err := b.tokenSigner.GenerateToken(req.Message.Chat, req.Message.From, opts)
 		if err != nil {
 			return err
 		}
 		token := string(tokenBytes)
-		b.tg.Send(tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Your token is: %s", token)))
+
+		var sb strings.Builder
+		if req.Message.Chat.IsPrivate() {
+			fmt.Fprintf(&sb, "Your token is: `%s`", token)
+		} else {
+			fmt.Fprintf(&sb, "Your token for %q is: `%s`", escapeMarkdown(req.Message.Chat.Title), token)
+		}
+		if len(opts.AllowedCIDRs) > 0 {
+			fmt.Fprintf(&sb, "\n\nIt can only be used from %s.", strings.Join(opts.AllowedCIDRs, ", "))
+		}
+		if b.cfg.PublicURL != "" {
+			fmt.Fprintf(&sb, "\n\n```\ncurl -X POST -H 'Authorization: %s' -d '{\"message\": \"hello\"}' %s/notify\n```",
+				token, strings.TrimSuffix(b.cfg.PublicURL, "/"))
+		}
+
+		delivered, err := b.sendSecret(ctx, req.Message, sb.String())
+		if !delivered {
+			// Nobody has the token, so it mustn't stay valid.
+			if err := b.tokenSigner.RevokeToken(claims.ID); err != nil {
+				b.logger.Error("failed to revoke undelivered token", "token_id", claims.ID, "error", err)
+			}
+			return err
+		}
+		b.RecordAudit(&audit.Entry{
+			Action:  audit.ActionTokenIssued,
+			Actor:   userActor(req.UserID()),
+			ChatID:  req.ChatID(),
+			Details: map[string]interface{}{"token_id": claims.ID, "allowed_cidrs": claims.AllowedCIDRs},
+		})
+		return err
+	},
+}
+
+// sendSecret delivers text, which contains a credential, to the sender of
+// msg, reporting whether it was delivered. Secrets requested in a group are
+// sent privately so other members don't see them, and every secret is
+// deleted after the configured TTL. Callers should revoke the credential
+// when it wasn't delivered.
+func (b *Bot) sendSecret(ctx context.Context, msg *tgbotapi.Message, text string) (bool, error) {
+	if b.cfg.TokenMessageTTL > 0 {
+		text += fmt.Sprintf("\n\nThis message will be deleted in %s.", b.cfg.TokenMessageTTL)
+	}
+
+	dest := msg.Chat.ID
+	if !msg.Chat.IsPrivate() {
+		dest = int64(msg.From.ID)
+	}
+
+	m := tgbotapi.NewMessage(dest, text)
+	m.ParseMode = tgbotapi.ModeMarkdown
+	sent, err := b.tg.SendContext(ctx, m)
+	if err != nil {
+		if dest == msg.Chat.ID {
+			return false, err
+		}
+		// Bots can only message users that have started a chat with them.
+		b.logger.Info("failed to send secret privately", "user_id", msg.From.ID, "error", err)
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(msg.Chat.ID,
+			fmt.Sprintf("I couldn't message you privately. Please start a chat with @%s and try again.", b.tg.Self.UserName)))
+		return false, nil
+	}
+	b.deleteAfter(dest, sent.MessageID, b.cfg.TokenMessageTTL)
+
+	if dest != msg.Chat.ID {
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(msg.Chat.ID, "I've sent you the details in a private message."))
+	}
+	return true, nil
+}
+
+var tokenCallback = &botCallback{
+	Prefix: "token",
+	RunFunc: func(ctx context.Context, b *Bot, query *tgbotapi.CallbackQuery, args []string) error {
+		if len(args) != 2 || args[0] != "revoke" {
+			return fmt.Errorf("malformed token callback: %v", args)
+		}
+		if query.Message == nil || !b.access.Allowed(int64(query.From.ID), query.Message.Chat.ID) {
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "You are not allowed to do that."))
+			return nil
+		}
+
+		// Callback data comes from the client, so the token must belong to
+		// the chat the button was pressed in.
+		rec := b.registry.Get(args[1])
+		if rec == nil || b.chats.Resolve(rec.ChatID) != b.chats.Resolve(query.Message.Chat.ID) {
+			b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "There is no token with that id in this chat."))
+			return nil
+		}
+
+		err := b.tokenSigner.RevokeToken(rec.ID)
+		if err != nil {
+			return err
+		}
+		b.logger.Info("token revoked", "token_id", rec.ID, "user_id", query.From.ID)
+		b.RecordAudit(&audit.Entry{
+			Action:  audit.ActionTokenRevoked,
+			Actor:   userActor(int64(query.From.ID)),
+			ChatID:  query.Message.Chat.ID,
+			Details: map[string]interface{}{"token_id": rec.ID},
+		})
+
+		b.tg.AnswerCallbackQueryContext(ctx, tgbotapi.NewCallback(query.ID, "Token revoked"))
+		b.tg.SendContext(ctx, tgbotapi.NewEditMessageText(query.Message.Chat.ID, query.Message.MessageID,
+			fmt.Sprintf("%s\n\nRevoked by %s.", query.Message.Text, displayName(query.From))))
 		return nil
 	},
 }
+
+// tokenAlertInterval is the least time between two alerts about the same
+// token. New addresses seen in between are listed together in the next one.
+const tokenAlertInterval = 10 * time.Minute
+
+// maxAlertAddrs bounds how many addresses a single alert lists.
+const maxAlertAddrs = 10
+
+type tokenAlert struct {
+	claims *tokensigner.Claims
+	addrs  []string
+	more   int
+	sentAt time.Time
+}
+
+// tokenAlerts collects the new addresses tokens are used from, so that each
+// token alerts its chat at most once per interval however many addresses it
+// is used from.
+type tokenAlerts struct {
+	interval time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]*tokenAlert
+}
+
+func newTokenAlerts(interval time.Duration) *tokenAlerts {
+	return &tokenAlerts{
+		interval: interval,
+		tokens:   make(map[string]*tokenAlert),
+	}
+}
+
+// Add records that claims was used from a new address at now, returning an
+// alert if one may be sent straight away.
+func (a *tokenAlerts) Add(claims *tokensigner.Claims, addr string, now time.Time) *tokenAlert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	alert, ok := a.tokens[claims.ID]
+	if !ok {
+		alert = &tokenAlert{}
+		a.tokens[claims.ID] = alert
+	}
+	alert.claims = claims
+	if len(alert.addrs) < maxAlertAddrs {
+		alert.addrs = append(alert.addrs, addr)
+	} else {
+		alert.more++
+	}
+	return a.takeLocked(alert, now)
+}
+
+// Due returns the alerts held back by the interval that may be sent at now.
+func (a *tokenAlerts) Due(now time.Time) []*tokenAlert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var out []*tokenAlert
+	for id, alert := range a.tokens {
+		if len(alert.addrs) == 0 {
+			if now.Sub(alert.sentAt) >= a.interval {
+				delete(a.tokens, id)
+			}
+			continue
+		}
+		if due := a.takeLocked(alert, now); due != nil {
+			out = append(out, due)
+		}
+	}
+	return out
+}
+
+func (a *tokenAlerts) takeLocked(alert *tokenAlert, now time.Time) *tokenAlert {
+	if !alert.sentAt.IsZero() && now.Sub(alert.sentAt) < a.interval {
+		return nil
+	}
+	due := &tokenAlert{claims: alert.claims, addrs: alert.addrs, more: alert.more, sentAt: now}
+	alert.addrs, alert.more, alert.sentAt = nil, 0, now
+	return due
+}
+
+// AlertTokenUse warns the chat a token belongs to that it was used from an
+// address it hasn't been seen at before, offering to revoke it. It doesn't
+// wait for the alert to be sent, and addresses seen within
+// tokenAlertInterval of the last alert wait for the next one.
+func (b *Bot) AlertTokenUse(claims *tokensigner.Claims, addr string, rejected bool) {
+	if rejected {
+		addr += " (rejected, not in the token's allowlist)"
+	}
+	if alert := b.tokenAlerts.Add(claims, addr, time.Now()); alert != nil {
+		go b.sendTokenAlert(alert)
+	}
+}
+
+// flushTokenAlerts sends the alerts that were held back by the interval.
+func (b *Bot) flushTokenAlerts(now time.Time) {
+	for _, alert := range b.tokenAlerts.Due(now) {
+		b.sendTokenAlert(alert)
+	}
+}
+
+func (b *Bot) sendTokenAlert(alert *tokenAlert) {
+	claims := alert.claims
+	owner := fmt.Sprintf("user %d", claims.UserID)
+	if claims.Username != "" {
+		owner = "@" + claims.Username
+	}
+	addrs := strings.Join(alert.addrs, ", ")
+	if alert.more > 0 {
+		addrs += fmt.Sprintf(" and %d more", alert.more)
+	}
+	what := "a new address"
+	if len(alert.addrs) > 1 {
+		what = "new addresses"
+	}
+	text := fmt.Sprintf("A token for this chat issued to %s (id %s) was used from %s: %s. If this wasn't you, revoke the token.",
+		owner, claims.ID, what, addrs)
+
+	msg := tgbotapi.NewMessage(claims.ChatID, text)
+	msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData("Revoke this token", "token:revoke:"+claims.ID),
+	))
+	_, err := b.tg.SendIn(laneUrgent, msg)
+	if err != nil {
+		b.logger.Error("failed to send token alert", "token_id", claims.ID, "error", err)
+	}
+}
+
+var markdownEscaper = strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[")
+
+// escapeMarkdown escapes user supplied text for use in a Markdown message.
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
@@ -0,0 +1,193 @@
+package bot
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/audit"
+	"github.com/endocrimes/endobot/internal/scheduler"
+	"github.com/endocrimes/endobot/internal/store"
+	"github.com/endocrimes/endobot/internal/tokensigner"
+)
+
+func issuedTokens(b *Bot) []*tokensigner.TokenRecord {
+	return b.registry.List(func(*tokensigner.TokenRecord) bool { return true })
+}
+
+func TestTokenDelivery(t *testing.T) {
+	cases := []struct {
+		name      string
+		chatID    int64
+		blocked   bool
+		delivered bool
+		reply     string
+	}{
+		{name: "private chat", chatID: testAllowed, delivered: true, reply: "Your token is"},
+		{name: "group", chatID: testGroup, delivered: true, reply: "sent you the details"},
+		{name: "group without a private chat", chatID: testGroup, blocked: true, reply: "couldn't message you privately"},
+	}
+	for _, tc := range cases {
+		b, fake := newTestBot(t, openTestStore(t), &Config{
+			AllowedUsers:    []int64{testAllowed},
+			TokenMessageTTL: 5 * time.Minute,
+		})
+		if tc.blocked {
+			fake.fail = func(method string, params url.Values) string {
+				if params.Get("chat_id") == strconv.Itoa(testAllowed) {
+					return "Forbidden: bot can't initiate conversation with a user"
+				}
+				return ""
+			}
+		}
+		b.handleUpdate(messageUpdate(tc.chatID, testAllowed, "/token"))
+
+		if got := fake.LastMessage(tc.chatID); !strings.Contains(got, tc.reply) {
+			t.Errorf("%s: replied %q, want it to contain %q", tc.name, got, tc.reply)
+		}
+		tokens := issuedTokens(b)
+		if len(tokens) != 1 {
+			t.Fatalf("%s: got %d tokens, want 1", tc.name, len(tokens))
+		}
+		if tokens[0].Revoked == tc.delivered {
+			t.Errorf("%s: got revoked %v, want %v", tc.name, tokens[0].Revoked, !tc.delivered)
+		}
+		issued := b.audit.Find(audit.Query{Action: audit.ActionTokenIssued})
+		if (len(issued) == 1) != tc.delivered {
+			t.Errorf("%s: got %d issued audit entries", tc.name, len(issued))
+		}
+
+		deletions := b.jobs.List(func(job *scheduler.Job) bool { return job.Kind == jobDeleteMessage })
+		if !tc.delivered {
+			if len(deletions) != 0 {
+				t.Errorf("%s: scheduled deletions for an undelivered token", tc.name)
+			}
+			continue
+		}
+		if len(deletions) != 1 || deletions[0].ChatID != testAllowed {
+			t.Errorf("%s: got deletions %v, want one in the private chat", tc.name, deletions)
+		} else if wait := time.Until(deletions[0].RunAt); wait < 4*time.Minute || wait > 5*time.Minute {
+			t.Errorf("%s: the message is deleted in %v, want the TTL", tc.name, wait)
+		}
+	}
+}
+
+func TestTokenMessageDeletedAfterRestart(t *testing.T) {
+	st, dir := openTestDir(t)
+	cfg := &Config{AllowedUsers: []int64{testAllowed}, TokenMessageTTL: time.Millisecond}
+	b, fake := newTestBot(t, st, cfg)
+	b.handleUpdate(messageUpdate(testAllowed, testAllowed, "/token"))
+	sent := fake.Calls("sendMessage")
+	if len(sent) != 1 {
+		t.Fatalf("got %d messages, want the token", len(sent))
+	}
+	// The fake numbers messages by the calls made so far.
+	messageID := fake.nextID
+
+	// The bot is down when the deletion comes due.
+	time.Sleep(10 * time.Millisecond)
+	st, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, fake = newTestBot(t, st, cfg)
+	ctx, cancelFn := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFn()
+	b.jobs.Run(ctx, b.runJob)
+
+	deleted := fake.Calls("deleteMessage")
+	if len(deleted) != 1 {
+		t.Fatalf("got %d deletions, want the token message deleted", len(deleted))
+	}
+	if deleted[0].Get("chat_id") != strconv.Itoa(testAllowed) || deleted[0].Get("message_id") != strconv.Itoa(messageID) {
+		t.Errorf("deleted %v, want message %d in the private chat", deleted[0], messageID)
+	}
+	if jobs := b.jobs.List(func(*scheduler.Job) bool { return true }); len(jobs) != 0 {
+		t.Errorf("%d jobs are left", len(jobs))
+	}
+}
+
+func TestUndeliveredCredentialsAreDeleted(t *testing.T) {
+	b, fake := newTestBot(t, openTestStore(t), &Config{AllowedUsers: []int64{testAllowed}})
+	fake.fail = func(method string, params url.Values) string {
+		if params.Get("chat_id") == strconv.Itoa(testAllowed) {
+			return "Forbidden: bot can't initiate conversation with a user"
+		}
+		return ""
+	}
+
+	b.handleUpdate(messageUpdate(testGroup, testAllowed, "/signingkey ci"))
+	if clients := b.signing.Clients(b.inChat(testGroup)); len(clients) != 0 {
+		t.Errorf("kept %d undelivered signing keys", len(clients))
+	}
+	b.handleUpdate(messageUpdate(testGroup, testAllowed, "/webhook new grafana"))
+	if hooks := b.webhooks.List(b.inChat(testGroup)); len(hooks) != 0 {
+		t.Errorf("kept %d undelivered webhooks", len(hooks))
+	}
+	if entries := b.audit.Find(audit.Query{}); len(entries) != 0 {
+		t.Errorf("audited undelivered credentials as created: %v", entries)
+	}
+}
+
+func TestTokenAlertsAreBatched(t *testing.T) {
+	b, fake := newTestBot(t, openTestStore(t), &Config{})
+	claims := &tokensigner.Claims{ID: "tok", ChatID: testAllowed, UserID: testAllowed}
+	now := time.Now()
+
+	if alert := b.tokenAlerts.Add(claims, "192.0.2.1", now); alert == nil {
+		t.Fatal("the first new address didn't alert")
+	}
+	for _, addr := range []string{"192.0.2.2", "192.0.2.3"} {
+		if alert := b.tokenAlerts.Add(claims, addr, now.Add(time.Minute)); alert != nil {
+			t.Fatalf("%s alerted within the interval", addr)
+		}
+	}
+	b.flushTokenAlerts(now.Add(5 * time.Minute))
+	if got := fake.Messages(testAllowed); len(got) != 0 {
+		t.Fatalf("alerts were sent within the interval: %q", got)
+	}
+
+	b.flushTokenAlerts(now.Add(tokenAlertInterval))
+	got := fake.Messages(testAllowed)
+	if len(got) != 1 || !strings.Contains(got[0], "192.0.2.2, 192.0.2.3") {
+		t.Fatalf("got %q, want one alert listing both held back addresses", got)
+	}
+	b.flushTokenAlerts(now.Add(3 * tokenAlertInterval))
+	if got := fake.Messages(testAllowed); len(got) != 1 {
+		t.Fatalf("an alert was sent again: %q", got)
+	}
+	if len(b.tokenAlerts.tokens) != 0 {
+		t.Fatal("an idle token wasn't forgotten")
+	}
+}
+
+func TestAlertTokenUseDoesNotBlock(t *testing.T) {
+	b, fake := newTestBot(t, openTestStore(t), &Config{})
+	sent := make(chan struct{})
+	release := make(chan struct{})
+	fake.fail = func(method string, params url.Values) string {
+		close(sent)
+		<-release
+		return ""
+	}
+	defer close(release)
+
+	returned := make(chan struct{})
+	go func() {
+		b.AlertTokenUse(&tokensigner.Claims{ID: "tok", ChatID: testAllowed}, "192.0.2.1", true)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("AlertTokenUse waited for the alert to be sent")
+	}
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the alert wasn't sent")
+	}
+}
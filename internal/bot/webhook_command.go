@@ -0,0 +1,141 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/endocrimes/endobot/internal/audit"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+var webhookCmd = &botCommand{
+	Alias:       "webhook",
+	Description: "Manage incoming webhooks for this chat",
+	Permission:  permAllowed,
+	Subcommands: []*botCommand{
+		{
+			Alias: "list",
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				hooks := b.webhooks.List(b.inChat(req.ChatID()))
+				if len(hooks) == 0 {
+					b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), "There are no webhooks for this chat."))
+					return nil
+				}
+				var sb strings.Builder
+				sb.WriteString("Webhooks for this chat:\n")
+				for _, h := range hooks {
+					fmt.Fprintf(&sb, "\n%s (created %s, key from %s)", h.Name,
+						h.CreatedAt.Format("2006-01-02"), h.RotatedAt.Format("2006-01-02"))
+				}
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), sb.String()))
+				return nil
+			},
+		},
+		{
+			Alias: "new",
+			Args: []commandArg{
+				{Name: "name", Kind: argString, Optional: true},
+			},
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				if req.Has("name") {
+					return b.createWebhook(ctx, req.Message, req.String("name"))
+				}
+
+				conv := b.startConversation(req)
+				return conv.Prompt(ctx, b, "What should the webhook be called? Send /cancel to stop.", webhookNameStep)
+			},
+		},
+		{
+			Alias: "rotate",
+			Args: []commandArg{
+				{Name: "name", Kind: argString},
+			},
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				hook, key, err := b.webhooks.Rotate(b.inChat(req.ChatID()), req.String("name"))
+				if err != nil {
+					b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), err.Error()))
+					return nil
+				}
+				b.RecordAudit(&audit.Entry{
+					Action:  audit.ActionWebhookRotated,
+					Actor:   userActor(req.UserID()),
+					ChatID:  req.ChatID(),
+					Details: map[string]interface{}{"webhook_id": hook.ID, "name": hook.Name},
+				})
+				// The old key stopped working either way, so an undelivered
+				// key is left for the next rotation to replace.
+				_, err = b.sendSecret(ctx, req.Message, webhookMessage(b, "Rotated the key of webhook", hook.Name, key))
+				return err
+			},
+		},
+		{
+			Alias: "delete",
+			Args: []commandArg{
+				{Name: "name", Kind: argString},
+			},
+			RunFunc: func(ctx context.Context, b *Bot, req *commandRequest) error {
+				ok, err := b.webhooks.Delete(b.inChat(req.ChatID()), req.String("name"))
+				if err != nil {
+					return err
+				}
+				reply := "Webhook deleted."
+				if !ok {
+					reply = fmt.Sprintf("There is no webhook called %q.", req.String("name"))
+				} else {
+					b.RecordAudit(&audit.Entry{
+						Action:  audit.ActionWebhookDeleted,
+						Actor:   userActor(req.UserID()),
+						ChatID:  req.ChatID(),
+						Details: map[string]interface{}{"name": req.String("name")},
+					})
+				}
+				b.tg.SendContext(ctx, tgbotapi.NewMessage(req.ChatID(), reply))
+				return nil
+			},
+		},
+	},
+}
+
+// webhookNameStep asks for the name of a new webhook until it gets a valid
+// one.
+func webhookNameStep(ctx context.Context, b *Bot, conv *conversation, reply *conversationReply) error {
+	name := strings.TrimSpace(reply.Text)
+	if reply.Message == nil || name == "" || strings.ContainsAny(name, " \t\n") {
+		return conv.Prompt(ctx, b, "Please send a single word name, or /cancel.", webhookNameStep)
+	}
+	return b.createWebhook(ctx, reply.Message, name)
+}
+
+func (b *Bot) createWebhook(ctx context.Context, msg *tgbotapi.Message, name string) error {
+	hook, key, err := b.webhooks.Create(msg.Chat.ID, b.inChat(msg.Chat.ID), name, int64(msg.From.ID))
+	if err != nil {
+		b.tg.SendContext(ctx, tgbotapi.NewMessage(msg.Chat.ID, err.Error()))
+		return nil
+	}
+
+	delivered, err := b.sendSecret(ctx, msg, webhookMessage(b, "Created webhook", hook.Name, key))
+	if !delivered {
+		// Free the name so the webhook can be created again.
+		if _, err := b.webhooks.Delete(b.inChat(msg.Chat.ID), hook.Name); err != nil {
+			b.logger.Error("failed to delete undelivered webhook", "webhook_id", hook.ID, "error", err)
+		}
+		return err
+	}
+	b.RecordAudit(&audit.Entry{
+		Action:  audit.ActionWebhookCreated,
+		Actor:   userActor(int64(msg.From.ID)),
+		ChatID:  msg.Chat.ID,
+		Details: map[string]interface{}{"webhook_id": hook.ID, "name": hook.Name},
+	})
+	return err
+}
+
+func webhookMessage(b *Bot, action, name, key string) string {
+	url := "/in/" + key
+	if b.cfg.PublicURL != "" {
+		url = strings.TrimSuffix(b.cfg.PublicURL, "/") + url
+	}
+	return fmt.Sprintf("%s %s.\n\nURL: `%s`\n\nThe key can also be sent as `Authorization: Key %s`. It is only shown once.",
+		action, escapeMarkdown(name), url, key)
+}
@@ -0,0 +1,237 @@
+package bot
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultReminderMinute is the time of day used when a date is given
+// without one.
+const defaultReminderMinute = 9 * 60
+
+var clockPattern = regexp.MustCompile(`^(\d{1,2})(?::(\d{2}))?(am|pm)?$`)
+
+// recurrence repeats a reminder at a time of day on some days of the week.
+type recurrence struct {
+	Days   [7]bool `json:"days"`
+	Minute int     `json:"minute"`
+}
+
+// next returns the first occurrence after t, in loc.
+func (r *recurrence) next(t time.Time, loc *time.Location) time.Time {
+	local := t.In(loc)
+	for i := 0; i <= 7; i++ {
+		day := time.Date(local.Year(), local.Month(), local.Day()+i, r.Minute/60, r.Minute%60, 0, 0, loc)
+		if r.Days[day.Weekday()] && day.After(t) {
+			return day
+		}
+	}
+	// Unreachable with at least one day set.
+	return time.Time{}
+}
+
+func (r *recurrence) String() string {
+	names := []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"}
+	var days []string
+	for d, ok := range r.Days {
+		if ok {
+			days = append(days, names[d])
+		}
+	}
+	when := strings.Join(days, ", ")
+	if len(days) == 7 {
+		when = "day"
+	}
+	return fmt.Sprintf("every %s at %02d:%02d", when, r.Minute/60, r.Minute%60)
+}
+
+// parseWhen parses a time from the start of fields, such as "in 20m",
+// "tomorrow 9am", "every monday 10:00" or "on 2026-12-01 at 18:30". Times
+// are in loc. It returns when the reminder is first due, how it repeats if
+// it does, and the fields that follow the time.
+func parseWhen(fields []string, now time.Time, loc *time.Location) (time.Time, *recurrence, []string, error) {
+	if len(fields) == 0 {
+		return time.Time{}, nil, nil, fmt.Errorf("missing a time")
+	}
+	local := now.In(loc)
+	today := func(days, minute int) time.Time {
+		return time.Date(local.Year(), local.Month(), local.Day()+days, minute/60, minute%60, 0, 0, loc)
+	}
+
+	word := strings.ToLower(fields[0])
+	rest := fields[1:]
+	switch word {
+	case "in":
+		d, rest, err := parseFieldsDuration(rest)
+		if err != nil {
+			return time.Time{}, nil, nil, err
+		}
+		return now.Add(d), nil, rest, nil
+
+	case "at":
+		minute, rest, err := parseFieldsClock(fields)
+		if err != nil {
+			return time.Time{}, nil, nil, err
+		}
+		at := today(0, minute)
+		if !at.After(now) {
+			at = today(1, minute)
+		}
+		return at, nil, rest, nil
+
+	case "today", "tomorrow":
+		minute, rest, err := parseFieldsClock(rest)
+		if err != nil && word == "today" {
+			return time.Time{}, nil, nil, err
+		}
+		if err != nil {
+			minute, rest = defaultReminderMinute, fields[1:]
+		}
+		days := 0
+		if word == "tomorrow" {
+			days = 1
+		}
+		at := today(days, minute)
+		if !at.After(now) {
+			return time.Time{}, nil, nil, fmt.Errorf("%s is in the past", at.Format("15:04"))
+		}
+		return at, nil, rest, nil
+
+	case "every":
+		if len(rest) == 0 {
+			return time.Time{}, nil, nil, fmt.Errorf("missing the days after every")
+		}
+		days, err := parseRecurrenceDays(rest[0])
+		if err != nil {
+			return time.Time{}, nil, nil, err
+		}
+		minute, after, err := parseFieldsClock(rest[1:])
+		if err != nil {
+			minute, after = defaultReminderMinute, rest[1:]
+		}
+		rec := &recurrence{Days: days, Minute: minute}
+		return rec.next(now, loc), rec, after, nil
+
+	case "on":
+		if len(rest) == 0 {
+			return time.Time{}, nil, nil, fmt.Errorf("missing a date after on")
+		}
+		word, rest = strings.ToLower(rest[0]), rest[1:]
+	}
+
+	// A date or day of the week, optionally followed by a time.
+	var date time.Time
+	if d, err := time.ParseInLocation("2006-01-02", word, loc); err == nil {
+		date = d
+	} else if wd, ok := weekdays[word]; ok {
+		offset := (int(wd) - int(local.Weekday()) + 7) % 7
+		date = today(offset, 0)
+	} else {
+		return time.Time{}, nil, nil, fmt.Errorf("I don't understand when %q is", strings.Join(fields, " "))
+	}
+
+	minute, after, err := parseFieldsClock(rest)
+	if err != nil {
+		minute, after = defaultReminderMinute, rest
+	}
+	at := time.Date(date.Year(), date.Month(), date.Day(), minute/60, minute%60, 0, 0, loc)
+	if !at.After(now) {
+		if _, ok := weekdays[word]; !ok {
+			return time.Time{}, nil, nil, fmt.Errorf("%s is in the past", at.Format("Jan 2 15:04"))
+		}
+		at = at.AddDate(0, 0, 7)
+	}
+	return at, nil, after, nil
+}
+
+// parseFieldsDuration parses a duration such as "20m", "1h30m", "2d" or
+// "3 hours" from the start of fields.
+func parseFieldsDuration(fields []string) (time.Duration, []string, error) {
+	if len(fields) == 0 {
+		return 0, nil, fmt.Errorf("missing a duration")
+	}
+
+	s := strings.ToLower(fields[0])
+	if strings.HasSuffix(s, "d") {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && n > 0 {
+			return time.Duration(n) * 24 * time.Hour, fields[1:], nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return d, fields[1:], nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 || len(fields) < 2 {
+		return 0, nil, fmt.Errorf("%q is not a duration like 20m or 3 hours", s)
+	}
+	units := map[string]time.Duration{
+		"minute": time.Minute, "minutes": time.Minute, "min": time.Minute, "mins": time.Minute,
+		"hour": time.Hour, "hours": time.Hour,
+		"day": 24 * time.Hour, "days": 24 * time.Hour,
+		"week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+	}
+	unit, ok := units[strings.ToLower(fields[1])]
+	if !ok {
+		return 0, nil, fmt.Errorf("%q is not a unit of time", fields[1])
+	}
+	return time.Duration(n) * unit, fields[2:], nil
+}
+
+// parseFieldsClock parses a time of day such as "9am", "18:30" or "at 7"
+// from the start of fields, returning minutes since midnight. Without "at"
+// the time must include minutes or am/pm, so numbers in the reminder text
+// aren't mistaken for times.
+func parseFieldsClock(fields []string) (int, []string, error) {
+	explicit := len(fields) > 0 && strings.EqualFold(fields[0], "at")
+	if explicit {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return 0, nil, fmt.Errorf("missing a time")
+	}
+
+	s := strings.ToLower(fields[0])
+	switch s {
+	case "noon":
+		return 12 * 60, fields[1:], nil
+	case "midnight":
+		return 0, fields[1:], nil
+	}
+
+	m := clockPattern.FindStringSubmatch(s)
+	if m == nil || (!explicit && m[2] == "" && m[3] == "") {
+		return 0, nil, fmt.Errorf("%q is not a time like 9am or 18:30", fields[0])
+	}
+	hour, _ := strconv.Atoi(m[1])
+	minute, _ := strconv.Atoi(m[2])
+	if hour > 23 || minute > 59 || (m[3] != "" && (hour < 1 || hour > 12)) {
+		return 0, nil, fmt.Errorf("%q is not a time of day", fields[0])
+	}
+	switch m[3] {
+	case "am":
+		if hour == 12 {
+			hour = 0
+		}
+	case "pm":
+		if hour < 12 {
+			hour += 12
+		}
+	}
+	return hour*60 + minute, fields[1:], nil
+}
+
+func parseRecurrenceDays(s string) ([7]bool, error) {
+	switch strings.ToLower(s) {
+	case "day":
+		return parseDays("daily")
+	case "weekday":
+		return parseDays("weekdays")
+	case "weekend":
+		return parseDays("weekends")
+	}
+	return parseDays(s)
+}
@@ -0,0 +1,116 @@
+package bot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseWhen(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	// Monday, 14:00 in Berlin.
+	now := time.Date(2026, 10, 19, 14, 0, 0, 0, loc)
+	at := func(month time.Month, day, hour, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, loc)
+	}
+
+	cases := []struct {
+		in       string
+		want     time.Time
+		repeats  string
+		wantRest string
+	}{
+		{in: "in 20m stretch", want: now.Add(20 * time.Minute), wantRest: "stretch"},
+		{in: "in 3 hours stretch", want: now.Add(3 * time.Hour), wantRest: "stretch"},
+		{in: "in 2d call mum", want: now.Add(48 * time.Hour), wantRest: "call mum"},
+		{in: "at 18:30 cook", want: at(10, 19, 18, 30), wantRest: "cook"},
+		// Times that have passed today are tomorrow.
+		{in: "at 9 standup", want: at(10, 20, 9, 0), wantRest: "standup"},
+		{in: "today 5pm gym", want: at(10, 19, 17, 0), wantRest: "gym"},
+		{in: "tomorrow 9am dentist", want: at(10, 20, 9, 0), wantRest: "dentist"},
+		// Numbers in the text aren't mistaken for times.
+		{in: "tomorrow 2 coffees", want: at(10, 20, 9, 0), wantRest: "2 coffees"},
+		{in: "on 2026-12-01 at 18:30 party", want: at(12, 1, 18, 30), wantRest: "party"},
+		{in: "on 2026-12-01 party", want: at(12, 1, 9, 0), wantRest: "party"},
+		{in: "friday noon lunch", want: at(10, 23, 12, 0), wantRest: "lunch"},
+		// Today's day of the week once its time has passed is next week.
+		{in: "monday 10:00 plan", want: at(10, 26, 10, 0), wantRest: "plan"},
+		// After the switch back to winter time, still at 10:00 local.
+		{
+			in:       "every monday 10:00 review",
+			want:     at(10, 26, 10, 0),
+			repeats:  "every monday at 10:00",
+			wantRest: "review",
+		},
+		{in: "every weekday water plants", want: at(10, 20, 9, 0), repeats: "every monday, tuesday, wednesday, thursday, friday at 09:00", wantRest: "water plants"},
+		{in: "every day 9pm", want: at(10, 19, 21, 0), repeats: "every day at 21:00"},
+	}
+	for _, tc := range cases {
+		got, rec, rest, err := parseWhen(strings.Fields(tc.in), now, loc)
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if !got.Equal(tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.in, got, tc.want)
+		}
+		repeats := ""
+		if rec != nil {
+			repeats = rec.String()
+		}
+		if repeats != tc.repeats {
+			t.Errorf("%q: repeats %q, want %q", tc.in, repeats, tc.repeats)
+		}
+		if strings.Join(rest, " ") != tc.wantRest {
+			t.Errorf("%q: left %q, want %q", tc.in, rest, tc.wantRest)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"in",
+		"in soon",
+		"in 3 fortnights",
+		"today 9am",
+		"today stretch",
+		"on 2026-01-01 party",
+		"at 25:00",
+		"at 13pm",
+		"every",
+		"every someday",
+		"whenever",
+	} {
+		if _, _, _, err := parseWhen(strings.Fields(in), now, loc); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestRecurrenceNext(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	rec := &recurrence{Days: [7]bool{time.Saturday: true, time.Sunday: true}, Minute: 2*60 + 30}
+
+	got := []time.Time{}
+	at := time.Date(2026, 3, 27, 12, 0, 0, 0, loc)
+	for i := 0; i < 3; i++ {
+		at = rec.next(at, loc)
+		got = append(got, at)
+	}
+	// 02:30 doesn't exist on the day summer time starts, and moves to
+	// 03:30.
+	want := []time.Time{
+		time.Date(2026, 3, 28, 2, 30, 0, 0, loc),
+		time.Date(2026, 3, 29, 3, 30, 0, 0, loc),
+		time.Date(2026, 4, 4, 2, 30, 0, 0, loc),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
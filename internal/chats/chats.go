@@ -0,0 +1,114 @@
+// Package chats keeps track of changes to Telegram chats that outlive the
+// credentials bound to them, such as groups being upgraded to supergroups
+// (which changes their ID) or users blocking the bot.
+package chats
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+)
+
+const (
+	chatsDocument = "chats"
+
+	// maxMigrations bounds how many migrations Resolve follows, guarding
+	// against cycles.
+	maxMigrations = 8
+)
+
+type chatState struct {
+	// Migrations maps old chat IDs to the ID the chat migrated to.
+	Migrations map[int64]int64 `json:"migrations"`
+
+	// Blocked records when sending to a chat last failed because the bot
+	// was blocked or removed.
+	Blocked map[int64]time.Time `json:"blocked"`
+}
+
+type Directory struct {
+	store *store.Store
+
+	mu    sync.Mutex
+	state chatState
+}
+
+func NewDirectory(st *store.Store) (*Directory, error) {
+	d := &Directory{
+		store: st,
+		state: chatState{
+			Migrations: make(map[int64]int64),
+			Blocked:    make(map[int64]time.Time),
+		},
+	}
+
+	err := st.Load(chatsDocument, &d.state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load chats: %v", err)
+	}
+
+	return d, nil
+}
+
+// Migrate records that the chat from is now known as to.
+func (d *Directory) Migrate(from, to int64) error {
+	if from == to || to == 0 {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.state.Migrations[from] == to {
+		return nil
+	}
+	d.state.Migrations[from] = to
+	return d.store.Save(chatsDocument, &d.state)
+}
+
+// Resolve returns the current ID of a chat, following any migrations.
+func (d *Directory) Resolve(id int64) int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := 0; i < maxMigrations; i++ {
+		next, ok := d.state.Migrations[id]
+		if !ok {
+			break
+		}
+		id = next
+	}
+	return id
+}
+
+// MarkBlocked records that the bot can't deliver to id.
+func (d *Directory) MarkBlocked(id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.state.Blocked[id] = time.Now()
+	return d.store.Save(chatsDocument, &d.state)
+}
+
+// ClearBlocked records that the bot can deliver to id again.
+func (d *Directory) ClearBlocked(id int64) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.state.Blocked[id]; !ok {
+		return nil
+	}
+	delete(d.state.Blocked, id)
+	return d.store.Save(chatsDocument, &d.state)
+}
+
+// BlockedSince returns when delivery to id started failing, if it has.
+func (d *Directory) BlockedSince(id int64) (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.state.Blocked[id]
+	return t, ok
+}
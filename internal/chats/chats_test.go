@@ -0,0 +1,84 @@
+package chats
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/endocrimes/endobot/internal/store"
+)
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "chats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDirectory(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range [][2]int64{{-1, -100}, {-100, -200}, {-5, -5}, {-6, 0}, {-7, -8}, {-8, -7}} {
+		if err := d.Migrate(m[0], m[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Migrations are persisted.
+	d, err = NewDirectory(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		id, want int64
+	}{
+		{-1, -200},
+		{-100, -200},
+		{-200, -200},
+		{42, 42},
+		{-5, -5},
+		{-6, -6},
+	}
+	for _, tc := range cases {
+		if got := d.Resolve(tc.id); got != tc.want {
+			t.Errorf("%d: got %d, want %d", tc.id, got, tc.want)
+		}
+	}
+
+	// A cycle doesn't loop forever.
+	if got := d.Resolve(-7); got != -7 && got != -8 {
+		t.Errorf("got %d for a cycle", got)
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	st, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDirectory(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := d.BlockedSince(1); ok {
+		t.Fatal("a new chat is blocked")
+	}
+	if err := d.MarkBlocked(1); err != nil {
+		t.Fatal(err)
+	}
+	if since, ok := d.BlockedSince(1); !ok || since.IsZero() {
+		t.Fatal("the chat wasn't marked blocked")
+	}
+	if err := d.ClearBlocked(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.BlockedSince(1); ok {
+		t.Fatal("the chat is still blocked")
+	}
+}
@@ -9,7 +9,13 @@ import (
 
 	"github.com/endocrimes/endobot/internal/api"
 	"github.com/endocrimes/endobot/internal/bot"
+	"github.com/endocrimes/endobot/internal/chats"
+	"github.com/endocrimes/endobot/internal/dedupe"
+	"github.com/endocrimes/endobot/internal/hmacauth"
+	"github.com/endocrimes/endobot/internal/store"
+	"github.com/endocrimes/endobot/internal/tokensigner"
 	"github.com/endocrimes/endobot/internal/tokensigner/jwt"
+	"github.com/endocrimes/endobot/internal/webhook"
 	jwtlib "github.com/gbrlsnchs/jwt/v3"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	"github.com/hashicorp/go-hclog"
@@ -31,8 +37,29 @@ func RunCommand(c *cli.Context, logger hclog.Logger) error {
 	if jwtSecretStr == "" {
 		return fmt.Errorf("missing required argument: jwt-secret")
 	}
+	st, err := store.Open(c.String("data-dir"))
+	if err != nil {
+		return err
+	}
+
+	registry, err := tokensigner.NewRegistry(st)
+	if err != nil {
+		return err
+	}
+	signing, err := hmacauth.New(st, c.Duration("signature-max-skew"))
+	if err != nil {
+		return err
+	}
+	webhooks, err := webhook.NewRegistry(st)
+	if err != nil {
+		return err
+	}
+	chatDir, err := chats.NewDirectory(st)
+	if err != nil {
+		return err
+	}
 	jwtSecret := jwtlib.NewHS256([]byte(jwtSecretStr))
-	signer := &jwt.TokenSigner{Secret: jwtSecret}
+	signer := &jwt.TokenSigner{Secret: jwtSecret, Registry: registry, Chats: chatDir}
 
 	tg, err := tgbotapi.NewBotAPI(telegramToken)
 	if err != nil {
@@ -40,18 +67,56 @@ func RunCommand(c *cli.Context, logger hclog.Logger) error {
 	}
 	logger.Info("telegram initialized", "bot_username", tg.Self.UserName)
 
+	bot, err := bot.New(logger, tg, signer, registry, signing, webhooks, chatDir, st, &bot.Config{
+		Owners:           c.Int64Slice("owner"),
+		AllowedUsers:     c.Int64Slice("allow-user"),
+		AllowedChats:     c.Int64Slice("allow-chat"),
+		TokenMessageTTL:  c.Duration("token-message-ttl"),
+		PublicURL:        c.String("public-url"),
+		Workers:          c.Int("bot-workers"),
+		CommandTimeout:   c.Duration("command-timeout"),
+		MissedJobs:       c.String("missed-jobs"),
+		HistoryRetention: c.Duration("history-retention"),
+		TokenRetention:   c.Duration("token-retention"),
+		AuditRetention:   c.Duration("audit-retention"),
+		AuthFailureAlert: c.Int("auth-failure-alert"),
+		RateLimit:        c.String("rate-limit"),
+		DailyQuota:       c.Int("daily-quota"),
+		ChatRateLimit:    c.String("chat-rate-limit"),
+		ChatDailyQuota:   c.Int("chat-daily-quota"),
+	})
+	if err != nil {
+		return fmt.Errorf("bot setup failed: %v", err)
+	}
+
+	dd, err := dedupe.New(st, c.Duration("idempotency-window"))
+	if err != nil {
+		return err
+	}
+
+	srv, err := api.NewServer(logger, bot, signer, registry, signing, webhooks, dd, &api.Config{
+		TrustedProxies: c.StringSlice("trusted-proxy"),
+		RealIPHeader:   c.String("real-ip-header"),
+		UnixSocket:     c.String("unix-socket"),
+		UnixUsers:      c.StringSlice("unix-user"),
+		UnixGroups:     c.StringSlice("unix-group"),
+	})
+	if err != nil {
+		return fmt.Errorf("api setup failed: %v", err)
+	}
+
 	shutdownCtx, cancelFn := context.WithCancel(context.Background())
 	errCh := make(chan error, 2)
 
-	bot := bot.New(logger, tg, signer)
+	botDone := make(chan struct{})
 	go func() {
+		defer close(botDone)
 		err := bot.Run(shutdownCtx)
 		if err != nil {
 			errCh <- err
 		}
 	}()
 
-	srv := api.NewServer(logger, bot, signer)
 	go func() {
 		err := srv.Start(shutdownCtx, c.String("listen-addr"))
 		if err != nil {
@@ -72,6 +137,8 @@ func RunCommand(c *cli.Context, logger hclog.Logger) error {
 		cancelFn()
 		return err
 	case <-shutdownCtx.Done():
+		// Let the bot finish the updates it has already received.
+		<-botDone
 		return nil
 	}
 }
@@ -0,0 +1,142 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"30-10 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"* * * foo *",
+		"@reboot",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("%q: expected an error", spec)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// Monday.
+	from := time.Date(2026, 10, 19, 14, 7, 0, 0, time.UTC)
+	date := func(year int, month time.Month, day, hour, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"*/15 * * * *", from, date(2026, 10, 19, 14, 15)},
+		// Next is strictly after the time it's given.
+		{"*/15 * * * *", date(2026, 10, 19, 14, 15), date(2026, 10, 19, 14, 30)},
+		{"*/15 * * * *", from.Add(30 * time.Second), date(2026, 10, 19, 14, 15)},
+		// A value with a step starts there and runs to the end of the field.
+		{"5/15 * * * *", from, date(2026, 10, 19, 14, 20)},
+		{"5/15 * * * *", date(2026, 10, 19, 14, 50), date(2026, 10, 19, 15, 5)},
+		{"0-30/10 9 * * *", from, date(2026, 10, 20, 9, 0)},
+		{"0 9,17 * * *", from, date(2026, 10, 19, 17, 0)},
+		{"0 9 * * mon-fri", from, date(2026, 10, 20, 9, 0)},
+		// Both 0 and 7 are Sunday.
+		{"0 9 * * 7", from, date(2026, 10, 25, 9, 0)},
+		{"0 9 * * 0", from, date(2026, 10, 25, 9, 0)},
+		{"0 9 * * SUN", from, date(2026, 10, 25, 9, 0)},
+		{"0 9 * * 5-7", from, date(2026, 10, 23, 9, 0)},
+		// With both days restricted either one matches.
+		{"0 9 1 * mon", from, date(2026, 10, 26, 9, 0)},
+		{"0 9 20 * mon", from, date(2026, 10, 20, 9, 0)},
+		{"0 9 1 * *", from, date(2026, 11, 1, 9, 0)},
+		{"0 12 * jan-mar *", from, date(2027, 1, 1, 12, 0)},
+		{"0 0 29 2 *", from, date(2028, 2, 29, 0, 0)},
+		{"0 0 31 * *", date(2026, 11, 1, 0, 0), date(2026, 12, 31, 0, 0)},
+		{"@daily", from, date(2026, 10, 20, 0, 0)},
+		{"@weekly", from, date(2026, 10, 25, 0, 0)},
+		// Never matches.
+		{"0 0 30 2 *", from, time.Time{}},
+	}
+	for _, tc := range cases {
+		s, err := Parse(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		if got := s.Next(tc.from); !got.Equal(tc.want) {
+			t.Errorf("%q after %v: got %v, want %v", tc.spec, tc.from, got, tc.want)
+		}
+	}
+}
+
+func TestNextDaylightSaving(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	date := func(month time.Month, day, hour, minute int, offset time.Duration) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC).Add(-offset)
+	}
+	const cet, cest = time.Hour, 2 * time.Hour
+
+	cases := []struct {
+		spec string
+		from time.Time
+		want []time.Time
+	}{
+		// The clocks go forward from 02:00 to 03:00 on March 29. Times in the
+		// skipped hour run when the clocks change.
+		{"30 2 * * *", date(3, 28, 12, 0, cet), []time.Time{
+			date(3, 29, 3, 0, cest),
+			date(3, 30, 2, 30, cest),
+		}},
+		{"30 1,2 * * *", date(3, 29, 0, 0, cet), []time.Time{
+			date(3, 29, 1, 30, cet),
+			date(3, 29, 3, 0, cest),
+			date(3, 30, 1, 30, cest),
+		}},
+		{"0 * * * *", date(3, 29, 0, 30, cet), []time.Time{
+			date(3, 29, 1, 0, cet),
+			date(3, 29, 3, 0, cest),
+			date(3, 29, 4, 0, cest),
+		}},
+		{"0 9 * * *", date(3, 28, 12, 0, cet), []time.Time{
+			date(3, 29, 9, 0, cest),
+		}},
+		// The clocks go back from 03:00 to 02:00 on October 25. Every hour
+		// still runs, but a time of day runs once.
+		{"0 * * * *", date(10, 25, 1, 30, cest), []time.Time{
+			date(10, 25, 2, 0, cest),
+			date(10, 25, 2, 0, cet),
+			date(10, 25, 3, 0, cet),
+		}},
+		{"30 2 * * *", date(10, 24, 12, 0, cest), []time.Time{
+			date(10, 25, 2, 30, cet),
+			date(10, 26, 2, 30, cet),
+		}},
+	}
+	for _, tc := range cases {
+		s, err := Parse(tc.spec)
+		if err != nil {
+			t.Errorf("%q: %v", tc.spec, err)
+			continue
+		}
+		at := tc.from.In(loc)
+		for _, want := range tc.want {
+			at = s.Next(at)
+			if !at.Equal(want) {
+				t.Errorf("%q: got %v, want %v", tc.spec, at, want.In(loc))
+				break
+			}
+		}
+	}
+}
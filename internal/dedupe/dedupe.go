@@ -0,0 +1,194 @@
+// Package dedupe remembers recent API requests so that retries don't send a
+// notification twice. Requests carrying an idempotency key are answered with
+// the response to the first request with that key, and credentials can opt
+// in to dropping notifications identical to one they sent recently. The
+// state is persisted in the data directory; only hashes of the content of
+// notifications are kept.
+package dedupe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+)
+
+const dedupeDocument = "dedupe"
+
+var (
+	// ErrKeyReused is returned when an idempotency key is presented with a
+	// different request than the one it was first used for.
+	ErrKeyReused = errors.New("the idempotency key was already used for a different request")
+
+	// ErrInProgress is returned when the first request with an idempotency
+	// key hasn't finished yet.
+	ErrInProgress = errors.New("a request with this idempotency key is still being processed")
+)
+
+type savedResponse struct {
+	Fingerprint string          `json:"fingerprint"`
+	Body        json.RawMessage `json:"body"`
+	Expires     time.Time       `json:"expires"`
+}
+
+type state struct {
+	// Responses are keyed by the credential and the idempotency key.
+	Responses map[string]*savedResponse `json:"responses"`
+
+	// Contents holds when the hashes of recently sent content, keyed with
+	// the credential that sent them, may be sent again.
+	Contents map[string]time.Time `json:"contents"`
+}
+
+// Cache holds the responses to requests with idempotency keys and the
+// content recently sent by credentials.
+type Cache struct {
+	store *store.Store
+
+	// window is how long responses to requests with idempotency keys are
+	// remembered.
+	window time.Duration
+
+	mu      sync.Mutex
+	state   state
+	pending map[string]string
+}
+
+func New(st *store.Store, window time.Duration) (*Cache, error) {
+	c := &Cache{
+		store:   st,
+		window:  window,
+		pending: make(map[string]string),
+	}
+
+	err := st.Load(dedupeDocument, &c.state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load dedupe state: %v", err)
+	}
+	if c.state.Responses == nil {
+		c.state.Responses = make(map[string]*savedResponse)
+	}
+	if c.state.Contents == nil {
+		c.state.Contents = make(map[string]time.Time)
+	}
+	return c, nil
+}
+
+func entryKey(credential, s string) string {
+	return credential + "\n" + s
+}
+
+// Hash returns a fingerprint of data, used to tell requests apart without
+// keeping them.
+func Hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// prune forgets everything that expired before now.
+func (c *Cache) prune(now time.Time) {
+	for k, r := range c.state.Responses {
+		if !now.Before(r.Expires) {
+			delete(c.state.Responses, k)
+		}
+	}
+	for k, expires := range c.state.Contents {
+		if !now.Before(expires) {
+			delete(c.state.Contents, k)
+		}
+	}
+}
+
+// Begin starts a request made by credential with an idempotency key.
+// fingerprint identifies the request. If the key was used for the same
+// request within the window the body of its response is returned and the
+// request should not be processed again. Otherwise Complete or Abort must be
+// called once the request has been processed.
+func (c *Cache) Begin(credential, key, fingerprint string, now time.Time) (json.RawMessage, error) {
+	k := entryKey(credential, key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if r, ok := c.state.Responses[k]; ok && now.Before(r.Expires) {
+		if r.Fingerprint != fingerprint {
+			return nil, ErrKeyReused
+		}
+		return r.Body, nil
+	}
+	if pending, ok := c.pending[k]; ok {
+		if pending != fingerprint {
+			return nil, ErrKeyReused
+		}
+		return nil, ErrInProgress
+	}
+	c.pending[k] = fingerprint
+	return nil, nil
+}
+
+// Complete remembers the response to a request started with Begin.
+func (c *Cache) Complete(credential, key string, body json.RawMessage, now time.Time) error {
+	k := entryKey(credential, key)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fingerprint, ok := c.pending[k]
+	if !ok {
+		return nil
+	}
+	delete(c.pending, k)
+
+	c.prune(now)
+	c.state.Responses[k] = &savedResponse{
+		Fingerprint: fingerprint,
+		Body:        body,
+		Expires:     now.Add(c.window),
+	}
+	return c.store.Save(dedupeDocument, &c.state)
+}
+
+// Abort forgets a request started with Begin that failed, so it can be
+// retried with the same key.
+func (c *Cache) Abort(credential, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, entryKey(credential, key))
+}
+
+// Claim records that credential is sending content, reporting whether it
+// already sent the same content within window. Release undoes a claim when
+// the content couldn't be sent after all.
+func (c *Cache) Claim(credential string, content []byte, window time.Duration, now time.Time) (bool, error) {
+	k := entryKey(credential, Hash(content))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if expires, ok := c.state.Contents[k]; ok && now.Before(expires) {
+		return true, nil
+	}
+	c.prune(now)
+	c.state.Contents[k] = now.Add(window)
+	return false, c.store.Save(dedupeDocument, &c.state)
+}
+
+// Release forgets that credential sent content.
+func (c *Cache) Release(credential string, content []byte) error {
+	k := entryKey(credential, Hash(content))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.state.Contents[k]; !ok {
+		return nil
+	}
+	delete(c.state.Contents, k)
+	return c.store.Save(dedupeDocument, &c.state)
+}
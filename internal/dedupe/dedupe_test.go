@@ -0,0 +1,195 @@
+package dedupe
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+)
+
+func newTestCache(t *testing.T, dir string) *Cache {
+	st, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(st, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestBegin(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	response := json.RawMessage(`{"message_id":1}`)
+
+	cases := []struct {
+		name        string
+		setup       func(c *Cache)
+		credential  string
+		fingerprint string
+		at          time.Time
+		want        json.RawMessage
+		wantErr     error
+	}{
+		{
+			name:        "new key",
+			setup:       func(c *Cache) {},
+			credential:  "a",
+			fingerprint: "req",
+			at:          now,
+		},
+		{
+			name: "replay",
+			setup: func(c *Cache) {
+				c.Begin("a", "key", "req", now)
+				c.Complete("a", "key", response, now)
+			},
+			credential:  "a",
+			fingerprint: "req",
+			at:          now.Add(59 * time.Minute),
+			want:        response,
+		},
+		{
+			name: "reused for another request",
+			setup: func(c *Cache) {
+				c.Begin("a", "key", "req", now)
+				c.Complete("a", "key", response, now)
+			},
+			credential:  "a",
+			fingerprint: "other",
+			at:          now,
+			wantErr:     ErrKeyReused,
+		},
+		{
+			name: "expired",
+			setup: func(c *Cache) {
+				c.Begin("a", "key", "req", now)
+				c.Complete("a", "key", response, now)
+			},
+			credential:  "a",
+			fingerprint: "other",
+			at:          now.Add(time.Hour),
+		},
+		{
+			name: "keys belong to their credential",
+			setup: func(c *Cache) {
+				c.Begin("a", "key", "req", now)
+				c.Complete("a", "key", response, now)
+			},
+			credential:  "b",
+			fingerprint: "other",
+			at:          now,
+		},
+		{
+			name:        "in progress",
+			setup:       func(c *Cache) { c.Begin("a", "key", "req", now) },
+			credential:  "a",
+			fingerprint: "req",
+			at:          now,
+			wantErr:     ErrInProgress,
+		},
+		{
+			name:        "in progress for another request",
+			setup:       func(c *Cache) { c.Begin("a", "key", "req", now) },
+			credential:  "a",
+			fingerprint: "other",
+			at:          now,
+			wantErr:     ErrKeyReused,
+		},
+		{
+			name: "aborted",
+			setup: func(c *Cache) {
+				c.Begin("a", "key", "req", now)
+				c.Abort("a", "key")
+			},
+			credential:  "a",
+			fingerprint: "req",
+			at:          now,
+		},
+	}
+	for _, tc := range cases {
+		c := newTestCache(t, "")
+		tc.setup(c)
+		got, err := c.Begin(tc.credential, "key", tc.fingerprint, tc.at)
+		if err != tc.wantErr {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.wantErr)
+		}
+		if string(got) != string(tc.want) {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestClaim(t *testing.T) {
+	c := newTestCache(t, "")
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	content := []byte("disk is full")
+
+	cases := []struct {
+		name       string
+		credential string
+		content    []byte
+		at         time.Time
+		want       bool
+	}{
+		{"first", "a", content, now, false},
+		{"repeated", "a", content, now.Add(time.Minute), true},
+		{"other content", "a", []byte("disk is fine"), now, false},
+		{"other credential", "b", content, now, false},
+		{"after the window", "a", content, now.Add(10 * time.Minute), false},
+	}
+	for _, tc := range cases {
+		got, err := c.Claim(tc.credential, tc.content, 10*time.Minute, tc.at)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Released content can be sent again.
+	if err := c.Release("a", content); err != nil {
+		t.Fatal(err)
+	}
+	if dup, _ := c.Claim("a", content, 10*time.Minute, now.Add(11*time.Minute)); dup {
+		t.Error("released content was still claimed")
+	}
+}
+
+func TestPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	c := newTestCache(t, dir)
+	c.Begin("a", "done", "req", now)
+	if err := c.Complete("a", "done", json.RawMessage(`{"ok":true}`), now); err != nil {
+		t.Fatal(err)
+	}
+	c.Begin("a", "pending", "req", now)
+	if _, err := c.Claim("a", []byte("hello"), time.Hour, now); err != nil {
+		t.Fatal(err)
+	}
+
+	c = newTestCache(t, dir)
+	got, err := c.Begin("a", "done", "req", now)
+	var saved struct{ OK bool }
+	if err != nil || json.Unmarshal(got, &saved) != nil || !saved.OK {
+		t.Errorf("got %s %v, want the saved response", got, err)
+	}
+	// Requests that never completed can be retried after a restart.
+	if got, err := c.Begin("a", "pending", "req", now); err != nil || got != nil {
+		t.Errorf("got %s %v, want a new request", got, err)
+	}
+	if dup, err := c.Claim("a", []byte("hello"), time.Hour, now); err != nil || !dup {
+		t.Errorf("got %v %v, want the content claimed", dup, err)
+	}
+}
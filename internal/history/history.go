@@ -0,0 +1,222 @@
+// Package history records the notifications delivered to chats so they can
+// be listed, searched and exported later. Records are appended to a log in
+// the data directory and kept in memory for querying.
+package history
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+	"github.com/hashicorp/go-hclog"
+)
+
+const historyLog = "history"
+
+// What happened to a notification.
+const (
+	StatusDelivered = "delivered"
+	StatusDigested  = "digested"
+	StatusHeld      = "held"
+	StatusMuted     = "muted"
+	StatusFailed    = "failed"
+
+	// StatusSkipped notifications were scheduled to be sent while the bot
+	// was down and dropped because missed jobs are skipped.
+	StatusSkipped = "skipped"
+)
+
+// Record is a notification and what happened to it.
+type Record struct {
+	ID     int64 `json:"id"`
+	ChatID int64 `json:"chat_id"`
+
+	// Source is the ID of the credential that sent the notification and
+	// SourceName describes it to users.
+	Source     string `json:"source"`
+	SourceName string `json:"source_name"`
+
+	Text string `json:"text"`
+
+	// ReceivedAt is when the notification was handed to the bot and
+	// DeliveredAt when it was sent to the chat on its own, if it was.
+	ReceivedAt  time.Time  `json:"received_at"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// ScheduledID is the ID of the scheduled or recurring notification that
+	// sent it, if any.
+	ScheduledID string `json:"scheduled_id,omitempty"`
+}
+
+// Query selects records. Zero fields match everything.
+type Query struct {
+	// Chat reports whether a record was sent to the chat being queried,
+	// which lets callers follow chats that changed ID.
+	Chat func(chatID int64) bool
+
+	Source string
+	Since  time.Time
+	Until  time.Time
+
+	// Text matches records containing every word of it, ignoring case.
+	Text string
+
+	// Limit returns only the newest records.
+	Limit int
+}
+
+func (q *Query) matches(r *Record, words []string) bool {
+	if q.Chat != nil && !q.Chat(r.ChatID) {
+		return false
+	}
+	if q.Source != "" && r.Source != q.Source {
+		return false
+	}
+	if !q.Since.IsZero() && r.ReceivedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.ReceivedAt.Before(q.Until) {
+		return false
+	}
+	text := strings.ToLower(r.Text)
+	for _, w := range words {
+		if !strings.Contains(text, w) {
+			return false
+		}
+	}
+	return true
+}
+
+// Log is the history of every chat.
+type Log struct {
+	store  *store.Store
+	logger hclog.Logger
+
+	mu      sync.Mutex
+	records []*Record
+	nextID  int64
+}
+
+func New(st *store.Store, logger hclog.Logger) (*Log, error) {
+	l := &Log{
+		store:  st,
+		logger: logger,
+		nextID: 1,
+	}
+
+	err := st.ReadLog(historyLog, func(entry []byte) error {
+		var r Record
+		if err := json.Unmarshal(entry, &r); err != nil {
+			// Most likely a write cut short by a crash.
+			logger.Warn("skipping unreadable history record", "error", err)
+			return nil
+		}
+		l.records = append(l.records, &r)
+		if r.ID >= l.nextID {
+			l.nextID = r.ID + 1
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Add assigns r an ID and records it.
+func (l *Log) Add(r *Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r.ID = l.nextID
+	l.nextID++
+	cp := *r
+	l.records = append(l.records, &cp)
+	return l.store.Append(historyLog, &cp)
+}
+
+// Delete removes the records for which filter returns true, returning how
+// many were removed.
+func (l *Log) Delete(filter func(r *Record) bool) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var kept []*Record
+	var entries []interface{}
+	for _, r := range l.records {
+		if !filter(r) {
+			kept = append(kept, r)
+			entries = append(entries, r)
+		}
+	}
+	n := len(l.records) - len(kept)
+	if n == 0 {
+		return 0, nil
+	}
+	l.records = kept
+	return n, l.store.ReplaceLog(historyLog, entries)
+}
+
+// Find returns copies of the records matching q, newest first.
+func (l *Log) Find(q Query) []*Record {
+	words := strings.Fields(strings.ToLower(q.Text))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var out []*Record
+	for i := len(l.records) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(out) >= q.Limit {
+			break
+		}
+		if r := l.records[i]; q.matches(r, words) {
+			cp := *r
+			out = append(out, &cp)
+		}
+	}
+	return out
+}
+
+// WriteCSV writes records to w as CSV with a header row.
+func WriteCSV(w io.Writer, records []*Record) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "chat_id", "source", "source_name", "received_at", "delivered_at", "status", "error", "text", "scheduled_id"})
+	for _, r := range records {
+		delivered := ""
+		if r.DeliveredAt != nil {
+			delivered = r.DeliveredAt.Format(time.RFC3339)
+		}
+		cw.Write([]string{
+			strconv.FormatInt(r.ID, 10),
+			strconv.FormatInt(r.ChatID, 10),
+			r.Source,
+			r.SourceName,
+			r.ReceivedAt.Format(time.RFC3339),
+			delivered,
+			r.Status,
+			r.Error,
+			r.Text,
+			r.ScheduledID,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteJSON writes records to w as a JSON array.
+func WriteJSON(w io.Writer, records []*Record) error {
+	if records == nil {
+		records = []*Record{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(records)
+}
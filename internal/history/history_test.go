@@ -0,0 +1,198 @@
+package history
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+	"github.com/hashicorp/go-hclog"
+)
+
+func openTestLog(t *testing.T) (*Log, string) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return reopen(t, dir), dir
+}
+
+func reopen(t *testing.T, dir string) *Log {
+	st, err := store.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := New(st, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+var start = time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func addRecords(t *testing.T, l *Log) {
+	delivered := start.Add(time.Second)
+	records := []*Record{
+		{ChatID: 1, Source: "token:a", Text: "Backup failed on host1", ReceivedAt: start, DeliveredAt: &delivered, Status: StatusDelivered},
+		{ChatID: 1, Source: "token:b", Text: "deploy done", ReceivedAt: start.Add(time.Hour), Status: StatusDigested},
+		{ChatID: 2, Source: "token:a", Text: "backup failed, again", ReceivedAt: start.Add(2 * time.Hour), Status: StatusFailed, Error: "chat not found"},
+		{ChatID: 1, Source: "token:a", Text: "backup ok", ReceivedAt: start.Add(3 * time.Hour), Status: StatusHeld},
+	}
+	for _, r := range records {
+		if err := l.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func ids(records []*Record) []int64 {
+	var out []int64
+	for _, r := range records {
+		out = append(out, r.ID)
+	}
+	return out
+}
+
+func TestFind(t *testing.T) {
+	l, _ := openTestLog(t)
+	addRecords(t, l)
+	inChat := func(id int64) func(int64) bool { return func(chatID int64) bool { return chatID == id } }
+
+	cases := []struct {
+		name  string
+		query Query
+		want  []int64
+	}{
+		{"everything", Query{}, []int64{4, 3, 2, 1}},
+		{"chat", Query{Chat: inChat(1)}, []int64{4, 2, 1}},
+		{"source", Query{Chat: inChat(1), Source: "token:a"}, []int64{4, 1}},
+		{"since", Query{Since: start.Add(time.Hour)}, []int64{4, 3, 2}},
+		{"until", Query{Until: start.Add(time.Hour)}, []int64{1}},
+		{"words", Query{Text: "FAILED backup"}, []int64{3, 1}},
+		{"limit", Query{Chat: inChat(1), Limit: 2}, []int64{4, 2}},
+		{"nothing", Query{Text: "nowhere"}, nil},
+	}
+	for _, tc := range cases {
+		if got := ids(l.Find(tc.query)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	// Callers get copies.
+	l.Find(Query{})[0].Text = "changed"
+	if l.Find(Query{})[0].Text != "backup ok" {
+		t.Fatal("a found record was changed")
+	}
+}
+
+func TestDeleteAndReload(t *testing.T) {
+	l, dir := openTestLog(t)
+	addRecords(t, l)
+
+	n, err := l.Delete(func(r *Record) bool { return r.ChatID == 2 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("deleted %d records, want 1", n)
+	}
+	if n, err := l.Delete(func(r *Record) bool { return r.ChatID == 2 }); n != 0 || err != nil {
+		t.Fatalf("deleted %d records again (%v)", n, err)
+	}
+
+	l = reopen(t, dir)
+	all := l.Find(Query{})
+	if got := ids(all); !reflect.DeepEqual(got, []int64{4, 2, 1}) {
+		t.Fatalf("got %v after reloading, want the records that weren't deleted", got)
+	}
+	if r := all[2]; r.DeliveredAt == nil || !r.DeliveredAt.Equal(start.Add(time.Second)) || r.Status != StatusDelivered {
+		t.Fatalf("got %+v after reloading", r)
+	}
+
+	// IDs aren't reused after a restart.
+	r := &Record{ChatID: 1, Text: "new", ReceivedAt: start.Add(4 * time.Hour), Status: StatusDelivered}
+	if err := l.Add(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != 5 {
+		t.Fatalf("got ID %d, want 5", r.ID)
+	}
+}
+
+func TestReloadSkipsUnreadableRecords(t *testing.T) {
+	l, dir := openTestLog(t)
+	addRecords(t, l)
+
+	// A write cut short by a crash.
+	f, err := os.OpenFile(filepath.Join(dir, historyLog+".jsonl"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id": 5, "chat_id"`)
+	f.Close()
+
+	if got := ids(reopen(t, dir).Find(Query{})); !reflect.DeepEqual(got, []int64{4, 3, 2, 1}) {
+		t.Fatalf("got %v, want the readable records", got)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	l, _ := openTestLog(t)
+	addRecords(t, l)
+
+	var buf bytes.Buffer
+	if err := WriteCSV(&buf, l.Find(Query{Limit: 2})); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"id", "chat_id", "source", "source_name", "received_at", "delivered_at", "status", "error", "text", "scheduled_id"},
+		{"4", "1", "token:a", "", "2020-03-01T15:00:00Z", "", "held", "", "backup ok", ""},
+		{"3", "2", "token:a", "", "2020-03-01T14:00:00Z", "", "failed", "chat not found", "backup failed, again", ""},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Fatalf("got %q, want %q", rows, want)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	l, _ := openTestLog(t)
+	addRecords(t, l)
+
+	var buf bytes.Buffer
+	if err := WriteJSON(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := bytes.TrimSpace(buf.Bytes()); string(got) != "[]" {
+		t.Fatalf("got %s for no records, want []", got)
+	}
+
+	buf.Reset()
+	records := l.Find(Query{})
+	if err := WriteJSON(&buf, records); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []*Record
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(records) {
+		t.Fatalf("got %d records, want %d", len(decoded), len(records))
+	}
+	for i := range records {
+		if decoded[i].ID != records[i].ID || decoded[i].Text != records[i].Text || !decoded[i].ReceivedAt.Equal(records[i].ReceivedAt) {
+			t.Fatalf("record %d: got %+v, want %+v", i, decoded[i], records[i])
+		}
+	}
+}
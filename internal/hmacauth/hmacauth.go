@@ -0,0 +1,280 @@
+// Package hmacauth implements request signing as an alternative to bearer
+// tokens. Clients sign the method, path, timestamp, a nonce and a hash of the
+// body with a shared secret, so the secret itself never travels with the
+// request.
+//
+// A signed request carries an Authorization header of the form:
+//
+//	ENDOBOT-HMAC-SHA256 Credential=<id>, Timestamp=<unix>, Nonce=<nonce>, Signature=<hex>
+//
+// where Signature is the hex encoded HMAC-SHA256 of StringToSign.
+package hmacauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+)
+
+const (
+	// Scheme is the Authorization scheme used by signed requests.
+	Scheme = "ENDOBOT-HMAC-SHA256"
+
+	clientsDocument = "hmac_clients"
+
+	// DefaultMaxSkew is how far a request timestamp may be from the server
+	// clock.
+	DefaultMaxSkew = 5 * time.Minute
+)
+
+// Client is a holder of a signing secret.
+type Client struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Secret    string    `json:"secret"`
+	ChatID    int64     `json:"chat_id"`
+	CreatedBy int64     `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Verifier checks signed requests and manages the signing clients.
+type Verifier struct {
+	store   *store.Store
+	maxSkew time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*Client
+	nonces  map[string]time.Time
+}
+
+func New(st *store.Store, maxSkew time.Duration) (*Verifier, error) {
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+
+	v := &Verifier{
+		store:   st,
+		maxSkew: maxSkew,
+		clients: make(map[string]*Client),
+		nonces:  make(map[string]time.Time),
+	}
+
+	err := st.Load(clientsDocument, &v.clients)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing clients: %v", err)
+	}
+
+	return v, nil
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// NewClient creates a signing client owned by createdBy that delivers to
+// chatID.
+func (v *Verifier) NewClient(chatID int64, name string, createdBy int64) (*Client, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		ID:        id,
+		Name:      name,
+		Secret:    secret,
+		ChatID:    chatID,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now(),
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.clients[id] = c
+	return c, v.store.Save(clientsDocument, v.clients)
+}
+
+// Clients returns the clients that deliver to the chats for which inChat
+// returns true.
+func (v *Verifier) Clients(inChat func(chatID int64) bool) []*Client {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	var out []*Client
+	for _, c := range v.clients {
+		if inChat(c.ChatID) {
+			cp := *c
+			out = append(out, &cp)
+		}
+	}
+	return out
+}
+
+// DeleteClient removes a client of the chats for which inChat returns true,
+// reporting whether it existed.
+func (v *Verifier) DeleteClient(inChat func(chatID int64) bool, id string) (bool, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	c, ok := v.clients[id]
+	if !ok || !inChat(c.ChatID) {
+		return false, nil
+	}
+	delete(v.clients, id)
+	return true, v.store.Save(clientsDocument, v.clients)
+}
+
+// DeleteUser removes every client created by userID, returning how many
+// were removed.
+func (v *Verifier) DeleteUser(userID int64) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	n := 0
+	for id, c := range v.clients {
+		if c.CreatedBy == userID {
+			delete(v.clients, id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, v.store.Save(clientsDocument, v.clients)
+}
+
+// DeleteChat removes every client of the chats for which inChat returns
+// true, returning how many were removed.
+func (v *Verifier) DeleteChat(inChat func(chatID int64) bool) (int, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	n := 0
+	for id, c := range v.clients {
+		if inChat(c.ChatID) {
+			delete(v.clients, id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, v.store.Save(clientsDocument, v.clients)
+}
+
+// IsSigned reports whether r claims to be a signed request.
+func IsSigned(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), Scheme+" ")
+}
+
+// StringToSign builds the canonical representation of a request that is
+// signed by clients.
+func StringToSign(method, path string, timestamp int64, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return strings.Join([]string{
+		Scheme,
+		strings.ToUpper(method),
+		path,
+		strconv.FormatInt(timestamp, 10),
+		nonce,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+}
+
+// Sign returns the hex encoded signature of stringToSign.
+func Sign(secret, stringToSign string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func requestPath(r *http.Request) string {
+	path := r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	return path
+}
+
+func parseAuthorization(header string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, part := range strings.Split(strings.TrimPrefix(header, Scheme+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed authorization parameter: %q", part)
+		}
+		params[kv[0]] = kv[1]
+	}
+	for _, k := range []string{"Credential", "Timestamp", "Nonce", "Signature"} {
+		if params[k] == "" {
+			return nil, fmt.Errorf("missing authorization parameter: %s", k)
+		}
+	}
+	return params, nil
+}
+
+// Verify checks the signature of r, whose body has already been read into
+// body, and returns the client that signed it.
+func (v *Verifier) Verify(r *http.Request, body []byte) (*Client, error) {
+	params, err := parseAuthorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return nil, err
+	}
+
+	ts, err := strconv.ParseInt(params["Timestamp"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp: %v", err)
+	}
+	now := time.Now()
+	skew := now.Sub(time.Unix(ts, 0))
+	if skew > v.maxSkew || skew < -v.maxSkew {
+		return nil, fmt.Errorf("request timestamp is outside the allowed clock skew")
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	c, ok := v.clients[params["Credential"]]
+	if !ok {
+		return nil, fmt.Errorf("unknown credential: %q", params["Credential"])
+	}
+
+	expected := Sign(c.Secret, StringToSign(r.Method, requestPath(r), ts, params["Nonce"], body))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(params["Signature"]))) {
+		return nil, fmt.Errorf("signature mismatch")
+	}
+
+	// Nonces only need to be remembered for as long as their timestamp is
+	// acceptable, after that the skew check rejects replays.
+	for k, exp := range v.nonces {
+		if now.After(exp) {
+			delete(v.nonces, k)
+		}
+	}
+	nonceKey := c.ID + ":" + params["Nonce"]
+	if _, seen := v.nonces[nonceKey]; seen {
+		return nil, fmt.Errorf("nonce has already been used")
+	}
+	v.nonces[nonceKey] = time.Unix(ts, 0).Add(v.maxSkew)
+
+	cp := *c
+	return &cp, nil
+}
@@ -0,0 +1,108 @@
+package hmacauth
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+)
+
+func newTestVerifier(t *testing.T) (*Verifier, *Client) {
+	st, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := New(st, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := v.NewClient(-100, "ci", 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, c
+}
+
+func TestStringToSign(t *testing.T) {
+	got := StringToSign("post", "/notify?pretty", 1700000000, "abc", []byte("hello"))
+	want := "ENDOBOT-HMAC-SHA256\nPOST\n/notify?pretty\n1700000000\nabc\n" +
+		"2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	v, c := newTestVerifier(t)
+	now := time.Now().Unix()
+
+	sign := func(secret, method, path, body string, ts int64, nonce string) (string, []byte) {
+		sig := Sign(secret, StringToSign(method, path, ts, nonce, []byte(body)))
+		return fmt.Sprintf("%s Credential=%s, Timestamp=%d, Nonce=%s, Signature=%s", Scheme, c.ID, ts, nonce, sig), []byte(body)
+	}
+	verify := func(header, path string, body []byte) error {
+		r := httptest.NewRequest("POST", path, strings.NewReader(string(body)))
+		r.Header.Set("Authorization", header)
+		if !IsSigned(r) {
+			t.Fatal("the request isn't recognised as signed")
+		}
+		_, err := v.Verify(r, body)
+		return err
+	}
+
+	header, body := sign(c.Secret, "POST", "/notify?pretty", `{"message": "hi"}`, now, "n1")
+	if err := verify(header, "/notify?pretty", body); err != nil {
+		t.Fatalf("a valid request was rejected: %v", err)
+	}
+	if err := verify(header, "/notify?pretty", body); err == nil {
+		t.Error("a replayed nonce was accepted")
+	}
+
+	header, body = sign(c.Secret, "POST", "/notify", `{"message": "hi"}`, now, "n2")
+	if err := verify(header, "/notify", []byte(`{"message": "bye"}`)); err == nil {
+		t.Error("a tampered body was accepted")
+	}
+	if err := verify(header, "/notify?pretty", body); err == nil {
+		t.Error("a tampered path was accepted")
+	}
+
+	header, body = sign("wrong secret", "POST", "/notify", "", now, "n3")
+	if err := verify(header, "/notify", body); err == nil {
+		t.Error("a request signed with the wrong secret was accepted")
+	}
+
+	for _, ts := range []int64{now - 120, now + 120} {
+		header, body = sign(c.Secret, "POST", "/notify", "", ts, fmt.Sprintf("skew%d", ts))
+		if err := verify(header, "/notify", body); err == nil {
+			t.Errorf("a request %ds off the server clock was accepted", ts-now)
+		}
+	}
+	header, body = sign(c.Secret, "POST", "/notify", "", now-30, "within")
+	if err := verify(header, "/notify", body); err != nil {
+		t.Errorf("a request within the allowed skew was rejected: %v", err)
+	}
+
+	if err := verify(Scheme+" Credential="+c.ID, "/notify", nil); err == nil {
+		t.Error("a header with missing parameters was accepted")
+	}
+}
+
+func TestClientsFollowChats(t *testing.T) {
+	v, c := newTestVerifier(t)
+	// The chat migrated from -100 to -200.
+	inChat := func(id int64) bool { return id == -100 || id == -200 }
+
+	clients := v.Clients(inChat)
+	if len(clients) != 1 || clients[0].ID != c.ID {
+		t.Fatalf("got %v, want the client of the migrated chat", clients)
+	}
+	if ok, err := v.DeleteClient(func(id int64) bool { return id == -300 }, c.ID); ok || err != nil {
+		t.Fatalf("deleted a client of another chat: %v %v", ok, err)
+	}
+	if ok, err := v.DeleteClient(inChat, c.ID); !ok || err != nil {
+		t.Fatalf("failed to delete the client: %v %v", ok, err)
+	}
+}
@@ -0,0 +1,205 @@
+// Package ratelimit limits how often something may happen, using token
+// buckets for short bursts and a count per UTC day for quotas. State is
+// kept in memory only, so it starts afresh when endobot restarts.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate allows Count events per period, in bursts of up to Count.
+type Rate struct {
+	Count int           `json:"count"`
+	Per   time.Duration `json:"per"`
+}
+
+var ratePeriods = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+}
+
+// ParseRate parses a rate such as "30/m", "500/h" or "5/s". "off" and "0"
+// mean unlimited.
+func ParseRate(s string) (Rate, error) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	if s == "off" || s == "0" || s == "" {
+		return Rate{}, nil
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) == 2 {
+		count, err := strconv.Atoi(parts[0])
+		per, ok := ratePeriods[parts[1]]
+		if err == nil && count > 0 && ok {
+			return Rate{Count: count, Per: per}, nil
+		}
+	}
+	return Rate{}, fmt.Errorf("%q is not a rate like 30/m, 500/h or off", s)
+}
+
+// Unlimited reports whether the rate allows everything.
+func (r Rate) Unlimited() bool {
+	return r.Count <= 0 || r.Per <= 0
+}
+
+func (r Rate) String() string {
+	if r.Unlimited() {
+		return "off"
+	}
+	for unit, per := range ratePeriods {
+		if per == r.Per {
+			return fmt.Sprintf("%d/%s", r.Count, unit)
+		}
+	}
+	return fmt.Sprintf("%d/%s", r.Count, r.Per)
+}
+
+// Limit combines a rate with a daily quota. Zero values are unlimited.
+type Limit struct {
+	Rate  Rate `json:"rate"`
+	Daily int  `json:"daily,omitempty"`
+}
+
+func (l Limit) String() string {
+	if l.Daily <= 0 {
+		return l.Rate.String()
+	}
+	return fmt.Sprintf("%s, %d a day", l.Rate, l.Daily)
+}
+
+// Check is a limit to enforce for a key.
+type Check struct {
+	Key   string
+	Limit Limit
+}
+
+// Exceeded describes a check that failed.
+type Exceeded struct {
+	Key   string
+	Limit Limit
+
+	// Quota is set when the daily quota, rather than the rate, was used up.
+	Quota bool
+
+	// RetryAfter is how long until the check would pass again.
+	RetryAfter time.Duration
+}
+
+func (e *Exceeded) Error() string {
+	if e.Quota {
+		return fmt.Sprintf("the daily quota of %d for %s is used up", e.Limit.Daily, e.Key)
+	}
+	return fmt.Sprintf("the rate limit of %s for %s was exceeded", e.Limit.Rate, e.Key)
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type dayCount struct {
+	day   time.Time
+	count int
+}
+
+// Limiter tracks how much of their limits keys have used.
+type Limiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	days    map[string]*dayCount
+}
+
+func New() *Limiter {
+	return &Limiter{
+		buckets: make(map[string]*bucket),
+		days:    make(map[string]*dayCount),
+	}
+}
+
+// Allow records an event at now against every check, unless one of them
+// would be exceeded, in which case nothing is recorded and the first check
+// that failed is returned.
+func (l *Limiter) Allow(now time.Time, checks ...Check) *Exceeded {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	day := startOfDay(now)
+	for _, c := range checks {
+		if c.Limit.Daily > 0 {
+			if d, ok := l.days[c.Key]; ok && d.day.Equal(day) && d.count >= c.Limit.Daily {
+				return &Exceeded{Key: c.Key, Limit: c.Limit, Quota: true, RetryAfter: day.AddDate(0, 0, 1).Sub(now)}
+			}
+		}
+		if !c.Limit.Rate.Unlimited() {
+			if tokens := l.refill(c.Key, c.Limit.Rate, now); tokens < 1 {
+				perToken := float64(c.Limit.Rate.Per) / float64(c.Limit.Rate.Count)
+				wait := time.Duration(math.Ceil((1 - tokens) * perToken))
+				return &Exceeded{Key: c.Key, Limit: c.Limit, RetryAfter: wait}
+			}
+		}
+	}
+
+	for _, c := range checks {
+		if c.Limit.Daily > 0 {
+			d, ok := l.days[c.Key]
+			if !ok || !d.day.Equal(day) {
+				d = &dayCount{day: day}
+				l.days[c.Key] = d
+			}
+			d.count++
+		}
+		if !c.Limit.Rate.Unlimited() {
+			l.buckets[c.Key].tokens--
+		}
+	}
+	return nil
+}
+
+// refill tops up the bucket of key for the time passed since it was last
+// used and returns how many tokens it holds.
+func (l *Limiter) refill(key string, r Rate, now time.Time) float64 {
+	capacity := float64(r.Count)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed.Seconds()*capacity/r.Per.Seconds())
+		b.last = now
+	}
+	// The limit may have been lowered since the bucket was filled.
+	b.tokens = math.Min(capacity, b.tokens)
+	return b.tokens
+}
+
+// Prune forgets daily counts from before today and buckets that have been
+// idle for longer than maxIdle, which should be at least the longest rate
+// period in use so that they are full again.
+func (l *Limiter) Prune(now time.Time, maxIdle time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	day := startOfDay(now)
+	for key, d := range l.days {
+		if d.day.Before(day) {
+			delete(l.days, key)
+		}
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > maxIdle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func startOfDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
@@ -0,0 +1,159 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    Rate
+		wantErr bool
+	}{
+		{in: "30/m", want: Rate{Count: 30, Per: time.Minute}},
+		{in: " 500/H ", want: Rate{Count: 500, Per: time.Hour}},
+		{in: "5/s", want: Rate{Count: 5, Per: time.Second}},
+		{in: "1000/d", want: Rate{Count: 1000, Per: 24 * time.Hour}},
+		{in: "off", want: Rate{}},
+		{in: "0", want: Rate{}},
+		{in: "", want: Rate{}},
+		{in: "30", wantErr: true},
+		{in: "0/m", wantErr: true},
+		{in: "-1/m", wantErr: true},
+		{in: "30/week", wantErr: true},
+		{in: "lots/m", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := ParseRate(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: got %+v, want %+v", tc.in, got, tc.want)
+		}
+		if s := got.String(); tc.want.Unlimited() && s != "off" {
+			t.Errorf("%q: formatted as %q, want off", tc.in, s)
+		}
+	}
+}
+
+func TestAllowRate(t *testing.T) {
+	l := New()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	check := Check{Key: "token", Limit: Limit{Rate: Rate{Count: 3, Per: time.Minute}}}
+
+	// The bucket starts full and allows a burst.
+	for i := 0; i < 3; i++ {
+		if e := l.Allow(now, check); e != nil {
+			t.Fatalf("event %d was limited: %v", i, e)
+		}
+	}
+	e := l.Allow(now, check)
+	if e == nil || e.Quota || e.Key != "token" {
+		t.Fatalf("got %v, want the rate of token exceeded", e)
+	}
+	if e.RetryAfter != 20*time.Second {
+		t.Errorf("got a retry after %v, want 20s", e.RetryAfter)
+	}
+
+	if e := l.Allow(now.Add(19*time.Second), check); e == nil {
+		t.Error("allowed an event before a token was refilled")
+	}
+	if e := l.Allow(now.Add(20*time.Second), check); e != nil {
+		t.Errorf("limited an event after a token was refilled: %v", e)
+	}
+
+	// Lowering the limit takes effect on a full bucket.
+	later := now.Add(time.Hour)
+	lowered := Check{Key: "token", Limit: Limit{Rate: Rate{Count: 1, Per: time.Minute}}}
+	if e := l.Allow(later, lowered); e != nil {
+		t.Fatalf("limited the first event: %v", e)
+	}
+	if e := l.Allow(later, lowered); e == nil {
+		t.Error("allowed more than the lowered limit")
+	}
+}
+
+func TestAllowIsAllOrNothing(t *testing.T) {
+	l := New()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	token := Check{Key: "token", Limit: Limit{Rate: Rate{Count: 3, Per: time.Hour}, Daily: 3}}
+	chat := Check{Key: "chat", Limit: Limit{Rate: Rate{Count: 1, Per: time.Hour}}}
+
+	if e := l.Allow(now, token, chat); e != nil {
+		t.Fatalf("limited the first event: %v", e)
+	}
+	for i := 0; i < 3; i++ {
+		e := l.Allow(now, token, chat)
+		if e == nil || e.Key != "chat" {
+			t.Fatalf("got %v, want the rate of chat exceeded", e)
+		}
+	}
+
+	// The events refused for the chat didn't count against the token.
+	for i := 0; i < 2; i++ {
+		if e := l.Allow(now, token); e != nil {
+			t.Fatalf("event %d was limited: %v", i, e)
+		}
+	}
+	if e := l.Allow(now, token); e == nil {
+		t.Error("allowed more than the token's limit")
+	}
+}
+
+func TestAllowDailyQuota(t *testing.T) {
+	l := New()
+	// 23:00 on October 19 in UTC, already October 20 in Berlin.
+	loc := time.FixedZone("CEST", 2*60*60)
+	now := time.Date(2026, 10, 20, 1, 0, 0, 0, loc)
+	check := Check{Key: "token", Limit: Limit{Daily: 2}}
+
+	for i := 0; i < 2; i++ {
+		if e := l.Allow(now, check); e != nil {
+			t.Fatalf("event %d was limited: %v", i, e)
+		}
+	}
+	e := l.Allow(now.Add(30*time.Minute), check)
+	if e == nil || !e.Quota {
+		t.Fatalf("got %v, want the daily quota used up", e)
+	}
+	if e.RetryAfter != 30*time.Minute {
+		t.Errorf("got a retry after %v, want 30m until midnight UTC", e.RetryAfter)
+	}
+
+	// The quota starts again at midnight UTC.
+	if e := l.Allow(now.Add(time.Hour), check); e != nil {
+		t.Errorf("limited an event on the next day: %v", e)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	l := New()
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	l.Allow(now, Check{Key: "a", Limit: Limit{Rate: Rate{Count: 1, Per: time.Minute}, Daily: 5}})
+	l.Allow(now.Add(time.Hour), Check{Key: "b", Limit: Limit{Rate: Rate{Count: 1, Per: time.Minute}}})
+
+	l.Prune(now.Add(90*time.Minute), time.Hour)
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("kept an idle bucket")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Error("pruned a bucket in use")
+	}
+	if _, ok := l.days["a"]; !ok {
+		t.Error("pruned today's count")
+	}
+
+	l.Prune(now.Add(24*time.Hour), time.Hour)
+	if len(l.days) != 0 {
+		t.Errorf("kept %d counts from yesterday", len(l.days))
+	}
+}
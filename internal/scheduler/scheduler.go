@@ -0,0 +1,393 @@
+// Package scheduler runs jobs at a later time, once or whenever a cron
+// expression matches. Jobs are persisted so they survive restarts, and each
+// run is recorded before the job is handed out so a job never fires twice,
+// even if the process dies while running it.
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/cron"
+	"github.com/endocrimes/endobot/internal/store"
+	"github.com/hashicorp/go-hclog"
+)
+
+const jobsDocument = "jobs"
+
+// maxSleep bounds how long the scheduler waits between checks, so jobs still
+// fire if the clock jumps.
+const maxSleep = time.Minute
+
+// Job is work to be done at RunAt. What to do is described by Kind and
+// Payload, which the scheduler doesn't interpret.
+type Job struct {
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	ChatID int64  `json:"chat_id"`
+
+	RunAt     time.Time `json:"run_at"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// CreatedBy describes who scheduled the job.
+	CreatedBy string `json:"created_by"`
+
+	// Cron makes the job recur: after it fires RunAt moves to the next time
+	// the expression matches in Timezone.
+	Cron     string `json:"cron,omitempty"`
+	Timezone string `json:"timezone,omitempty"`
+
+	// Paused recurring jobs don't fire until they are resumed.
+	Paused bool `json:"paused,omitempty"`
+
+	Payload json.RawMessage `json:"payload"`
+}
+
+// NextRuns returns the next n times after t that the cron expression spec
+// matches in timezone.
+func NextRuns(spec, timezone string, t time.Time, n int) ([]time.Time, error) {
+	sched, err := cron.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q", timezone)
+	}
+
+	var out []time.Time
+	t = t.In(loc)
+	for len(out) < n {
+		t = sched.Next(t)
+		if t.IsZero() {
+			break
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// next returns when a recurring job next runs after t, or the zero time if it
+// never will.
+func (j *Job) next(t time.Time) time.Time {
+	runs, err := NextRuns(j.Cron, j.Timezone, t, 1)
+	if err != nil || len(runs) == 0 {
+		return time.Time{}
+	}
+	return runs[0]
+}
+
+// Decode unmarshals the payload of the job into v.
+func (j *Job) Decode(v interface{}) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// Scheduler holds jobs until they are due.
+type Scheduler struct {
+	store  *store.Store
+	logger hclog.Logger
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+
+	// wake interrupts Run when a job is added, as it may be due before the
+	// one Run is waiting for.
+	wake chan struct{}
+}
+
+func New(st *store.Store, logger hclog.Logger) (*Scheduler, error) {
+	s := &Scheduler{
+		store:  st,
+		logger: logger,
+		jobs:   make(map[string]*Job),
+		wake:   make(chan struct{}, 1),
+	}
+
+	err := st.Load(jobsDocument, &s.jobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scheduled jobs: %v", err)
+	}
+
+	return s, nil
+}
+
+func (s *Scheduler) save() error {
+	return s.store.Save(jobsDocument, s.jobs)
+}
+
+func randomID() (string, error) {
+	buf := make([]byte, 6)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Add schedules a job that runs payload at runAt and returns it with its ID
+// set.
+func (s *Scheduler) Add(kind string, chatID int64, runAt time.Time, createdBy string, payload interface{}) (*Job, error) {
+	job := &Job{
+		Kind:      kind,
+		ChatID:    chatID,
+		RunAt:     runAt,
+		CreatedBy: createdBy,
+	}
+	return s.add(job, payload)
+}
+
+// AddRecurring schedules a job that runs payload whenever the cron
+// expression spec matches in timezone.
+func (s *Scheduler) AddRecurring(kind string, chatID int64, spec, timezone, createdBy string, payload interface{}) (*Job, error) {
+	runs, err := NextRuns(spec, timezone, time.Now(), 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(runs) == 0 {
+		return nil, fmt.Errorf("%q never matches", spec)
+	}
+
+	job := &Job{
+		Kind:      kind,
+		ChatID:    chatID,
+		RunAt:     runs[0],
+		CreatedBy: createdBy,
+		Cron:      spec,
+		Timezone:  timezone,
+	}
+	return s.add(job, payload)
+}
+
+func (s *Scheduler) add(job *Job, payload interface{}) (*Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	job.ID, err = randomID()
+	if err != nil {
+		return nil, err
+	}
+	job.CreatedAt = time.Now()
+	job.Payload = data
+
+	s.mu.Lock()
+	s.jobs[job.ID] = job
+	err = s.save()
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	s.wakeUp()
+
+	cp := *job
+	return &cp, nil
+}
+
+func (s *Scheduler) wakeUp() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Get returns a copy of the job with the given ID, or nil.
+func (s *Scheduler) Get(id string) *Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil
+	}
+	cp := *job
+	return &cp
+}
+
+// List returns copies of the jobs for which filter returns true, ordered by
+// when they run.
+func (s *Scheduler) List(filter func(job *Job) bool) []*Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var out []*Job
+	for _, job := range s.jobs {
+		if filter(job) {
+			cp := *job
+			out = append(out, &cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].RunAt.Before(out[j].RunAt)
+	})
+	return out
+}
+
+// Cancel removes the job with the given ID, reporting whether it existed.
+func (s *Scheduler) Cancel(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[id]; !ok {
+		return false, nil
+	}
+	delete(s.jobs, id)
+	return true, s.save()
+}
+
+// CancelChat removes every job of the chats for which inChat returns true,
+// returning how many were removed.
+func (s *Scheduler) CancelChat(inChat func(chatID int64) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for id, job := range s.jobs {
+		if inChat(job.ChatID) {
+			delete(s.jobs, id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.save()
+}
+
+// SetPaused pauses or resumes a recurring job, reporting whether it exists.
+// Resumed jobs next run at the first match after now rather than catching up
+// on the runs they missed.
+func (s *Scheduler) SetPaused(id string, paused bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if !ok || job.Cron == "" {
+		return false, nil
+	}
+	if job.Paused && !paused {
+		if next := job.next(time.Now()); !next.IsZero() {
+			job.RunAt = next
+		}
+	}
+	job.Paused = paused
+	err := s.save()
+	s.wakeUp()
+	return true, err
+}
+
+// takeDue returns the jobs due at now and when the next job is due. One off
+// jobs are removed and recurring jobs moved to their next run, and this is
+// saved before the jobs are fired so they never fire twice.
+func (s *Scheduler) takeDue(now time.Time) ([]*Job, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []*Job
+	var next time.Time
+	for id, job := range s.jobs {
+		if job.Paused {
+			continue
+		}
+		if !job.RunAt.After(now) {
+			cp := *job
+			due = append(due, &cp)
+
+			// Runs missed while the process was down are only fired once.
+			job.RunAt = time.Time{}
+			if job.Cron != "" {
+				job.RunAt = job.next(now)
+			}
+			if job.RunAt.IsZero() {
+				delete(s.jobs, id)
+				continue
+			}
+		}
+		if next.IsZero() || job.RunAt.Before(next) {
+			next = job.RunAt
+		}
+	}
+	if len(due) == 0 {
+		return nil, next, nil
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].RunAt.Before(due[j].RunAt)
+	})
+	return due, next, s.save()
+}
+
+// chatLines fires jobs in the background, one chat at a time in the order
+// they were due, so that a slow chat doesn't hold up the jobs of others.
+type chatLines struct {
+	wg sync.WaitGroup
+
+	mu    sync.Mutex
+	tails map[int64]chan struct{}
+}
+
+// fire runs fn after the jobs of chatID fired before it have finished.
+func (l *chatLines) fire(chatID int64, fn func()) {
+	done := make(chan struct{})
+	l.mu.Lock()
+	prev := l.tails[chatID]
+	l.tails[chatID] = done
+	l.mu.Unlock()
+
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		if prev != nil {
+			<-prev
+		}
+		fn()
+		close(done)
+
+		l.mu.Lock()
+		if l.tails[chatID] == done {
+			delete(l.tails, chatID)
+		}
+		l.mu.Unlock()
+	}()
+}
+
+// Run fires jobs as they become due until ctx is done, then waits for the
+// jobs it fired to finish. Jobs are fired concurrently, except that the jobs
+// of a chat fire one at a time in order. missed is true for jobs that became
+// due before Run was called, i.e. while the process wasn't running.
+func (s *Scheduler) Run(ctx context.Context, fire func(job *Job, missed bool)) {
+	started := time.Now()
+	lines := &chatLines{tails: make(map[int64]chan struct{})}
+	defer lines.wg.Wait()
+	for {
+		now := time.Now()
+		due, next, err := s.takeDue(now)
+		if err != nil {
+			// The jobs are still fired, but may fire again after a restart.
+			s.logger.Error("failed to record fired jobs", "error", err)
+		}
+		for _, job := range due {
+			job := job
+			lines.fire(job.ChatID, func() { fire(job, job.RunAt.Before(started)) })
+		}
+
+		sleep := maxSleep
+		if !next.IsZero() && next.Sub(now) < sleep {
+			sleep = next.Sub(now)
+		}
+		timer := time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+	"github.com/hashicorp/go-hclog"
+)
+
+func newTestScheduler(t *testing.T) *Scheduler {
+	st, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(st, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRunDoesNotWaitForOtherChats(t *testing.T) {
+	s := newTestScheduler(t)
+	now := time.Now()
+	for _, j := range []struct {
+		chatID int64
+		runAt  time.Time
+		name   string
+	}{
+		{1, now.Add(-3 * time.Second), "slow"},
+		{1, now.Add(-2 * time.Second), "after slow"},
+		{2, now.Add(-time.Second), "other chat"},
+	} {
+		if _, err := s.Add("test", j.chatID, j.runAt, "test", j.name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	release := make(chan struct{})
+	fired := make(chan string, 3)
+	ctx, cancelFn := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.Run(ctx, func(job *Job, missed bool) {
+			var name string
+			if err := job.Decode(&name); err != nil {
+				t.Error(err)
+			}
+			if name == "slow" {
+				<-release
+			}
+			fired <- name
+		})
+	}()
+
+	want := []string{"other chat", "slow", "after slow"}
+	for i, w := range want {
+		if i == 1 {
+			close(release)
+		}
+		select {
+		case got := <-fired:
+			if got != w {
+				t.Fatalf("job %d: got %q, want %q", i, got, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("job %q didn't fire", w)
+		}
+	}
+
+	cancelFn()
+	wg.Wait()
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// maxLogEntrySize bounds the length of a single log entry.
+const maxLogEntrySize = 1 << 20
+
+// Store persists small documents as JSON files inside a single directory.
+// Documents are written atomically so a crash never leaves a partial file
+// behind. A Store with an empty directory keeps nothing on disk, which is
+// convenient when running without persistence.
+type Store struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func Open(dir string) (*Store, error) {
+	if dir != "" {
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create data dir: %v", err)
+		}
+	}
+
+	return &Store{dir: dir}, nil
+}
+
+func (s *Store) path(name string) string {
+	return filepath.Join(s.dir, name+".json")
+}
+
+// Load decodes the named document into v. Missing documents are not an error
+// and leave v untouched.
+func (s *Store) Load(name string, v interface{}) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// Save replaces the named document with the JSON encoding of v.
+func (s *Store) Save(name string, v interface{}) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.replace(name, s.path(name), data)
+}
+
+// replace atomically writes data to path. The caller must hold s.mu.
+func (s *Store) replace(name, path string, data []byte) error {
+	f, err := ioutil.TempFile(s.dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (s *Store) logPath(name string) string {
+	return filepath.Join(s.dir, name+".jsonl")
+}
+
+// Append adds the JSON encoding of v to the named log, one line per entry.
+// Logs suit records that are added often but rarely changed, where rewriting
+// a whole document each time would be wasteful.
+func (s *Store) Append(name string, v interface{}) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.logPath(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ReadLog calls fn with each entry of the named log, oldest first. A missing
+// log has no entries.
+func (s *Store) ReadLog(name string, fn func(entry []byte) error) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.logPath(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxLogEntrySize)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		err = fn(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// ReplaceLog atomically replaces the entries of the named log, e.g. to drop
+// old ones.
+func (s *Store) ReplaceLog(name string, entries []interface{}) error {
+	if s.dir == "" {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.replace(name, s.logPath(name), buf.Bytes())
+}
@@ -0,0 +1,49 @@
+package tokensigner
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseCIDRs parses a list of CIDRs. Bare IP addresses are accepted and
+// treated as single host networks.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %q", c)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %q", c)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// NormalizeCIDRs validates cidrs and returns them in canonical form.
+func NormalizeCIDRs(cidrs []string) ([]string, error) {
+	nets, err := ParseCIDRs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(nets))
+	for _, n := range nets {
+		out = append(out, n.String())
+	}
+	return out, nil
+}
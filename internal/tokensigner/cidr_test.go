@@ -0,0 +1,40 @@
+package tokensigner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeCIDRs(t *testing.T) {
+	cases := []struct {
+		in      []string
+		want    []string
+		wantErr bool
+	}{
+		{in: []string{}, want: []string{}},
+		{in: []string{"10.0.0.0/8", "192.168.1.7/24"}, want: []string{"10.0.0.0/8", "192.168.1.0/24"}},
+		// Bare addresses are single hosts.
+		{in: []string{"203.0.113.9", "2001:db8::1"}, want: []string{"203.0.113.9/32", "2001:db8::1/128"}},
+		{in: []string{"::ffff:203.0.113.9"}, want: []string{"203.0.113.9/32"}},
+		{in: []string{"2001:db8::/32"}, want: []string{"2001:db8::/32"}},
+		{in: []string{"10.0.0.0/33"}, wantErr: true},
+		{in: []string{"10.0.0.0/8", "example.com"}, wantErr: true},
+		{in: []string{""}, wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := NormalizeCIDRs(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tc.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -1,10 +1,55 @@
 package tokensigner
 
 import (
+	"net"
+
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
 type TokenSigner interface {
-	GenerateToken(chat *tgbotapi.Chat, user *tgbotapi.User) ([]byte, error)
-	VerifyToken(token []byte) (int64, error)
+	// GenerateToken issues a token and returns it with its claims.
+	GenerateToken(chat *tgbotapi.Chat, user *tgbotapi.User, opts *TokenOptions) ([]byte, *Claims, error)
+	VerifyToken(token []byte) (*Claims, error)
+	RevokeToken(id string) error
+}
+
+// TokenOptions are optional restrictions applied to a new token.
+type TokenOptions struct {
+	// AllowedCIDRs limits the source addresses the token may be used from.
+	AllowedCIDRs []string
+}
+
+// Claims describe a verified token.
+type Claims struct {
+	ID       string
+	ChatID   int64
+	ChatType string
+
+	// UserID is the Telegram user the token was issued to. It is zero for
+	// tokens issued before user IDs were recorded, which only have the
+	// Username they were issued to.
+	UserID   int64
+	Username string
+
+	// AllowedCIDRs is the effective source address allowlist of the token.
+	// An empty list allows every address.
+	AllowedCIDRs []string
+}
+
+// AllowsAddr reports whether the token may be used from ip.
+func (c *Claims) AllowsAddr(ip net.IP) bool {
+	if len(c.AllowedCIDRs) == 0 {
+		return true
+	}
+
+	nets, err := ParseCIDRs(c.AllowedCIDRs)
+	if err != nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
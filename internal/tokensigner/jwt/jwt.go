@@ -2,49 +2,128 @@ package jwt
 
 import (
 	"fmt"
+	"strconv"
 	"time"
 
+	"github.com/endocrimes/endobot/internal/chats"
+	"github.com/endocrimes/endobot/internal/tokensigner"
 	"github.com/gbrlsnchs/jwt/v3"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	uuid "github.com/satori/go.uuid"
 )
 
+// ChatToken is the payload of a token. Its subject is the numeric ID of the
+// user it was issued to, tokens without a UserID predate that and have the
+// username as their subject instead.
 type ChatToken struct {
 	jwt.Payload
-	ChatID int64 `json:"chat_id"`
+	ChatID       int64    `json:"chat_id"`
+	ChatType     string   `json:"chat_type,omitempty"`
+	UserID       int64    `json:"user_id,omitempty"`
+	Username     string   `json:"username,omitempty"`
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
 }
 
 type TokenSigner struct {
-	Secret *jwt.HMACSHA
+	Secret   *jwt.HMACSHA
+	Registry *tokensigner.Registry
+
+	// Chats maps the chat IDs of tokens issued before a chat migrated to
+	// its current ID.
+	Chats *chats.Directory
 }
 
-func (t *TokenSigner) GenerateToken(chat *tgbotapi.Chat, user *tgbotapi.User) ([]byte, error) {
+func (t *TokenSigner) GenerateToken(chat *tgbotapi.Chat, user *tgbotapi.User, opts *tokensigner.TokenOptions) ([]byte, *tokensigner.Claims, error) {
+	if opts == nil {
+		opts = &tokensigner.TokenOptions{}
+	}
+	cidrs, err := tokensigner.NormalizeCIDRs(opts.AllowedCIDRs)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	now := time.Now()
 	pl := ChatToken{
 		Payload: jwt.Payload{
 			Issuer:         "Terrible Systems",
-			Subject:        user.UserName,
-			ExpirationTime: jwt.NumericDate(now.Add(12 * 30 * 24 * time.Hour)),
+			Subject:        strconv.Itoa(user.ID),
+			ExpirationTime: jwt.NumericDate(now.Add(tokensigner.TokenLifetime)),
 			IssuedAt:       jwt.NumericDate(now),
 			JWTID:          uuid.NewV4().String(),
 		},
-		ChatID: chat.ID,
+		ChatID:       chat.ID,
+		ChatType:     chat.Type,
+		UserID:       int64(user.ID),
+		Username:     user.UserName,
+		AllowedCIDRs: cidrs,
 	}
 
-	return jwt.Sign(pl, t.Secret)
+	token, err := jwt.Sign(pl, t.Secret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = t.Registry.Register(&tokensigner.TokenRecord{
+		ID:       pl.JWTID,
+		ChatID:   pl.ChatID,
+		ChatType: pl.ChatType,
+		UserID:   pl.UserID,
+		Username: pl.Username,
+		IssuedAt: now,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	claims := &tokensigner.Claims{
+		ID:           pl.JWTID,
+		ChatID:       pl.ChatID,
+		ChatType:     pl.ChatType,
+		UserID:       pl.UserID,
+		Username:     pl.Username,
+		AllowedCIDRs: cidrs,
+	}
+	return token, claims, nil
 }
 
-func (t *TokenSigner) VerifyToken(token []byte) (int64, error) {
+func (t *TokenSigner) VerifyToken(token []byte) (*tokensigner.Claims, error) {
 	var ct ChatToken
 	_, err := jwt.Verify(token, t.Secret, &ct)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	now := time.Now()
 	if ct.ExpirationTime.Before(now) {
-		return 0, fmt.Errorf("Token has expired")
+		return nil, fmt.Errorf("Token has expired")
+	}
+
+	claims := &tokensigner.Claims{
+		ID:           ct.JWTID,
+		ChatID:       t.Chats.Resolve(ct.ChatID),
+		ChatType:     ct.ChatType,
+		UserID:       ct.UserID,
+		Username:     ct.Username,
+		AllowedCIDRs: ct.AllowedCIDRs,
+	}
+	if ct.UserID == 0 {
+		// Legacy tokens only carry the username.
+		claims.Username = ct.Subject
 	}
 
-	return ct.ChatID, nil
+	rec := t.Registry.Get(ct.JWTID)
+	if rec != nil {
+		if rec.Revoked {
+			return nil, fmt.Errorf("Token has been revoked")
+		}
+		if rec.CIDRsOverridden {
+			claims.AllowedCIDRs = rec.AllowedCIDRs
+		}
+	}
+
+	return claims, nil
+}
+
+func (t *TokenSigner) RevokeToken(id string) error {
+	return t.Registry.Revoke(id)
 }
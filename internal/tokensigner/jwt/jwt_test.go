@@ -0,0 +1,118 @@
+package jwt
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/chats"
+	"github.com/endocrimes/endobot/internal/store"
+	"github.com/endocrimes/endobot/internal/tokensigner"
+	"github.com/gbrlsnchs/jwt/v3"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func newTestSigner(t *testing.T) *TokenSigner {
+	st, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := tokensigner.NewRegistry(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := chats.NewDirectory(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &TokenSigner{Secret: jwt.NewHS256([]byte("secret")), Registry: reg, Chats: dir}
+}
+
+func TestGenerateTokenClaims(t *testing.T) {
+	s := newTestSigner(t)
+	chat := &tgbotapi.Chat{ID: -100, Type: "group"}
+	user := &tgbotapi.User{ID: 42, UserName: "someone"}
+
+	token, claims, err := s.GenerateToken(chat, user, &tokensigner.TokenOptions{AllowedCIDRs: []string{"10.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified, err := s.VerifyToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(claims, verified) {
+		t.Fatalf("generated claims %+v differ from the verified %+v", claims, verified)
+	}
+	if s.Registry.Get(claims.ID) == nil {
+		t.Fatal("the token wasn't registered")
+	}
+
+	if err := s.RevokeToken(claims.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.VerifyToken(token); err == nil {
+		t.Fatal("a revoked token was accepted")
+	}
+}
+
+func TestLegacyTokens(t *testing.T) {
+	s := newTestSigner(t)
+	now := time.Now()
+	token, err := jwt.Sign(ChatToken{
+		Payload: jwt.Payload{
+			Subject:        "someone",
+			ExpirationTime: jwt.NumericDate(now.Add(time.Hour)),
+			IssuedAt:       jwt.NumericDate(now),
+			JWTID:          "legacy",
+		},
+		ChatID: -100,
+	}, s.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := s.VerifyToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != 0 || claims.Username != "someone" {
+		t.Fatalf("got user %d (%q), want the username read from the subject", claims.UserID, claims.Username)
+	}
+}
+
+func TestRevokeUser(t *testing.T) {
+	s := newTestSigner(t)
+	chat := &tgbotapi.Chat{ID: -100, Type: "group"}
+	issue := func(user *tgbotapi.User) []byte {
+		token, _, err := s.GenerateToken(chat, user, &tokensigner.TokenOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	// A username moving to someone else doesn't move the tokens with it.
+	first := issue(&tgbotapi.User{ID: 42, UserName: "someone"})
+	second := issue(&tgbotapi.User{ID: 42, UserName: "renamed"})
+	other := issue(&tgbotapi.User{ID: 43, UserName: "someone"})
+
+	n, err := s.Registry.RevokeUser(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Fatalf("revoked %d tokens, want 2", n)
+	}
+	for _, token := range [][]byte{first, second} {
+		if _, err := s.VerifyToken(token); err == nil {
+			t.Fatal("a revoked token was accepted")
+		}
+	}
+	claims, err := s.VerifyToken(other)
+	if err != nil {
+		t.Fatalf("another user's token was revoked: %v", err)
+	}
+	if claims.UserID != 43 {
+		t.Fatalf("got user %d, want 43", claims.UserID)
+	}
+}
@@ -0,0 +1,251 @@
+package tokensigner
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+)
+
+const (
+	registryDocument = "tokens"
+
+	// TokenLifetime is how long tokens are valid for after they are issued.
+	TokenLifetime = 12 * 30 * 24 * time.Hour
+
+	// maxSeenAddrs bounds the number of source addresses remembered per
+	// token.
+	maxSeenAddrs = 64
+)
+
+// TokenRecord is the server side state of an issued token.
+type TokenRecord struct {
+	ID       string    `json:"id"`
+	ChatID   int64     `json:"chat_id"`
+	ChatType string    `json:"chat_type"`
+	UserID   int64     `json:"user_id"`
+	Username string    `json:"username"`
+	IssuedAt time.Time `json:"issued_at"`
+	Revoked  bool      `json:"revoked"`
+
+	// AllowedCIDRs replaces the allowlist embedded in the token when
+	// CIDRsOverridden is set.
+	CIDRsOverridden bool     `json:"cidrs_overridden"`
+	AllowedCIDRs    []string `json:"allowed_cidrs"`
+
+	// SeenAddrs are the source addresses the token has been presented from.
+	SeenAddrs []string `json:"seen_addrs"`
+
+	// DedupeWindow drops notifications identical to one the token sent
+	// within the window. Zero disables it.
+	DedupeWindow time.Duration `json:"dedupe_window,omitempty"`
+}
+
+// Registry tracks issued tokens so they can be revoked or restricted after
+// they have been handed out.
+type Registry struct {
+	store *store.Store
+
+	mu     sync.Mutex
+	tokens map[string]*TokenRecord
+}
+
+func NewRegistry(st *store.Store) (*Registry, error) {
+	r := &Registry{
+		store:  st,
+		tokens: make(map[string]*TokenRecord),
+	}
+
+	err := st.Load(registryDocument, &r.tokens)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load token registry: %v", err)
+	}
+
+	return r, nil
+}
+
+func (r *Registry) save() error {
+	return r.store.Save(registryDocument, r.tokens)
+}
+
+// Register records a newly issued token.
+func (r *Registry) Register(rec *TokenRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tokens[rec.ID] = rec
+	return r.save()
+}
+
+// Get returns a copy of the record for id, or nil if the token is unknown.
+// Tokens issued before the registry existed are unknown.
+func (r *Registry) Get(id string) *TokenRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, ok := r.tokens[id]
+	if !ok {
+		return nil
+	}
+	cp := *rec
+	return &cp
+}
+
+func (r *Registry) record(id string, chatID int64) *TokenRecord {
+	rec, ok := r.tokens[id]
+	if !ok {
+		rec = &TokenRecord{ID: id, ChatID: chatID}
+		r.tokens[id] = rec
+	}
+	return rec
+}
+
+// Revoke permanently disables the token with the given id.
+func (r *Registry) Revoke(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, ok := r.tokens[id]
+	if !ok {
+		rec = &TokenRecord{ID: id}
+		r.tokens[id] = rec
+	}
+	rec.Revoked = true
+	return r.save()
+}
+
+// List returns copies of the records matching filter, oldest first.
+func (r *Registry) List(filter func(rec *TokenRecord) bool) []*TokenRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var out []*TokenRecord
+	for _, rec := range r.tokens {
+		if filter(rec) {
+			cp := *rec
+			out = append(out, &cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].IssuedAt.Before(out[j].IssuedAt) })
+	return out
+}
+
+// RevokeUser revokes every token issued to userID, returning how many were
+// revoked.
+func (r *Registry) RevokeUser(userID int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, rec := range r.tokens {
+		if rec.UserID == userID && !rec.Revoked {
+			rec.Revoked = true
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, r.save()
+}
+
+// RevokeChat revokes every token issued for a chat for which inChat returns
+// true, returning how many tokens it had. Revoked tokens must stay known
+// until they expire, so only the details needed to reject them are kept.
+func (r *Registry) RevokeChat(inChat func(chatID int64) bool) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for id, rec := range r.tokens {
+		if inChat(rec.ChatID) {
+			r.tokens[id] = &TokenRecord{
+				ID:       rec.ID,
+				ChatID:   rec.ChatID,
+				IssuedAt: rec.IssuedAt,
+				Revoked:  true,
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, r.save()
+}
+
+// Compact removes the records of tokens that expired before t, returning
+// how many were removed. Records of tokens issued before the registry
+// existed are kept, as when they expire is unknown.
+func (r *Registry) Compact(t time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for id, rec := range r.tokens {
+		if !rec.IssuedAt.IsZero() && rec.IssuedAt.Add(TokenLifetime).Before(t) {
+			delete(r.tokens, id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, r.save()
+}
+
+// SetAllowedCIDRs replaces the source address allowlist of a token. An empty
+// list removes every restriction.
+func (r *Registry) SetAllowedCIDRs(claims *Claims, cidrs []string) error {
+	cidrs, err := NormalizeCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec := r.record(claims.ID, claims.ChatID)
+	rec.CIDRsOverridden = true
+	rec.AllowedCIDRs = cidrs
+	return r.save()
+}
+
+// SetDedupeWindow sets how long notifications sent with a token are
+// remembered to drop identical ones. Zero disables it.
+func (r *Registry) SetDedupeWindow(claims *Claims, window time.Duration) error {
+	if window < 0 {
+		return fmt.Errorf("the dedupe window must not be negative")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec := r.record(claims.ID, claims.ChatID)
+	rec.DedupeWindow = window
+	return r.save()
+}
+
+// ObserveAddr records that the token was presented from addr. It reports
+// whether the address is new and whether it is the first address the token
+// has ever been used from.
+func (r *Registry) ObserveAddr(claims *Claims, addr string) (isNew, isFirst bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec := r.record(claims.ID, claims.ChatID)
+	for _, seen := range rec.SeenAddrs {
+		if seen == addr {
+			return false, false, nil
+		}
+	}
+
+	isFirst = len(rec.SeenAddrs) == 0
+	rec.SeenAddrs = append(rec.SeenAddrs, addr)
+	if len(rec.SeenAddrs) > maxSeenAddrs {
+		rec.SeenAddrs = rec.SeenAddrs[len(rec.SeenAddrs)-maxSeenAddrs:]
+	}
+	return true, isFirst, r.save()
+}
@@ -0,0 +1,216 @@
+// Package webhook manages incoming webhook credentials. Each webhook has an
+// unguessable key that is used either as part of its URL (/in/{key}) or as a
+// static API key, and is bound to a single chat. Only a hash of the key is
+// stored.
+package webhook
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/endocrimes/endobot/internal/store"
+)
+
+const webhooksDocument = "webhooks"
+
+type Webhook struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	ChatID    int64     `json:"chat_id"`
+	CreatedBy int64     `json:"created_by"`
+	KeyHash   string    `json:"key_hash"`
+	CreatedAt time.Time `json:"created_at"`
+	RotatedAt time.Time `json:"rotated_at"`
+}
+
+type Registry struct {
+	store *store.Store
+
+	mu       sync.Mutex
+	webhooks map[string]*Webhook
+}
+
+func NewRegistry(st *store.Store) (*Registry, error) {
+	r := &Registry{
+		store:    st,
+		webhooks: make(map[string]*Webhook),
+	}
+
+	err := st.Load(webhooksDocument, &r.webhooks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load webhooks: %v", err)
+	}
+
+	return r, nil
+}
+
+func (r *Registry) save() error {
+	return r.store.Save(webhooksDocument, r.webhooks)
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func newKey() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (r *Registry) find(inChat func(chatID int64) bool, name string) *Webhook {
+	for _, w := range r.webhooks {
+		if inChat(w.ChatID) && w.Name == name {
+			return w
+		}
+	}
+	return nil
+}
+
+// Create adds a webhook owned by createdBy to chatID and returns its key. Names are unique
+// among the webhooks of the chats for which inChat returns true.
+func (r *Registry) Create(chatID int64, inChat func(chatID int64) bool, name string, createdBy int64) (*Webhook, string, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.find(inChat, name) != nil {
+		return nil, "", fmt.Errorf("a webhook called %q already exists", name)
+	}
+
+	now := time.Now()
+	w := &Webhook{
+		ID:        hashKey(key)[:12],
+		Name:      name,
+		ChatID:    chatID,
+		CreatedBy: createdBy,
+		KeyHash:   hashKey(key),
+		CreatedAt: now,
+		RotatedAt: now,
+	}
+	r.webhooks[w.ID] = w
+
+	cp := *w
+	return &cp, key, r.save()
+}
+
+// Rotate replaces the key of a webhook of the chats for which inChat returns
+// true, invalidating the old one.
+func (r *Registry) Rotate(inChat func(chatID int64) bool, name string) (*Webhook, string, error) {
+	key, err := newKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	w := r.find(inChat, name)
+	if w == nil {
+		return nil, "", fmt.Errorf("there is no webhook called %q", name)
+	}
+	w.KeyHash = hashKey(key)
+	w.RotatedAt = time.Now()
+
+	cp := *w
+	return &cp, key, r.save()
+}
+
+// Delete removes a webhook of the chats for which inChat returns true,
+// reporting whether it existed.
+func (r *Registry) Delete(inChat func(chatID int64) bool, name string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	w := r.find(inChat, name)
+	if w == nil {
+		return false, nil
+	}
+	delete(r.webhooks, w.ID)
+	return true, r.save()
+}
+
+// DeleteUser removes every webhook created by userID, returning how many
+// were removed.
+func (r *Registry) DeleteUser(userID int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for id, w := range r.webhooks {
+		if w.CreatedBy == userID {
+			delete(r.webhooks, id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, r.save()
+}
+
+// DeleteChat removes every webhook of the chats for which inChat returns
+// true, returning how many were removed.
+func (r *Registry) DeleteChat(inChat func(chatID int64) bool) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for id, w := range r.webhooks {
+		if inChat(w.ChatID) {
+			delete(r.webhooks, id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, r.save()
+}
+
+// List returns the webhooks of the chats for which inChat returns true,
+// sorted by name.
+func (r *Registry) List(inChat func(chatID int64) bool) []*Webhook {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var out []*Webhook
+	for _, w := range r.webhooks {
+		if inChat(w.ChatID) {
+			cp := *w
+			out = append(out, &cp)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Resolve returns the webhook with the given key, or nil if there is none.
+func (r *Registry) Resolve(key string) *Webhook {
+	h := hashKey(key)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, w := range r.webhooks {
+		if w.KeyHash == h {
+			cp := *w
+			return &cp
+		}
+	}
+	return nil
+}
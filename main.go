@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"sort"
+	"time"
 
 	"github.com/endocrimes/endobot/internal/commands"
 	"github.com/hashicorp/go-hclog"
@@ -45,6 +46,187 @@ func main() {
 						Usage: "The address that the HTTP API should listen to",
 						Value: ":8080",
 					},
+					&cli.DurationFlag{
+						Name: "signature-max-skew",
+						EnvVars: []string{
+							"ENDOBOT_SIGNATURE_MAX_SKEW",
+						},
+						Usage: "How far the timestamp of a signed request may differ from the server clock",
+						Value: 5 * time.Minute,
+					},
+					&cli.StringSliceFlag{
+						Name: "trusted-proxy",
+						EnvVars: []string{
+							"ENDOBOT_TRUSTED_PROXIES",
+						},
+						Usage: "CIDR of a reverse proxy whose real IP header is trusted, may be repeated",
+					},
+					&cli.StringFlag{
+						Name: "real-ip-header",
+						EnvVars: []string{
+							"ENDOBOT_REAL_IP_HEADER",
+						},
+						Usage: "Header trusted proxies use to pass on the client address",
+						Value: "X-Forwarded-For",
+					},
+					&cli.StringFlag{
+						Name: "unix-socket",
+						EnvVars: []string{
+							"ENDOBOT_UNIX_SOCKET",
+						},
+						Usage: "Path of an optional unix socket the HTTP API should also listen on",
+					},
+					&cli.StringSliceFlag{
+						Name: "unix-user",
+						EnvVars: []string{
+							"ENDOBOT_UNIX_USERS",
+						},
+						Usage: "Maps a local user to a chat for unix socket callers, as user=chat_id, may be repeated",
+					},
+					&cli.StringSliceFlag{
+						Name: "unix-group",
+						EnvVars: []string{
+							"ENDOBOT_UNIX_GROUPS",
+						},
+						Usage: "Maps a local group to a chat for unix socket callers, as group=chat_id, may be repeated",
+					},
+					&cli.StringFlag{
+						Name: "data-dir",
+						EnvVars: []string{
+							"ENDOBOT_DATA_DIR",
+						},
+						Usage: "Directory used to persist bot state, state is kept in memory if empty",
+						Value: "data",
+					},
+					&cli.DurationFlag{
+						Name: "token-message-ttl",
+						EnvVars: []string{
+							"ENDOBOT_TOKEN_MESSAGE_TTL",
+						},
+						Usage: "How long messages containing tokens are kept before they are deleted, 0 keeps them",
+						Value: 5 * time.Minute,
+					},
+					&cli.StringFlag{
+						Name: "public-url",
+						EnvVars: []string{
+							"ENDOBOT_PUBLIC_URL",
+						},
+						Usage: "Externally reachable URL of the HTTP API, used in usage examples",
+					},
+					&cli.IntFlag{
+						Name: "bot-workers",
+						EnvVars: []string{
+							"ENDOBOT_BOT_WORKERS",
+						},
+						Usage: "Number of Telegram updates processed concurrently",
+						Value: 8,
+					},
+					&cli.DurationFlag{
+						Name: "command-timeout",
+						EnvVars: []string{
+							"ENDOBOT_COMMAND_TIMEOUT",
+						},
+						Usage: "Default deadline for bot commands",
+						Value: 30 * time.Second,
+					},
+					&cli.StringFlag{
+						Name: "missed-jobs",
+						EnvVars: []string{
+							"ENDOBOT_MISSED_JOBS",
+						},
+						Usage: "What to do with scheduled notifications that came due while the bot was down: fire or skip",
+						Value: "fire",
+					},
+					&cli.DurationFlag{
+						Name: "history-retention",
+						EnvVars: []string{
+							"ENDOBOT_HISTORY_RETENTION",
+						},
+						Usage: "How long the history of notifications is kept, 0 keeps it forever",
+						Value: 90 * 24 * time.Hour,
+					},
+					&cli.DurationFlag{
+						Name: "token-retention",
+						EnvVars: []string{
+							"ENDOBOT_TOKEN_RETENTION",
+						},
+						Usage: "How long the records of expired tokens are kept, 0 keeps them forever",
+						Value: 30 * 24 * time.Hour,
+					},
+					&cli.DurationFlag{
+						Name: "audit-retention",
+						EnvVars: []string{
+							"ENDOBOT_AUDIT_RETENTION",
+						},
+						Usage: "How long audit log entries are kept, 0 keeps them forever",
+						Value: 365 * 24 * time.Hour,
+					},
+					&cli.IntFlag{
+						Name: "auth-failure-alert",
+						EnvVars: []string{
+							"ENDOBOT_AUTH_FAILURE_ALERT",
+						},
+						Usage: "Alert the owners when this many API requests fail to authenticate within 5 minutes, 0 disables it",
+					},
+					&cli.DurationFlag{
+						Name: "idempotency-window",
+						EnvVars: []string{
+							"ENDOBOT_IDEMPOTENCY_WINDOW",
+						},
+						Usage: "How long responses to requests with an Idempotency-Key are remembered",
+						Value: 24 * time.Hour,
+					},
+					&cli.StringFlag{
+						Name: "rate-limit",
+						EnvVars: []string{
+							"ENDOBOT_RATE_LIMIT",
+						},
+						Usage: "How many notifications each token, webhook or signing key may send, e.g. 30/m or 500/h, off disables it",
+						Value: "30/m",
+					},
+					&cli.IntFlag{
+						Name: "daily-quota",
+						EnvVars: []string{
+							"ENDOBOT_DAILY_QUOTA",
+						},
+						Usage: "How many notifications each token, webhook or signing key may send per UTC day, 0 disables it",
+					},
+					&cli.StringFlag{
+						Name: "chat-rate-limit",
+						EnvVars: []string{
+							"ENDOBOT_CHAT_RATE_LIMIT",
+						},
+						Usage: "How many notifications may be sent to each chat, e.g. 60/m, off disables it",
+						Value: "60/m",
+					},
+					&cli.IntFlag{
+						Name: "chat-daily-quota",
+						EnvVars: []string{
+							"ENDOBOT_CHAT_DAILY_QUOTA",
+						},
+						Usage: "How many notifications may be sent to each chat per UTC day, 0 disables it",
+					},
+					&cli.Int64SliceFlag{
+						Name: "owner",
+						EnvVars: []string{
+							"ENDOBOT_OWNERS",
+						},
+						Usage: "Telegram user ID that administers the bot, may be repeated",
+					},
+					&cli.Int64SliceFlag{
+						Name: "allow-user",
+						EnvVars: []string{
+							"ENDOBOT_ALLOWED_USERS",
+						},
+						Usage: "Telegram user ID that may use privileged commands, may be repeated",
+					},
+					&cli.Int64SliceFlag{
+						Name: "allow-chat",
+						EnvVars: []string{
+							"ENDOBOT_ALLOWED_CHATS",
+						},
+						Usage: "Telegram chat ID whose members may use privileged commands, may be repeated",
+					},
 				},
 				Action: func(c *cli.Context) error {
 					return commands.RunCommand(c, logger)